@@ -0,0 +1,196 @@
+package leaky
+
+import (
+	"errors"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AtomicBucket is a lock-free alternative to Bucket. Its value and drain time are packed into a single
+// word which is replaced with a compare-and-swap, so each operation (including the drain which precedes
+// it) takes effect in a single linearizable step without allocating.
+//
+// The drain time is stored as an offset from a per-bucket epoch, leaving fewer bits for the value than an
+// int64. NewAtomicBucket returns an error if Capacity plus OverflowLimit does not fit alongside the offset.
+// The epoch is moved forward when an offset no longer fits, which takes a lock but only happens once the
+// bucket has been in use for a while (at least 2^32 nanoseconds, about four seconds, and longer for smaller
+// buckets).
+//
+// Unlike Bucket, the parameters of an AtomicBucket cannot be changed after creation, and it does not
+// support reservations or encoding.
+type AtomicBucket struct {
+	config    Config
+	clock     Clock
+	valueBits uint
+	state     atomic.Uint64   // epoch generation, drain time offset, and value; see pack
+	epochs    [2]atomic.Int64 // Unix nanoseconds of each generation's epoch
+	rebase    sync.Mutex      // serializes moving the state to the other epoch
+}
+
+// minOffsetBits is the fewest bits an AtomicBucket may use for its drain time offset, bounding how often
+// its epoch must be moved forward.
+const minOffsetBits = 32
+
+// NewAtomicBucket creates a new, empty AtomicBucket using the parameters in the given config, applying
+// the given options to the bucket before it is returned. It returns an error if the config is invalid,
+// or Capacity plus OverflowLimit is too large to be packed with the drain time.
+//
+// Example usage:
+//
+//	bucket, err := leaky.NewAtomicBucket(leaky.Config{
+//		DrainBy:       5,
+//		DrainInterval: time.Minute,
+//		Capacity:      300,
+//	})
+//
+// Parameters:
+//
+//	config  - the parameters for the bucket
+//	opts    - the options to apply to the bucket
+//
+// Return values:
+//
+//	*AtomicBucket   - the created AtomicBucket instance
+//	error           - error message if the config or options are invalid
+func NewAtomicBucket(config Config, opts ...Option) (*AtomicBucket, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = config.Validate(); err != nil {
+		return nil, err
+	}
+	limit := config.Capacity + config.OverflowLimit
+	valueBits := uint(bits.Len64(uint64(limit)))
+	if limit < 0 || 63-valueBits < minOffsetBits {
+		return nil, errors.New("leaky: capacity and overflow limit too large for an atomic bucket")
+	}
+	b := &AtomicBucket{
+		config:    config,
+		clock:     o.clock,
+		valueBits: valueBits,
+	}
+	b.epochs[0].Store(o.clock.Now().UnixNano())
+	return b, nil // a zero state is an empty bucket drained at the epoch
+}
+
+// pack encodes the value and last drain time relative to the given generation's epoch. The generation is
+// held in the top bit, followed by the offset from the epoch in nanoseconds, with the value in the lowest
+// valueBits bits. It returns false if the offset does not fit.
+func (b *AtomicBucket) pack(gen uint64, value int64, lastDrain time.Time) (uint64, bool) {
+	offset := lastDrain.UnixNano() - b.epochs[gen].Load()
+	if offset < 0 || offset >= 1<<(63-b.valueBits) {
+		return 0, false
+	}
+	return gen<<63 | uint64(offset)<<b.valueBits | uint64(value), true
+}
+
+// unpack decodes a state produced by pack, returning the value and last drain time.
+//
+// An epoch is only changed while the current state refers to the other one. A state loaded earlier could
+// only be misread if the epoch moved twice while it was held, which takes at least 2^32 nanoseconds of
+// drain time, and storing over it would then fail unless the new state happened to be identical.
+func (b *AtomicBucket) unpack(state uint64) (int64, time.Time) {
+	gen := state >> 63
+	offset := int64(state << 1 >> (b.valueBits + 1))
+	value := int64(state & (1<<b.valueBits - 1))
+	return value, time.Unix(0, b.epochs[gen].Load()+offset)
+}
+
+// store replaces the current state with the given value and last drain time, returning false if the state
+// is no longer current. If the drain time cannot be packed relative to the current epoch, the state is
+// moved to the other generation with an epoch at the drain time.
+func (b *AtomicBucket) store(current uint64, value int64, lastDrain time.Time) bool {
+	gen := current >> 63
+	if next, ok := b.pack(gen, value, lastDrain); ok {
+		return b.state.CompareAndSwap(current, next)
+	}
+
+	b.rebase.Lock()
+	defer b.rebase.Unlock()
+	if b.state.Load() != current {
+		return false // changed while waiting for the lock
+	}
+
+	// Only a rebase changes the generation, and rebases are serialized, so nothing refers to the other epoch.
+	gen ^= 1
+	b.epochs[gen].Store(lastDrain.UnixNano())
+	next, _ := b.pack(gen, value, lastDrain)
+	return b.state.CompareAndSwap(current, next)
+}
+
+// Config returns the parameters of the bucket.
+func (b *AtomicBucket) Config() Config {
+	return b.config
+}
+
+// drained returns the current state, and the value and last drain time after a drain operation, without
+// storing them. Because draining is deterministic, there is no need to store the drained state until it is
+// next modified.
+func (b *AtomicBucket) drained(now time.Time) (uint64, int64, time.Time) {
+	current := b.state.Load()
+	value, lastDrain := b.unpack(current)
+	value, lastDrain = b.config.drain(value, lastDrain, now)
+	return current, value, lastDrain
+}
+
+// Peek returns the current value of the bucket without performing any drain.
+func (b *AtomicBucket) Peek() int64 {
+	value, _ := b.unpack(b.state.Load())
+	return value
+}
+
+// Value returns the current value of the bucket after performing a drain operation.
+func (b *AtomicBucket) Value() int64 {
+	_, value, _ := b.drained(b.clock.Now())
+	return value
+}
+
+// Remaining returns the remaining capacity of the bucket after performing a drain operation.
+//
+// Note that this may return a negative number if OverflowLimit is set.
+func (b *AtomicBucket) Remaining() int64 {
+	_, value, _ := b.drained(b.clock.Now())
+	return b.config.Capacity - value
+}
+
+// Add increments the value of the bucket by the specified amount, with the same semantics as Bucket.Add.
+// The drain, capacity check, and update happen atomically.
+func (b *AtomicBucket) Add(amount int64) error {
+	for {
+		now := b.clock.Now()
+		current, value, lastDrain := b.drained(now)
+		value, err := b.config.add(value, lastDrain, now, amount)
+		if err != nil {
+			return err
+		}
+		if b.store(current, value, lastDrain) {
+			return nil
+		}
+	}
+}
+
+// Drain reduces the value of the bucket by the specified amount. It is equivalent to calling Add with
+// a negative amount.
+func (b *AtomicBucket) Drain(amount int64) error {
+	return b.Add(-amount)
+}
+
+// Set sets the value of the bucket, with the same semantics as Bucket.Set. This resets the drain time.
+func (b *AtomicBucket) Set(value int64) error {
+	if value < 0 {
+		return errors.New("leaky: bucket value cannot be negative")
+	}
+	if value > b.config.Capacity {
+		return errors.New("leaky: bucket value cannot exceed capacity")
+	}
+
+	for {
+		now := b.clock.Now()
+		if b.store(b.state.Load(), value, now) {
+			return nil
+		}
+	}
+}
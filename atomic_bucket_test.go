@@ -0,0 +1,179 @@
+package leaky
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewAtomicBucket(t *testing.T) {
+	var err error
+
+	_, err = NewAtomicBucket(Config{DrainBy: 5, DrainInterval: time.Minute})
+	assert.EqualError(t, err, "leaky: bucket can never fill")
+
+	_, err = NewAtomicBucket(Config{DrainBy: 5, DrainInterval: time.Minute, Capacity: 1 << 31})
+	assert.EqualError(t, err, "leaky: capacity and overflow limit too large for an atomic bucket")
+	_, err = NewAtomicBucket(Config{DrainBy: 5, DrainInterval: time.Minute, Capacity: 1<<30 - 1, OverflowLimit: 1 << 30})
+	assert.Nil(t, err)
+
+	_, err = NewAtomicBucket(testRegistryConfig, WithClock(nil))
+	assert.EqualError(t, err, "leaky: clock cannot be nil")
+
+	bucket, err := NewAtomicBucket(testRegistryConfig)
+	assert.Nil(t, err)
+	assert.NotNil(t, bucket)
+	assert.Equal(t, testRegistryConfig, bucket.Config())
+	assert.Equal(t, int64(0), bucket.Peek())
+}
+
+func TestAtomicBucket(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	bucket, err := NewAtomicBucket(Config{DrainBy: 5, DrainInterval: time.Minute, Capacity: 300}, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestAtomicBucket: unexpected error %v", err)
+	}
+
+	if err = bucket.Add(100); err != nil {
+		t.Errorf("TestAtomicBucket: unexpected Add error %v", err)
+	}
+	assert.Equal(t, int64(100), bucket.Value())
+	assert.Equal(t, int64(200), bucket.Remaining())
+
+	// Test overflow
+	var fullErr *BucketFullError
+	err = bucket.Add(250)
+	if assert.ErrorAs(t, err, &fullErr) {
+		assert.Equal(t, 10*time.Minute, fullErr.RetryAfter)
+	}
+	assert.Equal(t, int64(100), bucket.Value())
+	assert.ErrorIs(t, bucket.Add(301), ErrBucketFull)
+
+	// Drains before add, and Peek doesn't drain
+	clock.Advance(time.Minute)
+	assert.Equal(t, int64(100), bucket.Peek())
+	assert.Equal(t, int64(95), bucket.Value())
+	if err = bucket.Add(205); err != nil {
+		t.Errorf("TestAtomicBucket: unexpected Add error %v", err)
+	}
+	assert.Equal(t, int64(300), bucket.Peek())
+
+	// Drain, including underflow
+	if err = bucket.Drain(100); err != nil {
+		t.Errorf("TestAtomicBucket: unexpected Drain error %v", err)
+	}
+	assert.Equal(t, int64(200), bucket.Value())
+	if err = bucket.Drain(250); err != nil {
+		t.Errorf("TestAtomicBucket: unexpected Drain error %v", err)
+	}
+	assert.Equal(t, int64(0), bucket.Value())
+
+	// Set validates, and resets the drain time
+	assert.EqualError(t, bucket.Set(-1), "leaky: bucket value cannot be negative")
+	assert.EqualError(t, bucket.Set(301), "leaky: bucket value cannot exceed capacity")
+	clock.Advance(30 * time.Second)
+	if err = bucket.Set(42); err != nil {
+		t.Errorf("TestAtomicBucket: unexpected Set error %v", err)
+	}
+	clock.Advance(59 * time.Second)
+	assert.Equal(t, int64(42), bucket.Value())
+	clock.Advance(time.Second)
+	assert.Equal(t, int64(37), bucket.Value())
+}
+
+func TestAtomicBucket_Rebase(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	bucket, err := NewAtomicBucket(Config{DrainBy: 1, DrainInterval: time.Second, Capacity: 1<<31 - 1}, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestAtomicBucket_Rebase: unexpected error %v", err)
+	}
+
+	// Offsets only have 32 bits, so each of these moves the state to the other epoch. 16.5 seconds pass in
+	// total, draining 16 units.
+	if err = bucket.Add(1000); err != nil {
+		t.Errorf("TestAtomicBucket_Rebase: unexpected Add error %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		clock.Advance(5*time.Second + 500*time.Millisecond)
+		if err = bucket.Add(10); err != nil {
+			t.Errorf("TestAtomicBucket_Rebase: unexpected Add error %v", err)
+		}
+	}
+	assert.Equal(t, int64(1014), bucket.Peek())
+	assert.Equal(t, uint64(1), bucket.state.Load()>>63)
+
+	// Partial intervals are carried over exactly
+	clock.Advance(500 * time.Millisecond)
+	assert.Equal(t, int64(1013), bucket.Value())
+	clock.Advance(999 * time.Millisecond)
+	assert.Equal(t, int64(1013), bucket.Value())
+	clock.Advance(time.Millisecond)
+	assert.Equal(t, int64(1012), bucket.Value())
+
+	// Set also moves the epoch when needed
+	clock.Advance(time.Hour)
+	if err = bucket.Set(42); err != nil {
+		t.Errorf("TestAtomicBucket_Rebase: unexpected Set error %v", err)
+	}
+	assert.Equal(t, int64(42), bucket.Value())
+	clock.Advance(time.Second)
+	assert.Equal(t, int64(41), bucket.Value())
+}
+
+func TestAtomicBucket_Concurrent(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	bucket, err := NewAtomicBucket(Config{DrainBy: 5, DrainInterval: time.Minute, Capacity: 1000}, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestAtomicBucket_Concurrent: unexpected error %v", err)
+	}
+
+	// Exactly Capacity units should be accepted, no matter how the goroutines interleave
+	accepted := int64(0)
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := bucket.Add(1); err == nil {
+					lock.Lock()
+					accepted++
+					lock.Unlock()
+				} else if !errors.Is(err, ErrBucketFull) {
+					t.Errorf("TestAtomicBucket_Concurrent: unexpected Add error %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(1000), accepted)
+	assert.Equal(t, int64(1000), bucket.Value())
+}
+
+func BenchmarkBucket_Add(b *testing.B) {
+	bucket, err := NewBucket(1, time.Nanosecond, 1000000)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_ = bucket.Add(1)
+		}
+	})
+}
+
+func BenchmarkAtomicBucket_Add(b *testing.B) {
+	bucket, err := NewAtomicBucket(Config{DrainBy: 1, DrainInterval: time.Nanosecond, Capacity: 1000000})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_ = bucket.Add(1)
+		}
+	})
+}
@@ -1,9 +1,12 @@
 package leaky
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"sync"
 	"time"
@@ -12,7 +15,40 @@ import (
 // ErrBucketFull represents an error indicating that a bucket is full or would overflow.
 var ErrBucketFull = errors.New("leaky: bucket full or would overflow")
 
+// BucketFullError is returned by Add when the bucket is full or would overflow, but would be able to
+// accept the amount after draining. It wraps ErrBucketFull, so errors.Is(err, ErrBucketFull) continues
+// to work for callers which don't need the extra detail.
+//
+// Example usage:
+//
+//	var fullErr *leaky.BucketFullError
+//	if err := bucket.Add(5); errors.As(err, &fullErr) {
+//		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(fullErr.RetryAfter.Seconds()))))
+//		w.WriteHeader(http.StatusTooManyRequests)
+//	}
+type BucketFullError struct {
+	// RetryAfter is how long until the rejected amount would fit in the bucket, assuming nothing else
+	// is added in the meantime.
+	RetryAfter time.Duration
+}
+
+// Error returns the same message as ErrBucketFull, including the retry duration.
+func (e *BucketFullError) Error() string {
+	return fmt.Sprintf("%s (retry after %s)", ErrBucketFull.Error(), e.RetryAfter)
+}
+
+// Unwrap returns ErrBucketFull.
+func (e *BucketFullError) Unwrap() error {
+	return ErrBucketFull
+}
+
+// ErrAmountTooLarge represents an error indicating that an amount can never fit in a bucket, even when empty.
+var ErrAmountTooLarge = errors.New("leaky: amount exceeds bucket capacity and overflow limit")
+
 // Bucket represents a leaky bucket implementation for rate limiting or throttling.
+//
+// The exported fields may be set freely before the bucket is shared, but must not be modified while
+// other goroutines are using the bucket. Use Reconfigure to change them safely at runtime.
 type Bucket struct {
 	DrainBy       int64
 	DrainInterval time.Duration
@@ -27,11 +63,62 @@ type Bucket struct {
 	// Defaults to zero, providing a hard limit for the bucket.
 	OverflowLimit int64
 
+	// Mode configures how the bucket drains over time. See DrainMode for details.
+	//
+	// Defaults to DrainStepped, draining DrainBy units each time a full DrainInterval elapses.
+	Mode DrainMode
+
 	value     int64
 	lastDrain time.Time
+	clock     Clock
+	drained   int64          // total units drained from the front of the bucket, used to settle reservations
+	reserved  []*Reservation // outstanding reservations, in the order they were made
 	lock      sync.Mutex
 }
 
+// DrainMode determines how a Bucket drains over time.
+type DrainMode int32
+
+const (
+	// DrainStepped drains the bucket by DrainBy units each time a full DrainInterval elapses. Partial
+	// intervals are carried over to the next drain, but don't drain anything on their own. This is
+	// the default mode.
+	DrainStepped DrainMode = 0
+
+	// DrainContinuous drains the bucket proportionally to the time elapsed, at a rate of DrainBy units
+	// per DrainInterval. For example, a bucket draining 5 units every 2 minutes will have drained 2 units
+	// after 1 minute. Time which has not yet amounted to a whole unit is carried over to the next drain.
+	DrainContinuous DrainMode = 1
+)
+
+// Option configures optional behaviour of a Bucket when passed to NewBucketWithOptions.
+type Option func(o *options)
+
+type options struct {
+	clock Clock
+}
+
+// newOptions applies the given options over the defaults.
+func newOptions(opts []Option) (*options, error) {
+	o := &options{
+		clock: RealClock,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.clock == nil {
+		return nil, errors.New("leaky: clock cannot be nil")
+	}
+	return o, nil
+}
+
+// WithClock sets the Clock used by the bucket to determine the current time. Defaults to RealClock.
+func WithClock(clock Clock) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
+}
+
 // NewBucket creates a new Bucket with the given drainBy, drainEvery, and capacity parameters.
 // It returns an error if any of the parameters are invalid.
 //
@@ -50,26 +137,45 @@ type Bucket struct {
 //	*Bucket     - the created Bucket instance
 //	error       - error message if any of the parameters are invalid
 func NewBucket(drainBy int64, drainEvery time.Duration, capacity int64) (*Bucket, error) {
-	if drainBy <= 0 || drainEvery <= 0 {
-		return nil, errors.New("leaky: bucket never drains")
-	}
-	if capacity <= 0 {
-		return nil, errors.New("leaky: bucket can never fill")
-	}
-	return &Bucket{
+	return NewBucketWithOptions(drainBy, drainEvery, capacity)
+}
+
+// NewBucketWithOptions creates a new Bucket in the same way as NewBucket, applying the given options
+// to the bucket before it is returned.
+//
+// Example usage:
+//
+//	clock := leaky.NewManualClock(time.Now())
+//	bucket, err := leaky.NewBucketWithOptions(5, 1 * time.Minute, 300, leaky.WithClock(clock))
+//
+// Parameters:
+//
+//	drainBy     - the amount to drain the bucket by each drain interval
+//	drainEvery  - the duration between each drain interval
+//	capacity    - the maximum capacity the bucket can hold
+//	opts        - the options to apply to the bucket
+//
+// Return values:
+//
+//	*Bucket     - the created Bucket instance
+//	error       - error message if any of the parameters are invalid
+func NewBucketWithOptions(drainBy int64, drainEvery time.Duration, capacity int64, opts ...Option) (*Bucket, error) {
+	return NewBucketFromConfig(Config{
 		DrainBy:       drainBy,
 		DrainInterval: drainEvery,
 		Capacity:      capacity,
-		value:         0,
-		lastDrain:     time.Now(),
-		lock:          sync.Mutex{},
-	}, nil
+	}, opts...)
 }
 
 // DecodeBucket produces a Bucket from a previous Encode operation.
 // It returns an error if any read operation fails. Read operations are performed sequentially rather
 // than atomically. If an error occurs, partial data may remain on the reader.
 //
+// Both EncodingStandard and EncodingCompact are detected automatically.
+//
+// Buckets encoded by older versions of this library (format 1) are still accepted, though they carry no
+// checksum. As format 1 predates Mode, they are decoded using DrainStepped.
+//
 // Example usage:
 //
 //	buf := bytes.NewBuffer(myEncodedData)
@@ -88,19 +194,32 @@ func NewBucket(drainBy int64, drainEvery time.Duration, capacity int64) (*Bucket
 //	*Bucket - the Bucket instance decoded from the binary data in r
 //	error   - error message if any errors occurred during reading or decoding
 func DecodeBucket(r io.Reader) (*Bucket, error) {
-	bucket := &Bucket{}
-
-	bucket.lock.Lock()
-	defer bucket.lock.Unlock()
-
 	// Check format version
 	format := int32(0)
 	if err := binary.Read(r, binary.BigEndian, &format); err != nil {
 		return nil, errors.Join(errors.New("leaky: unable to read format version"), err)
 	}
-	if format != 1 {
-		return nil, fmt.Errorf("leaky: unsupported format version %d", format)
+	switch format {
+	case 1:
+		return decodeUnframed(r)
+	case 2:
+		return decodeFramed(r)
 	}
+	if byte(format>>24) == compactMarker {
+		// The rest of the "version" is the start of the compact encoding
+		header := binary.BigEndian.AppendUint32(nil, uint32(format))
+		return decodeCompact(io.MultiReader(bytes.NewReader(header[1:]), r))
+	}
+	return nil, fmt.Errorf("leaky: unsupported format version %d", format)
+}
+
+// decodeUnframed reads the fields of a format 1 bucket, which are written sequentially without a length
+// or checksum.
+func decodeUnframed(r io.Reader) (*Bucket, error) {
+	bucket := &Bucket{}
+
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
 
 	// Read fields in write order
 	if err := binary.Read(r, binary.BigEndian, &bucket.DrainBy); err != nil {
@@ -119,11 +238,12 @@ func DecodeBucket(r io.Reader) (*Bucket, error) {
 	if err := binary.Read(r, binary.BigEndian, &timestampSize); err != nil {
 		return nil, errors.Join(errors.New("leaky: unable to read size of `lastDrain`"), err)
 	}
+	if timestampSize < 0 || timestampSize > maxTimestampSize {
+		return nil, fmt.Errorf("leaky: invalid size of `lastDrain` %d", timestampSize)
+	}
 	timestampBytes := make([]byte, timestampSize)
-	if c, err := r.Read(timestampBytes); err != nil {
+	if _, err := io.ReadFull(r, timestampBytes); err != nil {
 		return nil, errors.Join(errors.New("leaky: unable to read `lastDrain`"), err)
-	} else if int32(c) != timestampSize {
-		return nil, errors.New("leaky: did not read entire timestamp")
 	}
 	if err := bucket.lastDrain.UnmarshalBinary(timestampBytes); err != nil {
 		return nil, errors.Join(errors.New("leaky: unable to unmarshal `lastDrain`"), err)
@@ -135,10 +255,148 @@ func DecodeBucket(r io.Reader) (*Bucket, error) {
 	return bucket, nil
 }
 
+// decodeFramed reads a format 2 bucket: the payload length, the payload, then a CRC-32 (IEEE) checksum
+// of the payload. The payload is only parsed once the checksum has been verified.
+func decodeFramed(r io.Reader) (*Bucket, error) {
+	length := uint32(0)
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, errors.Join(errors.New("leaky: unable to read payload length"), err)
+	}
+	if length > maxPayloadSize {
+		return nil, fmt.Errorf("leaky: invalid payload length %d", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errors.Join(errors.New("leaky: unable to read payload"), err)
+	}
+	checksum := uint32(0)
+	if err := binary.Read(r, binary.BigEndian, &checksum); err != nil {
+		return nil, errors.Join(errors.New("leaky: unable to read checksum"), err)
+	}
+	if actual := crc32.ChecksumIEEE(payload); actual != checksum {
+		return nil, fmt.Errorf("leaky: checksum mismatch (expected %08x, got %08x)", checksum, actual)
+	}
+
+	// The checksum passed, so any problems from here are from a faulty encoder rather than corruption
+	bucket := &Bucket{}
+	p := bytes.NewReader(payload)
+	flags, err := p.ReadByte()
+	if err != nil {
+		return nil, errors.Join(errors.New("leaky: unable to read flags"), err)
+	}
+	if flags&^(flagLastDrain|flagOverflowLimit|flagMode) != 0 {
+		return nil, fmt.Errorf("leaky: unsupported flags %08b", flags)
+	}
+	if err = binary.Read(p, binary.BigEndian, &bucket.DrainBy); err != nil {
+		return nil, errors.Join(errors.New("leaky: unable to read `DrainBy`"), err)
+	}
+	if err = binary.Read(p, binary.BigEndian, &bucket.DrainInterval); err != nil {
+		return nil, errors.Join(errors.New("leaky: unable to read `DrainInterval`"), err)
+	}
+	if err = binary.Read(p, binary.BigEndian, &bucket.Capacity); err != nil {
+		return nil, errors.Join(errors.New("leaky: unable to read `Capacity`"), err)
+	}
+	if err = binary.Read(p, binary.BigEndian, &bucket.value); err != nil {
+		return nil, errors.Join(errors.New("leaky: unable to read `value`"), err)
+	}
+	if flags&flagLastDrain != 0 {
+		timestampSize, err := p.ReadByte()
+		if err != nil {
+			return nil, errors.Join(errors.New("leaky: unable to read size of `lastDrain`"), err)
+		}
+		timestampBytes := make([]byte, timestampSize)
+		if _, err = io.ReadFull(p, timestampBytes); err != nil {
+			return nil, errors.Join(errors.New("leaky: unable to read `lastDrain`"), err)
+		}
+		if err = bucket.lastDrain.UnmarshalBinary(timestampBytes); err != nil {
+			return nil, errors.Join(errors.New("leaky: unable to unmarshal `lastDrain`"), err)
+		}
+	}
+	if flags&flagOverflowLimit != 0 {
+		if err = binary.Read(p, binary.BigEndian, &bucket.OverflowLimit); err != nil {
+			return nil, errors.Join(errors.New("leaky: unable to read `OverflowLimit`"), err)
+		}
+	}
+	if flags&flagMode != 0 {
+		if err = binary.Read(p, binary.BigEndian, &bucket.Mode); err != nil {
+			return nil, errors.Join(errors.New("leaky: unable to read `Mode`"), err)
+		}
+		if bucket.Mode != DrainStepped && bucket.Mode != DrainContinuous {
+			return nil, fmt.Errorf("leaky: unsupported drain mode %d", bucket.Mode)
+		}
+	}
+	if p.Len() > 0 {
+		return nil, errors.New("leaky: unexpected data after payload")
+	}
+
+	return bucket, nil
+}
+
+const (
+	// maxTimestampSize is the largest encoded `lastDrain` accepted, well above what time.Time produces.
+	maxTimestampSize = 64
+
+	// maxPayloadSize is the largest format 2 payload accepted, well above the size of every field.
+	maxPayloadSize = 1024
+)
+
+// Flags for optional fields in a format 2 payload. Fields which are at their zero value are omitted.
+const (
+	flagLastDrain     byte = 1 << 0
+	flagOverflowLimit byte = 1 << 1
+	flagMode          byte = 1 << 2
+)
+
+// Encoding selects how EncodeWith writes a bucket.
+type Encoding int
+
+const (
+	// EncodingStandard is the encoding used by Encode, with fixed-size fields, a length, and a checksum.
+	EncodingStandard Encoding = 0
+
+	// EncodingCompact uses variable-length integers, stores the last drain time as nanoseconds relative
+	// to a fixed epoch, and omits fields which are at their default values. It is typically less than
+	// half the size of EncodingStandard, making it useful for storing large numbers of buckets. It does
+	// not carry a checksum, and the last drain time loses its time zone and monotonic clock reading.
+	EncodingCompact Encoding = 1
+)
+
+// EncodeWith writes the bucket's state to the provided io.Writer using the given encoding. DecodeBucket
+// detects which encoding was used. See Encode for details.
+//
+// Example usage:
+//
+//	buf := &bytes.Buffer{}
+//	if err := bucket.EncodeWith(buf, leaky.EncodingCompact); err != nil {
+//		log.Fatal(err)
+//	}
+//
+// Parameters:
+//
+//	w           - an io.Writer interface to which the binary data will be written
+//	encoding    - the encoding to use
+//
+// Return values:
+//
+//	error   - error message if any errors occurred during writing or encoding
+func (b *Bucket) EncodeWith(w io.Writer, encoding Encoding) error {
+	switch encoding {
+	case EncodingStandard:
+		return b.Encode(w)
+	case EncodingCompact:
+		return b.encodeCompact(w)
+	default:
+		return fmt.Errorf("leaky: unsupported encoding %d", encoding)
+	}
+}
+
 // Encode writes the bucket's state to the provided io.Writer.
 // It returns an error if any writing operation fails. Write operations are performed sequentially rather
 // than atomically. If an error occurs, partial data may be written to the writer.
 //
+// The encoding (format 2) is framed by the payload length and followed by a CRC-32 checksum of the payload,
+// allowing DecodeBucket to detect truncated or corrupted data.
+//
 // Example usage:
 //
 //	buf := &bytes.Buffer{}
@@ -155,90 +413,203 @@ func DecodeBucket(r io.Reader) (*Bucket, error) {
 //
 //	error   - error message if any errors occurred during writing or encoding
 func (b *Bucket) Encode(w io.Writer) error {
-	b.lock.Lock()
-	defer b.lock.Unlock()
+	payload, err := b.encodePayload()
+	if err != nil {
+		return err
+	}
 
 	// Format version
-	if err := binary.Write(w, binary.BigEndian, int32(1)); err != nil {
+	if err = binary.Write(w, binary.BigEndian, int32(2)); err != nil {
 		return errors.Join(errors.New("leaky: unable to write format version"), err)
 	}
 
-	// Fields, ordered
-	if err := binary.Write(w, binary.BigEndian, b.DrainBy); err != nil {
-		return errors.Join(errors.New("leaky: unable to write `DrainBy`"), err)
+	// Framed payload
+	if err = binary.Write(w, binary.BigEndian, uint32(len(payload))); err != nil {
+		return errors.Join(errors.New("leaky: unable to write payload length"), err)
 	}
-	if err := binary.Write(w, binary.BigEndian, b.DrainInterval); err != nil {
-		return errors.Join(errors.New("leaky: unable to write `DrainInterval`"), err)
+	if _, err = w.Write(payload); err != nil {
+		return errors.Join(errors.New("leaky: unable to write payload"), err)
 	}
-	if err := binary.Write(w, binary.BigEndian, b.Capacity); err != nil {
-		return errors.Join(errors.New("leaky: unable to write `Capacity`"), err)
+	if err = binary.Write(w, binary.BigEndian, crc32.ChecksumIEEE(payload)); err != nil {
+		return errors.Join(errors.New("leaky: unable to write checksum"), err)
 	}
-	if err := binary.Write(w, binary.BigEndian, b.value); err != nil {
-		return errors.Join(errors.New("leaky: unable to write `value`"), err)
-	}
-	if timestampBytes, err := b.lastDrain.MarshalBinary(); err != nil {
-		return errors.Join(errors.New("leaky: unable to marshal `lastDrain`"), err)
-	} else {
-		if err := binary.Write(w, binary.BigEndian, int32(len(timestampBytes))); err != nil {
-			return errors.Join(errors.New("leaky: unable to write length of `lastDrain`"), err)
-		}
-		if _, err := w.Write(timestampBytes); err != nil {
-			return errors.Join(errors.New("leaky: unable to write `lastDrain`"), err)
+
+	return nil
+}
+
+// encodePayload produces the format 2 payload for the bucket.
+func (b *Bucket) encodePayload() ([]byte, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	flags := byte(0)
+	var timestampBytes []byte
+	if !b.lastDrain.IsZero() {
+		var err error
+		if timestampBytes, err = b.lastDrain.MarshalBinary(); err != nil {
+			return nil, errors.Join(errors.New("leaky: unable to marshal `lastDrain`"), err)
 		}
+		flags |= flagLastDrain
+	}
+	if b.OverflowLimit != 0 {
+		flags |= flagOverflowLimit
 	}
-	if err := binary.Write(w, binary.BigEndian, b.OverflowLimit); err != nil {
-		return errors.Join(errors.New("leaky: unable to write `OverflowLimit`"), err)
+	if b.Mode != DrainStepped {
+		flags |= flagMode
 	}
 
-	return nil
+	// Fields, ordered
+	payload := make([]byte, 0, 64)
+	payload = append(payload, flags)
+	payload = binary.BigEndian.AppendUint64(payload, uint64(b.DrainBy))
+	payload = binary.BigEndian.AppendUint64(payload, uint64(b.DrainInterval))
+	payload = binary.BigEndian.AppendUint64(payload, uint64(b.Capacity))
+	payload = binary.BigEndian.AppendUint64(payload, uint64(b.value))
+	if flags&flagLastDrain != 0 {
+		payload = append(payload, byte(len(timestampBytes)))
+		payload = append(payload, timestampBytes...)
+	}
+	if flags&flagOverflowLimit != 0 {
+		payload = binary.BigEndian.AppendUint64(payload, uint64(b.OverflowLimit))
+	}
+	if flags&flagMode != 0 {
+		payload = binary.BigEndian.AppendUint32(payload, uint32(b.Mode))
+	}
+	return payload, nil
+}
+
+// getClock returns the bucket's clock, defaulting to RealClock if the bucket was not created with one.
+func (b *Bucket) getClock() Clock {
+	if b.clock == nil {
+		return RealClock
+	}
+	return b.clock
 }
 
-// drain updates the value of the bucket by subtracting the drained amount based on the elapsed time since the last drain.
-// If the bucket is already empty, it does nothing.
+// now returns the current time according to the bucket's clock.
+func (b *Bucket) now() time.Time {
+	return b.getClock().Now()
+}
+
+// Config returns the bucket's current parameters.
+func (b *Bucket) Config() Config {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.config()
+}
+
+// Reconfigure changes the bucket's parameters. The new config is validated in the same way as
+// NewBucketFromConfig, and an error is returned if it is invalid, leaving the bucket unchanged.
 //
-// If the bucket has never been drained before, it sets the last drain time as the current time.
-// If the bucket value is zero or negative after the drain, it sets the value to zero and updates the last drain time.
+// Before switching, a drain operation is performed using the old parameters, so time which has already
+// elapsed is drained at the old rate. Any partial interval carried over by that drain is discarded, and
+// draining at the new rate begins from the time of the call.
 //
-// The elapsed time since the last drain is calculated by subtracting the last drain time from the current time.
-// The elapsed time is truncated to the nearest multiple of the drain interval.
-// The number of leaks is then calculated by dividing the elapsed time by the drain interval.
-// The drained amount is calculated by multiplying the drain by the number of leaks.
-// The bucket value is updated by subtracting the drained amount.
-// If the bucket value becomes negative, it is set to zero.
+// The bucket's value is kept as-is. If it exceeds the new Capacity, further Adds are rejected until it
+// drains below capacity again.
 //
-// Finally, the last drain time is updated to the current time minus the remaining elapsed time (since - drainTime).
-func (b *Bucket) drain() {
+// Example usage:
+//
+//	config := bucket.Config()
+//	config.Capacity = 700
+//	if err := bucket.Reconfigure(config); err != nil {
+//		log.Fatal(err)
+//	}
+//
+// Parameters:
+//
+//	config  - the new parameters for the bucket
+//
+// Return values:
+//
+//	error   - error message if the config is invalid
+func (b *Bucket) Reconfigure(config Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
-	if b.lastDrain.IsZero() {
-		b.lastDrain = time.Now() // assume we've never drained
+	now := b.now()
+	b.drainLocked(now) // settle under the old parameters
+
+	b.DrainBy = config.DrainBy
+	b.DrainInterval = config.DrainInterval
+	b.Capacity = config.Capacity
+	b.OverflowLimit = config.OverflowLimit
+	b.Mode = config.Mode
+	b.lastDrain = now
+	return nil
+}
+
+// config returns the bucket's parameters as a Config.
+//
+// The caller must hold the bucket's lock.
+func (b *Bucket) config() Config {
+	return Config{
+		DrainBy:       b.DrainBy,
+		DrainInterval: b.DrainInterval,
+		Capacity:      b.Capacity,
+		OverflowLimit: b.OverflowLimit,
+		Mode:          b.Mode,
 	}
+}
+
+// drain takes the bucket's lock and performs a drain operation. See drainLocked for details.
+func (b *Bucket) drain() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.drainLocked(b.now())
+}
 
-	if b.value <= 0 {
-		b.value = 0
-		b.lastDrain = time.Now()
-		return // nothing to drain, so don't bother
+// drainLocked updates the value of the bucket by subtracting the drained amount based on the elapsed time
+// since the last drain. See Config.drain for details.
+//
+// The caller must hold the bucket's lock.
+func (b *Bucket) drainLocked(now time.Time) {
+	before := b.value
+	b.value, b.lastDrain = b.config().drain(b.value, b.lastDrain, now)
+	if before > b.value {
+		b.drained += before - b.value
 	}
+}
 
-	since := time.Since(b.lastDrain)
-	drainTime := since.Truncate(b.DrainInterval)
-	leaks := int64(drainTime.Abs() / b.DrainInterval.Abs())
-	b.value -= b.DrainBy * leaks
-	if b.value < 0 {
-		b.value = 0
+// setValueLocked sets the value of the bucket. If the value is lowered, the removed units are counted as
+// drained from the front of the bucket, so outstanding reservations are settled as though the bucket had
+// drained that far.
+//
+// The caller must hold the bucket's lock.
+func (b *Bucket) setValueLocked(value int64) {
+	if value < b.value {
+		b.drained += b.value - value
 	}
-	b.lastDrain = time.Now().Add((since - drainTime) * -1)
+	b.value = value
+}
+
+// resetValueLocked replaces the value of the bucket with unrelated state, such as a decoded bucket. All of
+// the previous fill is counted as drained, and outstanding reservations are no longer tracked, so
+// cancelling them refunds nothing.
+//
+// The caller must hold the bucket's lock.
+func (b *Bucket) resetValueLocked(value int64) {
+	b.drained += b.value
+	b.reserved = nil
+	b.value = value
 }
 
 // Peek returns the current value of the bucket without performing any drain.
 func (b *Bucket) Peek() int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
 	return b.value
 }
 
 // Value returns the current value of the bucket after performing a drain operation.
 func (b *Bucket) Value() int64 {
-	b.drain()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.drainLocked(b.now())
 	return b.value
 }
 
@@ -251,14 +622,31 @@ func (b *Bucket) Value() int64 {
 //
 // Returns the remaining capacity as an int64 value.
 func (b *Bucket) Remaining() int64 {
-	b.drain()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.drainLocked(b.now())
 	return b.Capacity - b.value
 }
 
+// TimeToEmpty returns how long until the bucket will have fully drained, if nothing more is added. It
+// first applies the drain operation to update the bucket's internal value.
+func (b *Bucket) TimeToEmpty() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := b.now()
+	b.drainLocked(now)
+	return b.config().until(b.value, b.lastDrain, now, 0)
+}
+
 // Add increments the value of the Bucket by the specified amount.
 // If the new value would exceed Capacity, ErrBucketFull is returned without modifying the bucket's
-// internal value. Otherwise, the amount is added to the bucket atomically. In either case, a drain
-// operation is performed before checking the capacity.
+// internal value. Otherwise, the amount is added to the bucket. In either case, a drain operation is
+// performed before checking the capacity. The drain, capacity check, and update happen atomically.
+//
+// When the amount would fit after the bucket drains, the returned error is a *BucketFullError carrying
+// the duration until the amount would fit. If the amount can never fit within Capacity and OverflowLimit,
+// ErrBucketFull is returned directly.
 //
 // The amount may be negative to drain the bucket instead. ErrBucketFull will not be raised when
 // draining. Note that when negative the bucket may additionally drain on its own. For example, if
@@ -273,37 +661,85 @@ func (b *Bucket) Remaining() int64 {
 //
 // Return values:
 //
-//	error   - ErrBucketFull if the new value would exceed the capacity, otherwise nil
+//	error   - *BucketFullError or ErrBucketFull if the new value would exceed the capacity, otherwise nil
 func (b *Bucket) Add(amount int64) error {
-	b.drain() // always drain first
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := b.now()
+	b.drainLocked(now) // always drain first
 
 	if amount == 0 {
 		return nil // optimization
 	}
 
-	b.lock.Lock()
-	defer b.lock.Unlock()
+	newValue, err := b.config().add(b.value, b.lastDrain, now, amount)
+	if err != nil {
+		return err
+	}
 
-	newValue := b.value + amount
-	if newValue < 0 {
-		newValue = 0
+	if newValue < b.value {
+		b.drained += b.value - newValue
 	}
+	b.value = newValue
+	return nil
+}
+
+// Wait adds the specified amount to the Bucket, blocking until the bucket can accept it.
+// If the amount cannot be added immediately, Wait calculates when enough drain intervals will have
+// elapsed for the amount to fit, sleeps for that long, and tries again.
+//
+// ErrAmountTooLarge is returned without blocking if the amount could never fit within the bucket's
+// Capacity and OverflowLimit. If the context is cancelled while waiting, the context's error is
+// returned and the bucket is not modified.
+//
+// Example usage:
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+//	defer cancel()
+//	if err := bucket.Wait(ctx, 5); err != nil {
+//		log.Fatal(err)
+//	}
+//
+// Parameters:
+//
+//	ctx     - the context which may cancel the wait
+//	amount  - the amount by which the bucket's value will be incremented
+//
+// Return values:
+//
+//	error   - ErrAmountTooLarge, the context's error, or nil once the amount has been added
+func (b *Bucket) Wait(ctx context.Context, amount int64) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
-	// Only check capacity if we're heading towards the upper limit
-	if amount > 0 {
-		// Are we already over capacity? Error if so.
-		if b.value > b.Capacity {
-			return ErrBucketFull
+		err := b.Add(amount)
+		var fullErr *BucketFullError
+		if !errors.As(err, &fullErr) {
+			if errors.Is(err, ErrBucketFull) {
+				return ErrAmountTooLarge // can never fit
+			}
+			return err
 		}
 
-		// Are we about to overflow beyond what we're allowed to? Error if so.
-		if newValue > (b.Capacity + b.OverflowLimit) {
-			return ErrBucketFull
+		timer := b.getClock().NewTimer(fullErr.RetryAfter)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C():
 		}
 	}
+}
 
-	b.value = newValue
-	return nil
+// delay returns how long until the given amount can be added to the bucket, assuming the bucket
+// was drained at the given time. If the amount can never be added, false is returned.
+//
+// The caller must hold the bucket's lock.
+func (b *Bucket) delay(amount int64, now time.Time) (time.Duration, bool) {
+	return b.config().delay(b.value, b.lastDrain, now, amount)
 }
 
 // Drain reduces the value of the bucket by the specified amount.
@@ -325,7 +761,8 @@ func (b *Bucket) Drain(amount int64) error {
 
 // Set sets the value of the Bucket.
 // The value must be positive or zero, and within capacity for the bucket. An error is returned otherwise.
-// This is an atomic operation, and resets the drain time.
+// This is an atomic operation, and resets the drain time. Lowering the value counts as draining the bucket,
+// so cancelled reservations are only refunded for what remains of them.
 //
 // Parameters:
 //
@@ -335,6 +772,9 @@ func (b *Bucket) Drain(amount int64) error {
 //
 //	error   - error message if the value is invalid
 func (b *Bucket) Set(value int64) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
 	if value < 0 {
 		return errors.New("leaky: bucket value cannot be negative")
 	}
@@ -342,10 +782,46 @@ func (b *Bucket) Set(value int64) error {
 		return errors.New("leaky: bucket value cannot exceed capacity")
 	}
 
+	b.setValueLocked(value)
+	b.lastDrain = b.now()
+	return nil
+}
+
+// Backoff raises the value of the Bucket so that nothing can be added to it for at least retryAfter,
+// based on its drain parameters. This is useful for clients when a server reports that they are being
+// rate limited, so that their own bucket matches the server's. The value may exceed Capacity and
+// OverflowLimit, and is never lowered. A drain operation is performed first.
+//
+// Example usage:
+//
+//	if resp.StatusCode == http.StatusTooManyRequests {
+//		bucket.Backoff(30 * time.Second) // from the Retry-After header
+//	}
+//
+// Parameters:
+//
+//	retryAfter  - how long the bucket should not accept any amount for
+func (b *Bucket) Backoff(retryAfter time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := b.now()
+	b.drainLocked(now)
+	b.value = b.config().backoff(b.value, b.lastDrain, now, retryAfter)
+}
+
+// Raise raises the value of the Bucket to at least the given value, such as when a server reports less
+// remaining capacity than the bucket would allow. The value is never lowered, and the time elapsed since
+// the last drain is kept. A drain operation is performed first, and the drain, comparison and update
+// happen atomically.
+//
+// Parameters:
+//
+//	value   - the minimum value for the bucket
+func (b *Bucket) Raise(value int64) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
-	b.value = value
-	b.lastDrain = time.Now()
-	return nil
+	b.drainLocked(b.now())
+	b.value = max(b.value, value)
 }
@@ -2,8 +2,14 @@ package leaky
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
+	"hash/crc32"
 	"io"
+	"math"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -94,6 +100,69 @@ func TestNewBucket(t *testing.T) {
 	assert.Equal(t, int64(0), bucket.OverflowLimit)
 }
 
+func TestNewBucketWithOptions(t *testing.T) {
+	var err error
+
+	// Validates like NewBucket
+	_, err = NewBucketWithOptions(0, time.Minute, 300)
+	assert.EqualError(t, err, "leaky: bucket never drains")
+	_, err = NewBucketWithOptions(5, time.Minute, 0)
+	assert.EqualError(t, err, "leaky: bucket can never fill")
+
+	// Nil clock
+	_, err = NewBucketWithOptions(5, time.Minute, 300, WithClock(nil))
+	assert.EqualError(t, err, "leaky: clock cannot be nil")
+
+	// Happy path
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	bucket, err := NewBucketWithOptions(5, time.Minute, 300, WithClock(clock))
+	assert.Nil(t, err)
+	assert.NotNil(t, bucket)
+	assert.Equal(t, int64(5), bucket.DrainBy)
+	assert.Equal(t, time.Minute, bucket.DrainInterval)
+	assert.Equal(t, int64(300), bucket.Capacity)
+	assert.Equal(t, int64(0), bucket.value)
+	assert.Equal(t, clock.Now(), bucket.lastDrain)
+	assert.Equal(t, Clock(clock), bucket.clock)
+}
+
+func TestBucket_ManualClock(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	bucket, err := NewBucketWithOptions(5, 2*time.Minute, 300, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestBucket_ManualClock: unexpected error %v", err)
+	}
+
+	if err = bucket.Add(300); err != nil {
+		t.Errorf("TestBucket_ManualClock: unexpected Add error %v", err)
+	}
+
+	// Doesn't drain without the clock moving
+	assert.Equal(t, int64(300), bucket.Value())
+
+	// Drains in whole intervals only
+	clock.Advance(2*time.Minute - time.Nanosecond)
+	assert.Equal(t, int64(300), bucket.Value())
+	clock.Advance(time.Nanosecond)
+	assert.Equal(t, int64(295), bucket.Value())
+
+	// Partial intervals are carried over
+	clock.Advance(3 * time.Minute)
+	assert.Equal(t, int64(290), bucket.Value())
+	clock.Advance(time.Minute)
+	assert.Equal(t, int64(285), bucket.Value())
+
+	// Drains fully over long periods
+	clock.Advance(24 * time.Hour)
+	assert.Equal(t, int64(0), bucket.Value())
+
+	// Set uses the clock for the drain time
+	if err = bucket.Set(100); err != nil {
+		t.Errorf("TestBucket_ManualClock: unexpected Set error %v", err)
+	}
+	assert.Equal(t, clock.Now(), bucket.lastDrain)
+}
+
 func TestBucketEncodeThenDecode(t *testing.T) {
 	for i, createFn := range createCaseFunctions {
 		bucket, err := createFn(5, time.Minute, 300)
@@ -104,6 +173,7 @@ func TestBucketEncodeThenDecode(t *testing.T) {
 		bucket.value = 42                                            // force a given value
 		bucket.lastDrain = time.Now().Add(-1 * bucket.DrainInterval) // prepare for 1 drain operation
 		bucket.OverflowLimit = 24                                    // force a given value
+		bucket.Mode = DrainContinuous                                // force a given value
 
 		// Encode
 		buf := &bytes.Buffer{}
@@ -126,9 +196,53 @@ func TestBucketEncodeThenDecode(t *testing.T) {
 		assert.Equalf(t, 0, bucket2.lastDrain.Compare(bucket.lastDrain), "TestBucketEncodeThenDecode(case:%d)", i)
 		assert.Equalf(t, bucket.lastDrain.UnixNano(), bucket2.lastDrain.UnixNano(), "TestBucketEncodeThenDecode(case:%d)", i)
 		assert.Equalf(t, bucket.OverflowLimit, bucket2.OverflowLimit, "TestBucketEncodeThenDecode(case:%d)", i)
+		assert.Equalf(t, bucket.Mode, bucket2.Mode, "TestBucketEncodeThenDecode(case:%d)", i)
 	}
 }
 
+func TestDecodeBucket_Format1(t *testing.T) {
+	lastDrain := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	timestampBytes, err := lastDrain.MarshalBinary()
+	if err != nil {
+		t.Fatalf("TestDecodeBucket_Format1: unexpected error %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	for _, v := range []any{int32(1), int64(5), time.Minute, int64(300), int64(42), int32(len(timestampBytes))} {
+		_ = binary.Write(buf, binary.BigEndian, v)
+	}
+	buf.Write(timestampBytes)
+	_ = binary.Write(buf, binary.BigEndian, int64(24))
+
+	bucket, err := DecodeBucket(buf)
+	if err != nil {
+		t.Fatalf("TestDecodeBucket_Format1: unexpected decode error %v", err)
+	}
+	assert.Equal(t, int64(5), bucket.DrainBy)
+	assert.Equal(t, time.Minute, bucket.DrainInterval)
+	assert.Equal(t, int64(300), bucket.Capacity)
+	assert.Equal(t, int64(42), bucket.value)
+	assert.Equal(t, 0, lastDrain.Compare(bucket.lastDrain))
+	assert.Equal(t, int64(24), bucket.OverflowLimit)
+	assert.Equal(t, DrainStepped, bucket.Mode)
+	assert.Equal(t, 0, buf.Len())
+}
+
+func TestDecodeBucket_UnsupportedMode(t *testing.T) {
+	bucket, err := NewBucket(5, time.Minute, 300)
+	if err != nil {
+		t.Fatalf("TestDecodeBucket_UnsupportedMode: unexpected error %v", err)
+	}
+	bucket.Mode = 42
+
+	buf := &bytes.Buffer{}
+	if err = bucket.Encode(buf); err != nil {
+		t.Fatalf("TestDecodeBucket_UnsupportedMode: unexpected encode error %v", err)
+	}
+	_, err = DecodeBucket(buf)
+	assert.EqualError(t, err, "leaky: unsupported drain mode 42")
+}
+
 func TestBucket_Encode(t *testing.T) {
 	for i, createFn := range createCaseFunctions {
 		bucket, err := createFn(5, time.Minute, 300)
@@ -141,14 +255,9 @@ func TestBucket_Encode(t *testing.T) {
 
 		errorMessages := []string{
 			"leaky: unable to write format version",
-			"leaky: unable to write `DrainBy`",
-			"leaky: unable to write `DrainInterval`",
-			"leaky: unable to write `Capacity`",
-			"leaky: unable to write `value`",
-			//"leaky: unable to marshal `lastDrain`",
-			"leaky: unable to write length of `lastDrain`",
-			"leaky: unable to write `lastDrain`",
-			"leaky: unable to write `OverflowLimit`",
+			"leaky: unable to write payload length",
+			"leaky: unable to write payload",
+			"leaky: unable to write checksum",
 		}
 		for j, message := range errorMessages {
 			rw := newFaultyReaderWriter(j+1, j+1)
@@ -177,6 +286,61 @@ func TestBucket_Decode(t *testing.T) {
 			continue
 		}
 
+		errorMessages := []string{
+			"leaky: unable to read format version",
+			//"leaky: unsupported format version %d",
+			"leaky: unable to read payload length",
+			"leaky: unable to read payload",
+			"leaky: unable to read checksum",
+		}
+		for j, message := range errorMessages {
+			rw := newFaultyReaderWriter(j+1, j+1)
+			rw.Buffer = bytes.NewBuffer(buf.Bytes())
+			bucket2, err := DecodeBucket(rw)
+			assert.Nilf(t, bucket2, "TestBucket_Decode(case:%d,msg:%d)", i, j)
+			if err != nil {
+				assert.ErrorContainsf(t, err, message, "TestBucket_Decode(case:%d,msg:%d)", i, j)
+			} else {
+				t.Errorf("TestBucket_Decode(case:%d,msg:%d): expected error %s", i, j, message)
+			}
+		}
+	}
+}
+
+// encodeUnframed writes a bucket in the format 1 layout, which is no longer produced by Encode.
+func encodeUnframed(t *testing.T, bucket *Bucket) []byte {
+	timestampBytes, err := bucket.lastDrain.MarshalBinary()
+	if err != nil {
+		t.Fatalf("encodeUnframed: unexpected error %v", err)
+	}
+	buf := &bytes.Buffer{}
+	for _, v := range []any{int32(1), bucket.DrainBy, bucket.DrainInterval, bucket.Capacity, bucket.value, int32(len(timestampBytes))} {
+		_ = binary.Write(buf, binary.BigEndian, v)
+	}
+	buf.Write(timestampBytes)
+	_ = binary.Write(buf, binary.BigEndian, bucket.OverflowLimit)
+	return buf.Bytes()
+}
+
+func TestBucket_Decode_Unframed(t *testing.T) {
+	for i, createFn := range createCaseFunctions {
+		bucket, err := createFn(5, time.Minute, 300)
+		if err != nil {
+			t.Errorf("TestBucket_Decode_Unframed(case:%d): unexpected error %v", i, err)
+			continue
+		}
+		bucket.value = 42                                            // force a given value
+		bucket.lastDrain = time.Now().Add(-1 * bucket.DrainInterval) // prepare for 1 drain operation
+		bucket.OverflowLimit = 24                                    // force a given value
+		encoded := encodeUnframed(t, bucket)
+
+		bucket2, err := DecodeBucket(bytes.NewBuffer(encoded))
+		if err != nil {
+			t.Errorf("TestBucket_Decode_Unframed(case:%d): unexpected decode error %v", i, err)
+			continue
+		}
+		assertBucketsEqual(t, bucket, bucket2)
+
 		errorMessages := []string{
 			"leaky: unable to read format version",
 			//"leaky: unsupported format version %d",
@@ -186,21 +350,104 @@ func TestBucket_Decode(t *testing.T) {
 			"leaky: unable to read `value`",
 			"leaky: unable to read size of `lastDrain`",
 			"leaky: unable to read `lastDrain`",
-			//"leaky: did not read entire timestamp",
 			//"leaky: unable to unmarshal `lastDrain`",
 			"leaky: unable to read `OverflowLimit`",
 		}
 		for j, message := range errorMessages {
 			rw := newFaultyReaderWriter(j+1, j+1)
-			rw.Buffer = bytes.NewBuffer(buf.Bytes())
+			rw.Buffer = bytes.NewBuffer(encoded)
 			bucket2, err := DecodeBucket(rw)
-			assert.Nilf(t, bucket2, "TestBucket_Decode(case:%d,msg:%d)", i, j)
+			assert.Nilf(t, bucket2, "TestBucket_Decode_Unframed(case:%d,msg:%d)", i, j)
 			if err != nil {
-				assert.ErrorContainsf(t, err, message, "TestBucket_Decode(case:%d,msg:%d)", i, j)
+				assert.ErrorContainsf(t, err, message, "TestBucket_Decode_Unframed(case:%d,msg:%d)", i, j)
 			} else {
-				t.Errorf("TestBucket_Decode(case:%d,msg:%d): expected error %s", i, j, message)
+				t.Errorf("TestBucket_Decode_Unframed(case:%d,msg:%d): expected error %s", i, j, message)
 			}
 		}
+
+		// Short reads of the timestamp are errors
+		_, err = DecodeBucket(bytes.NewBuffer(encoded[:4+8*4+4+3]))
+		assert.ErrorContainsf(t, err, "leaky: unable to read `lastDrain`", "TestBucket_Decode_Unframed(case:%d)", i)
+		assert.ErrorIsf(t, err, io.ErrUnexpectedEOF, "TestBucket_Decode_Unframed(case:%d)", i)
+
+		// Unreasonable timestamp sizes are rejected before allocating
+		corrupted := bytes.Clone(encoded)
+		binary.BigEndian.PutUint32(corrupted[4+8*4:], 0x7fffffff)
+		_, err = DecodeBucket(bytes.NewBuffer(corrupted))
+		assert.EqualErrorf(t, err, "leaky: invalid size of `lastDrain` 2147483647", "TestBucket_Decode_Unframed(case:%d)", i)
+	}
+}
+
+func TestBucket_Decode_Framed(t *testing.T) {
+	bucket, err := NewBucket(5, time.Minute, 300)
+	if err != nil {
+		t.Fatalf("TestBucket_Decode_Framed: unexpected error %v", err)
+	}
+	bucket.value = 42
+	buf := &bytes.Buffer{}
+	if err = bucket.Encode(buf); err != nil {
+		t.Fatalf("TestBucket_Decode_Framed: unexpected encode error %v", err)
+	}
+	encoded := buf.Bytes()
+
+	// frame builds a format 2 encoding around the given payload, with a valid checksum
+	frame := func(payload []byte) *bytes.Buffer {
+		framed := binary.BigEndian.AppendUint32(nil, 2)
+		framed = binary.BigEndian.AppendUint32(framed, uint32(len(payload)))
+		framed = append(framed, payload...)
+		framed = binary.BigEndian.AppendUint32(framed, crc32.ChecksumIEEE(payload))
+		return bytes.NewBuffer(framed)
+	}
+	payload := encoded[8 : len(encoded)-4]
+
+	// Round trips through a valid frame
+	bucket2, err := DecodeBucket(frame(payload))
+	if assert.Nil(t, err) {
+		assertBucketsEqual(t, bucket, bucket2)
+	}
+
+	// Detects corruption anywhere in the payload
+	for i := 8; i < len(encoded)-4; i++ {
+		corrupted := bytes.Clone(encoded)
+		corrupted[i] ^= 0x01
+		_, err = DecodeBucket(bytes.NewBuffer(corrupted))
+		assert.ErrorContainsf(t, err, "leaky: checksum mismatch", "TestBucket_Decode_Framed(byte:%d)", i)
+	}
+
+	// Detects truncation
+	_, err = DecodeBucket(bytes.NewBuffer(encoded[:len(encoded)-10]))
+	assert.ErrorContains(t, err, "leaky: unable to read payload")
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Rejects unreasonable lengths before allocating
+	corrupted := bytes.Clone(encoded)
+	binary.BigEndian.PutUint32(corrupted[4:], 0xffffffff)
+	_, err = DecodeBucket(bytes.NewBuffer(corrupted))
+	assert.EqualError(t, err, "leaky: invalid payload length 4294967295")
+
+	// Rejects malformed payloads, even with a valid checksum
+	_, err = DecodeBucket(frame(nil))
+	assert.ErrorContains(t, err, "leaky: unable to read flags")
+	_, err = DecodeBucket(frame(append([]byte{0x80}, payload[1:]...)))
+	assert.EqualError(t, err, "leaky: unsupported flags 10000000")
+	_, err = DecodeBucket(frame(payload[:20]))
+	assert.ErrorContains(t, err, "leaky: unable to read `Capacity`")
+	_, err = DecodeBucket(frame(append(bytes.Clone(payload), 0)))
+	assert.EqualError(t, err, "leaky: unexpected data after payload")
+	_, err = DecodeBucket(frame(append([]byte{payload[0] | flagMode}, append(bytes.Clone(payload[1:]), 0, 0, 0, 42)...)))
+	assert.EqualError(t, err, "leaky: unsupported drain mode 42")
+
+	// Omits default fields
+	empty := &Bucket{DrainBy: 5, DrainInterval: time.Minute, Capacity: 300}
+	buf = &bytes.Buffer{}
+	if err = empty.Encode(buf); err != nil {
+		t.Fatalf("TestBucket_Decode_Framed: unexpected encode error %v", err)
+	}
+	assert.Equal(t, 4+4+1+8*4+4, buf.Len())
+	bucket2, err = DecodeBucket(buf)
+	if assert.Nil(t, err) {
+		assertBucketsEqual(t, empty, bucket2)
+		assert.True(t, bucket2.lastDrain.IsZero())
 	}
 }
 
@@ -260,6 +507,54 @@ func TestBucket_drain(t *testing.T) {
 	}
 }
 
+func TestBucket_drain_Continuous(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	bucket, err := NewBucketWithOptions(5, 2*time.Minute, 300, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestBucket_drain_Continuous: unexpected error %v", err)
+	}
+	bucket.Mode = DrainContinuous
+	bucket.value = 100
+
+	// Drains proportionally, where stepped mode would not have drained at all
+	clock.Advance(time.Minute + 59*time.Second)
+	bucket.drain()
+	assert.Equal(t, int64(96), bucket.value)
+
+	// Carries sub-unit time over (1m59s drained 4 units in 1m36s, leaving 23s)
+	assert.Equal(t, clock.Now().Add(-23*time.Second), bucket.lastDrain)
+	clock.Advance(time.Second / 2)
+	bucket.drain()
+	assert.Equal(t, int64(96), bucket.value)
+	clock.Advance(time.Second / 2)
+	bucket.drain()
+	assert.Equal(t, int64(95), bucket.value)
+
+	// Drains fully, even when the math would overflow
+	clock.Advance(24 * 365 * time.Hour)
+	bucket.drain()
+	assert.Equal(t, int64(0), bucket.value)
+	assert.Equal(t, clock.Now(), bucket.lastDrain)
+
+	// Doesn't drain when time goes backwards
+	bucket.value = 100
+	clock.Advance(-1 * time.Hour)
+	bucket.drain()
+	assert.Equal(t, int64(100), bucket.value)
+
+	// Waits are computed proportionally too
+	bucket.lastDrain = clock.Now()
+	bucket.value = 300
+	var fullErr *BucketFullError
+	if err = bucket.Add(1); assert.ErrorAs(t, err, &fullErr) {
+		assert.Equal(t, 24*time.Second, fullErr.RetryAfter)
+	}
+	clock.Advance(fullErr.RetryAfter)
+	if err = bucket.Add(1); err != nil {
+		t.Errorf("TestBucket_drain_Continuous: unexpected Add error %v", err)
+	}
+}
+
 func TestBucket_Peek(t *testing.T) {
 	for i, createFn := range createCaseFunctions {
 		bucket, err := createFn(5, time.Minute, 300)
@@ -311,6 +606,33 @@ func TestBucket_Remaining(t *testing.T) {
 	}
 }
 
+func TestBucket_TimeToEmpty(t *testing.T) {
+	for i, createFn := range createCaseFunctions {
+		bucket, err := createFn(5, time.Minute, 300)
+		if err != nil {
+			t.Errorf("TestBucket_TimeToEmpty(case:%d): unexpected error %v", i, err)
+			continue
+		}
+		clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		bucket.clock = clock
+		bucket.lastDrain = clock.Now()
+
+		assert.Equalf(t, time.Duration(0), bucket.TimeToEmpty(), "TestBucket_TimeToEmpty(case:%d) should be equal", i)
+
+		// Rounds up to whole intervals
+		bucket.value = 12
+		assert.Equalf(t, 3*time.Minute, bucket.TimeToEmpty(), "TestBucket_TimeToEmpty(case:%d) should be equal", i)
+
+		// Drains first, accounting for unused time
+		clock.Advance(90 * time.Second)
+		assert.Equalf(t, 90*time.Second, bucket.TimeToEmpty(), "TestBucket_TimeToEmpty(case:%d) should be equal", i)
+		assert.Equalf(t, int64(7), bucket.Peek(), "TestBucket_TimeToEmpty(case:%d) should be equal", i)
+
+		bucket.Mode = DrainContinuous
+		assert.Equalf(t, 54*time.Second, bucket.TimeToEmpty(), "TestBucket_TimeToEmpty(case:%d) should be equal", i)
+	}
+}
+
 func TestBucket_Add(t *testing.T) {
 	for i, createFn := range createCaseFunctions {
 		bucket, err := createFn(5, time.Minute, 300)
@@ -575,3 +897,410 @@ func TestBucket_Set(t *testing.T) {
 		assert.InDeltaf(t, 0*time.Millisecond, time.Since(bucket.lastDrain), float64(10*time.Millisecond), "TestBucket_Set(case:%d)", i)
 	}
 }
+
+func TestBucket_Raise(t *testing.T) {
+	for i, createFn := range createCaseFunctions {
+		bucket, err := createFn(5, time.Minute, 300)
+		if err != nil {
+			t.Errorf("TestBucket_Raise(case:%d): unexpected error %v", i, err)
+			continue
+		}
+		clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		bucket.clock = clock
+		bucket.lastDrain = clock.Now()
+
+		bucket.Raise(100)
+		assert.Equalf(t, int64(100), bucket.value, "TestBucket_Raise(case:%d) should be equal", i)
+
+		// Never lowers the value
+		bucket.Raise(50)
+		assert.Equalf(t, int64(100), bucket.value, "TestBucket_Raise(case:%d) should be equal", i)
+
+		// Drains first, keeping partial intervals
+		clock.Advance(90 * time.Second)
+		bucket.Raise(96)
+		assert.Equalf(t, int64(96), bucket.value, "TestBucket_Raise(case:%d) should be equal", i)
+		clock.Advance(30 * time.Second)
+		assert.Equalf(t, int64(91), bucket.Value(), "TestBucket_Raise(case:%d) should be equal", i)
+	}
+}
+
+func TestBucket_Backoff(t *testing.T) {
+	for i, createFn := range createCaseFunctions {
+		bucket, err := createFn(5, time.Minute, 300)
+		if err != nil {
+			t.Errorf("TestBucket_Backoff(case:%d): unexpected error %v", i, err)
+			continue
+		}
+		clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		bucket.clock = clock
+		bucket.lastDrain = clock.Now()
+
+		// Rounds up to whole intervals
+		bucket.Backoff(90 * time.Second)
+		assert.Equalf(t, int64(309), bucket.value, "TestBucket_Backoff(case:%d) should be equal", i)
+		delay, ok := bucket.delay(1, clock.Now())
+		assert.Truef(t, ok, "TestBucket_Backoff(case:%d) should be true", i)
+		assert.Equalf(t, 2*time.Minute, delay, "TestBucket_Backoff(case:%d) should be equal", i)
+		err = bucket.Add(1)
+		var fullErr *BucketFullError
+		assert.ErrorAsf(t, err, &fullErr, "TestBucket_Backoff(case:%d) should be full", i)
+
+		// Never lowers the value
+		bucket.Backoff(time.Second)
+		bucket.Backoff(0)
+		bucket.Backoff(-time.Hour)
+		assert.Equalf(t, int64(309), bucket.value, "TestBucket_Backoff(case:%d) should be equal", i)
+
+		// Elapsed time since the last drain is made up
+		clock.Advance(30 * time.Second)
+		bucket.Backoff(90 * time.Second)
+		assert.Equalf(t, int64(309), bucket.value, "TestBucket_Backoff(case:%d) should be equal", i)
+		bucket.Backoff(91 * time.Second)
+		assert.Equalf(t, int64(314), bucket.value, "TestBucket_Backoff(case:%d) should be equal", i)
+		delay, _ = bucket.delay(1, clock.Now())
+		assert.Equalf(t, 150*time.Second, delay, "TestBucket_Backoff(case:%d) should be equal", i)
+
+		// Overflow allows adding once below capacity, so the value must be that much higher. Being empty, the
+		// bucket's drain time is reset.
+		bucket.value = 0
+		bucket.OverflowLimit = 10
+		bucket.Backoff(time.Second)
+		assert.Equalf(t, int64(305), bucket.value, "TestBucket_Backoff(case:%d) should be equal", i)
+		assert.ErrorAsf(t, bucket.Add(1), &fullErr, "TestBucket_Backoff(case:%d) should be full", i)
+		assert.Equalf(t, time.Minute, fullErr.RetryAfter, "TestBucket_Backoff(case:%d) should be equal", i)
+
+		// Continuous mode rounds up to whole units
+		bucket.value = 0
+		bucket.OverflowLimit = 0
+		bucket.Mode = DrainContinuous
+		bucket.Backoff(25 * time.Second)
+		assert.Equalf(t, int64(302), bucket.value, "TestBucket_Backoff(case:%d) should be equal", i)
+		delay, _ = bucket.delay(1, clock.Now())
+		assert.Truef(t, delay >= 25*time.Second && delay < 37*time.Second, "TestBucket_Backoff(case:%d) delay %s out of range", i, delay)
+
+		// Handles durations which would overflow
+		bucket.Backoff(time.Duration(math.MaxInt64))
+		delay, _ = bucket.delay(1, clock.Now())
+		assert.Equalf(t, time.Duration(math.MaxInt64), delay, "TestBucket_Backoff(case:%d) should be equal", i)
+	}
+}
+
+func TestBucket_Wait(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	bucket, err := NewBucketWithOptions(5, time.Minute, 300, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestBucket_Wait: unexpected error %v", err)
+	}
+
+	// Doesn't block when there's capacity
+	if err = bucket.Wait(context.Background(), 300); err != nil {
+		t.Errorf("TestBucket_Wait: unexpected Wait error %v", err)
+	}
+	assert.Equal(t, int64(300), bucket.value)
+
+	// Fails immediately when the amount can never fit
+	assert.ErrorIs(t, bucket.Wait(context.Background(), 301), ErrAmountTooLarge)
+	bucket.OverflowLimit = 10
+	assert.ErrorIs(t, bucket.Wait(context.Background(), 311), ErrAmountTooLarge)
+	bucket.OverflowLimit = 0
+	assert.Equal(t, int64(300), bucket.value)
+
+	// Sleeps until enough intervals have passed, accounting for partial intervals already elapsed
+	clock.Advance(30 * time.Second)
+	done := make(chan error, 1)
+	go func() {
+		done <- bucket.Wait(context.Background(), 12) // needs 3 drain intervals
+	}()
+	waitForTimers(t, clock, 1)
+	clock.Advance(2*time.Minute + 29*time.Second)
+	select {
+	case err = <-done:
+		t.Errorf("TestBucket_Wait: returned early with %v", err)
+	default:
+	}
+	clock.Advance(time.Second)
+	select {
+	case err = <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("TestBucket_Wait: did not return after drain")
+	}
+	assert.Equal(t, int64(300-15+12), bucket.value)
+
+	// Returns the context error when cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		done <- bucket.Wait(ctx, 50)
+	}()
+	waitForTimers(t, clock, 1)
+	cancel()
+	select {
+	case err = <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("TestBucket_Wait: did not return after cancel")
+	}
+	assert.Equal(t, int64(297), bucket.value)
+	assert.ErrorIs(t, bucket.Wait(ctx, 1), context.Canceled)
+}
+
+func TestBucket_delay(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	bucket := &Bucket{
+		DrainBy:       5,
+		DrainInterval: time.Minute,
+		Capacity:      300,
+		value:         300,
+		lastDrain:     now,
+	}
+
+	delay, ok := bucket.delay(0, now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), delay)
+
+	delay, ok = bucket.delay(1, now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, delay)
+
+	delay, ok = bucket.delay(6, now.Add(15*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, 105*time.Second, delay)
+
+	_, ok = bucket.delay(301, now)
+	assert.False(t, ok)
+
+	// Must drain below capacity before the overflow can be used
+	bucket.OverflowLimit = 10
+	bucket.value = 305
+	delay, ok = bucket.delay(1, now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, delay)
+	bucket.value = 300
+	delay, ok = bucket.delay(10, now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), delay)
+}
+
+func waitForTimers(t *testing.T, clock *ManualClock, count int) {
+	deadline := time.Now().Add(time.Second)
+	for clock.Timers() < count {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d timers", count)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBucket_Add_RetryAfter(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	bucket, err := NewBucketWithOptions(5, time.Minute, 300, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestBucket_Add_RetryAfter: unexpected error %v", err)
+	}
+	bucket.OverflowLimit = 10
+
+	if err = bucket.Add(300); err != nil {
+		t.Errorf("TestBucket_Add_RetryAfter: unexpected Add error %v", err)
+	}
+
+	// Reports the time until the amount fits, including partially elapsed intervals
+	clock.Advance(20 * time.Second)
+	var fullErr *BucketFullError
+	err = bucket.Add(20)
+	assert.ErrorIs(t, err, ErrBucketFull)
+	if assert.ErrorAs(t, err, &fullErr) {
+		assert.Equal(t, 100*time.Second, fullErr.RetryAfter)
+		assert.EqualError(t, err, "leaky: bucket full or would overflow (retry after 1m40s)")
+	}
+
+	// Retrying after the reported duration succeeds
+	clock.Advance(fullErr.RetryAfter)
+	if err = bucket.Add(20); err != nil {
+		t.Errorf("TestBucket_Add_RetryAfter: unexpected Add error %v", err)
+	}
+	assert.Equal(t, int64(310), bucket.value)
+
+	// Over capacity must drain back to capacity first
+	err = bucket.Add(1)
+	if assert.ErrorAs(t, err, &fullErr) {
+		assert.Equal(t, 2*time.Minute, fullErr.RetryAfter)
+	}
+
+	// Amounts which can never fit are not retryable
+	err = bucket.Add(311)
+	assert.ErrorIs(t, err, ErrBucketFull)
+	assert.False(t, errors.As(err, &fullErr))
+}
+
+func TestBucket_Concurrent_Add(t *testing.T) {
+	for i, createFn := range createCaseFunctions {
+		bucket, err := createFn(5, time.Hour, 1000)
+		if err != nil {
+			t.Errorf("TestBucket_Concurrent_Add(case:%d): unexpected error %v", i, err)
+			continue
+		}
+
+		// Exactly Capacity units should be accepted, no matter how the goroutines interleave
+		accepted := atomic.Int64{}
+		wg := sync.WaitGroup{}
+		for g := 0; g < 20; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					if err := bucket.Add(1); err == nil {
+						accepted.Add(1)
+					} else if !errors.Is(err, ErrBucketFull) {
+						t.Errorf("TestBucket_Concurrent_Add(case:%d): unexpected Add error %v", i, err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equalf(t, int64(1000), accepted.Load(), "TestBucket_Concurrent_Add(case:%d)", i)
+		assert.Equalf(t, int64(1000), bucket.Value(), "TestBucket_Concurrent_Add(case:%d)", i)
+	}
+}
+
+func TestBucket_Concurrent_AddDrain(t *testing.T) {
+	for i, createFn := range createCaseFunctions {
+		bucket, err := createFn(5, time.Hour, 2000)
+		if err != nil {
+			t.Errorf("TestBucket_Concurrent_AddDrain(case:%d): unexpected error %v", i, err)
+			continue
+		}
+		bucket.value = 500
+
+		// The bucket never empties or fills, so no operation should be lost or clamped
+		wg := sync.WaitGroup{}
+		for g := 0; g < 10; g++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					if err := bucket.Add(1); err != nil {
+						t.Errorf("TestBucket_Concurrent_AddDrain(case:%d): unexpected Add error %v", i, err)
+					}
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 40; j++ {
+					if err := bucket.Drain(1); err != nil {
+						t.Errorf("TestBucket_Concurrent_AddDrain(case:%d): unexpected Drain error %v", i, err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equalf(t, int64(1100), bucket.Value(), "TestBucket_Concurrent_AddDrain(case:%d)", i)
+	}
+}
+
+func TestBucket_Concurrent_Mixed(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	bucket, err := NewBucketWithOptions(5, time.Second, 300, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestBucket_Concurrent_Mixed: unexpected error %v", err)
+	}
+	bucket.OverflowLimit = 10
+
+	// Exercise every operation at once while time moves, checking the bucket's invariants hold. This is
+	// primarily useful when run with -race.
+	check := func(value int64) {
+		if value < 0 || value > bucket.Capacity+bucket.OverflowLimit {
+			t.Errorf("TestBucket_Concurrent_Mixed: value %d out of range", value)
+		}
+	}
+	ops := []func(){
+		func() { _ = bucket.Add(7) },
+		func() { _ = bucket.Drain(3) },
+		func() { check(bucket.Value()) },
+		func() { check(bucket.Capacity - bucket.Remaining()) },
+		func() { check(bucket.Peek()) },
+		func() { _ = bucket.Set(100) },
+		func() { _ = bucket.Encode(&bytes.Buffer{}) },
+		func() { clock.Advance(100 * time.Millisecond) },
+	}
+	wg := sync.WaitGroup{}
+	for g := 0; g < 4; g++ {
+		for _, op := range ops {
+			wg.Add(1)
+			go func(op func()) {
+				defer wg.Done()
+				for j := 0; j < 200; j++ {
+					op()
+				}
+			}(op)
+		}
+	}
+	wg.Wait()
+	check(bucket.Value())
+}
+
+func TestBucket_Reconfigure(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	bucket, err := NewBucketWithOptions(5, time.Minute, 300, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestBucket_Reconfigure: unexpected error %v", err)
+	}
+	bucket.value = 300
+
+	// Invalid configs are rejected without changes
+	config := bucket.Config()
+	config.Capacity = 0
+	assert.EqualError(t, bucket.Reconfigure(config), "leaky: bucket can never fill")
+	assert.Equal(t, Config{DrainBy: 5, DrainInterval: time.Minute, Capacity: 300}, bucket.Config())
+
+	// Settles pending drains at the old rate, then drains at the new rate from now
+	clock.Advance(2*time.Minute + 30*time.Second)
+	config = Config{DrainBy: 50, DrainInterval: time.Minute, Capacity: 200, OverflowLimit: 10, Mode: DrainContinuous}
+	if err = bucket.Reconfigure(config); err != nil {
+		t.Errorf("TestBucket_Reconfigure: unexpected Reconfigure error %v", err)
+	}
+	assert.Equal(t, config, bucket.Config())
+	assert.Equal(t, int64(290), bucket.Peek())
+	assert.Equal(t, clock.Now(), bucket.lastDrain)
+	clock.Advance(30 * time.Second)
+	assert.Equal(t, int64(265), bucket.Value())
+
+	// Over the new capacity until drained
+	assert.ErrorIs(t, bucket.Add(1), ErrBucketFull)
+	clock.Advance(78 * time.Second)
+	assert.Equal(t, int64(200), bucket.Value())
+	if err = bucket.Add(10); err != nil {
+		t.Errorf("TestBucket_Reconfigure: unexpected Add error %v", err)
+	}
+}
+
+func TestBucket_Concurrent_Reconfigure(t *testing.T) {
+	bucket, err := NewBucket(5, time.Minute, 1000)
+	if err != nil {
+		t.Fatalf("TestBucket_Concurrent_Reconfigure: unexpected error %v", err)
+	}
+
+	wg := sync.WaitGroup{}
+	for g := 0; g < 4; g++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				_ = bucket.Add(1)
+				_ = bucket.Remaining()
+			}
+		}()
+		go func(g int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				config := bucket.Config()
+				config.Capacity = int64(500 + g*100 + j)
+				config.DrainInterval = time.Duration(j+1) * time.Second
+				if err := bucket.Reconfigure(config); err != nil {
+					t.Errorf("TestBucket_Concurrent_Reconfigure: unexpected Reconfigure error %v", err)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,165 @@
+package leaky
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock provides the current time and timers to a Bucket. The default clock uses the time package
+// directly, though a ManualClock may be supplied to control time during tests or simulations.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTimer creates a Timer which sends the current time on its channel after at least
+	// duration d has elapsed.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer represents a single event produced by a Clock, similar to time.Timer.
+type Timer interface {
+	// C returns the channel on which the time is delivered when the timer fires.
+	C() <-chan time.Time
+
+	// Stop prevents the timer from firing. It returns false if the timer has already fired or
+	// been stopped.
+	Stop() bool
+}
+
+// RealClock is a Clock backed by the time package.
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return &realTimer{t: time.NewTimer(d)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t *realTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t *realTimer) Stop() bool {
+	return t.t.Stop()
+}
+
+// ManualClock is a Clock which only moves when told to. It is safe for concurrent use.
+//
+// Timers created by a ManualClock fire once the clock has been advanced to or beyond their deadline.
+//
+// Example usage:
+//
+//	clock := leaky.NewManualClock(time.Now())
+//	bucket, err := leaky.NewBucketWithOptions(5, time.Minute, 300, leaky.WithClock(clock))
+//	// ...
+//	clock.Advance(24 * time.Hour) // the bucket will drain as though a day has passed
+type ManualClock struct {
+	now    time.Time
+	timers []*manualTimer
+	lock   sync.Mutex
+}
+
+// NewManualClock creates a new ManualClock starting at the given time.
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{
+		now:    now,
+		timers: make([]*manualTimer, 0),
+		lock:   sync.Mutex{},
+	}
+}
+
+// Now returns the clock's current time.
+func (c *ManualClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// NewTimer creates a Timer which fires once the clock reaches the current time plus d. If d is zero
+// or negative, the timer fires immediately.
+func (c *ManualClock) NewTimer(d time.Duration) Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	t := &manualTimer{
+		clock:    c,
+		deadline: c.now.Add(d),
+		ch:       make(chan time.Time, 1),
+	}
+	if d <= 0 {
+		t.ch <- c.now
+		return t
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forwards by d, firing any timers which become due. Negative durations
+// move the clock backwards without firing any timers.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.setLocked(c.now.Add(d))
+}
+
+// Set moves the clock to the given time, firing any timers which become due.
+func (c *ManualClock) Set(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.setLocked(now)
+}
+
+// Timers returns the number of timers which are waiting to fire. This is useful in tests to
+// determine whether something is blocked on the clock before advancing it.
+func (c *ManualClock) Timers() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.timers)
+}
+
+func (c *ManualClock) setLocked(now time.Time) {
+	c.now = now
+	remaining := c.timers[:0]
+	for _, t := range c.timers {
+		if !t.deadline.After(now) {
+			t.ch <- now
+		} else {
+			remaining = append(remaining, t)
+		}
+	}
+	c.timers = remaining
+}
+
+func (c *ManualClock) stopTimer(t *manualTimer) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type manualTimer struct {
+	clock    *ManualClock
+	deadline time.Time
+	ch       chan time.Time
+}
+
+func (t *manualTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *manualTimer) Stop() bool {
+	return t.clock.stopTimer(t)
+}
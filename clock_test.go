@@ -0,0 +1,83 @@
+package leaky
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRealClock(t *testing.T) {
+	before := time.Now()
+	now := RealClock.Now()
+	assert.False(t, now.Before(before))
+
+	timer := RealClock.NewTimer(time.Millisecond)
+	select {
+	case <-timer.C():
+	case <-time.After(time.Second):
+		t.Error("TestRealClock: timer did not fire")
+	}
+	assert.False(t, timer.Stop())
+
+	timer = RealClock.NewTimer(time.Hour)
+	assert.True(t, timer.Stop())
+}
+
+func TestManualClock_Advance(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewManualClock(start)
+	assert.Equal(t, start, clock.Now())
+
+	clock.Advance(time.Hour)
+	assert.Equal(t, start.Add(time.Hour), clock.Now())
+
+	clock.Advance(-2 * time.Hour)
+	assert.Equal(t, start.Add(-1*time.Hour), clock.Now())
+
+	clock.Set(start)
+	assert.Equal(t, start, clock.Now())
+}
+
+func TestManualClock_NewTimer(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	// Fires immediately when not in the future
+	timer := clock.NewTimer(0)
+	assert.Equal(t, 0, clock.Timers())
+	select {
+	case <-timer.C():
+	default:
+		t.Error("TestManualClock_NewTimer: expected timer to fire immediately")
+	}
+
+	// Fires only once the deadline is reached
+	timer = clock.NewTimer(time.Minute)
+	assert.Equal(t, 1, clock.Timers())
+	clock.Advance(59 * time.Second)
+	select {
+	case <-timer.C():
+		t.Error("TestManualClock_NewTimer: timer fired early")
+	default:
+	}
+	clock.Advance(time.Second)
+	select {
+	case fired := <-timer.C():
+		assert.Equal(t, clock.Now(), fired)
+	default:
+		t.Error("TestManualClock_NewTimer: expected timer to fire")
+	}
+	assert.Equal(t, 0, clock.Timers())
+	assert.False(t, timer.Stop())
+
+	// Doesn't fire once stopped
+	timer = clock.NewTimer(time.Minute)
+	assert.True(t, timer.Stop())
+	assert.Equal(t, 0, clock.Timers())
+	clock.Advance(time.Hour)
+	select {
+	case <-timer.C():
+		t.Error("TestManualClock_NewTimer: stopped timer fired")
+	default:
+	}
+}
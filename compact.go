@@ -0,0 +1,136 @@
+package leaky
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// compactMarker is the first byte of an EncodingCompact bucket. Standard encodings start with a
+// big-endian format version, so their first byte is always zero.
+const compactMarker byte = 0xC1
+
+// compactEpoch is the time the last drain time is stored relative to, keeping it small for recent times.
+var compactEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// encodeCompact writes the bucket in EncodingCompact.
+func (b *Bucket) encodeCompact(w io.Writer) error {
+	buf, err := b.compactBytes()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(buf); err != nil {
+		return errors.Join(errors.New("leaky: unable to write compact bucket"), err)
+	}
+	return nil
+}
+
+// compactBytes produces the EncodingCompact form of the bucket: the marker, flags for optional fields,
+// then each field as a varint. Optional fields use the same flags as format 2.
+func (b *Bucket) compactBytes() ([]byte, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	flags := byte(0)
+	var lastDrain int64
+	if !b.lastDrain.IsZero() {
+		since := b.lastDrain.Sub(compactEpoch)
+		if !compactEpoch.Add(since).Equal(b.lastDrain) {
+			return nil, errors.New("leaky: `lastDrain` is out of range for compact encoding")
+		}
+		lastDrain = int64(since)
+		flags |= flagLastDrain
+	}
+	if b.OverflowLimit != 0 {
+		flags |= flagOverflowLimit
+	}
+	if b.Mode != DrainStepped {
+		flags |= flagMode
+	}
+
+	// Fields, ordered
+	buf := make([]byte, 0, 32)
+	buf = append(buf, compactMarker, flags)
+	buf = binary.AppendVarint(buf, b.DrainBy)
+	buf = binary.AppendVarint(buf, int64(b.DrainInterval))
+	buf = binary.AppendVarint(buf, b.Capacity)
+	buf = binary.AppendVarint(buf, b.value)
+	if flags&flagLastDrain != 0 {
+		buf = binary.AppendVarint(buf, lastDrain)
+	}
+	if flags&flagOverflowLimit != 0 {
+		buf = binary.AppendVarint(buf, b.OverflowLimit)
+	}
+	if flags&flagMode != 0 {
+		buf = binary.AppendUvarint(buf, uint64(b.Mode))
+	}
+	return buf, nil
+}
+
+// decodeCompact reads an EncodingCompact bucket, starting after the marker.
+func decodeCompact(r io.Reader) (*Bucket, error) {
+	br := &singleByteReader{r: r}
+	flags, err := br.ReadByte()
+	if err != nil {
+		return nil, errors.Join(errors.New("leaky: unable to read flags"), err)
+	}
+	if flags&^(flagLastDrain|flagOverflowLimit|flagMode) != 0 {
+		return nil, fmt.Errorf("leaky: unsupported flags %08b", flags)
+	}
+
+	bucket := &Bucket{}
+	if bucket.DrainBy, err = binary.ReadVarint(br); err != nil {
+		return nil, errors.Join(errors.New("leaky: unable to read `DrainBy`"), err)
+	}
+	interval, err := binary.ReadVarint(br)
+	if err != nil {
+		return nil, errors.Join(errors.New("leaky: unable to read `DrainInterval`"), err)
+	}
+	bucket.DrainInterval = time.Duration(interval)
+	if bucket.Capacity, err = binary.ReadVarint(br); err != nil {
+		return nil, errors.Join(errors.New("leaky: unable to read `Capacity`"), err)
+	}
+	if bucket.value, err = binary.ReadVarint(br); err != nil {
+		return nil, errors.Join(errors.New("leaky: unable to read `value`"), err)
+	}
+	if flags&flagLastDrain != 0 {
+		lastDrain, err := binary.ReadVarint(br)
+		if err != nil {
+			return nil, errors.Join(errors.New("leaky: unable to read `lastDrain`"), err)
+		}
+		bucket.lastDrain = compactEpoch.Add(time.Duration(lastDrain))
+	}
+	if flags&flagOverflowLimit != 0 {
+		if bucket.OverflowLimit, err = binary.ReadVarint(br); err != nil {
+			return nil, errors.Join(errors.New("leaky: unable to read `OverflowLimit`"), err)
+		}
+	}
+	if flags&flagMode != 0 {
+		mode, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, errors.Join(errors.New("leaky: unable to read `Mode`"), err)
+		}
+		bucket.Mode = DrainMode(mode)
+		if bucket.Mode != DrainStepped && bucket.Mode != DrainContinuous {
+			return nil, fmt.Errorf("leaky: unsupported drain mode %d", mode)
+		}
+	}
+
+	return bucket, nil
+}
+
+// singleByteReader adapts an io.Reader to an io.ByteReader without reading ahead, so nothing beyond the
+// encoded bucket is consumed from the underlying reader.
+type singleByteReader struct {
+	r   io.Reader
+	buf [1]byte
+}
+
+func (r *singleByteReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(r.r, r.buf[:]); err != nil {
+		return 0, err
+	}
+	return r.buf[0], nil
+}
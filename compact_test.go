@@ -0,0 +1,139 @@
+package leaky
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucket_EncodeWith(t *testing.T) {
+	bucket := newMarshalTestBucket(t)
+
+	// Standard is the same as Encode
+	buf := &bytes.Buffer{}
+	if err := bucket.EncodeWith(buf, EncodingStandard); err != nil {
+		t.Fatalf("TestBucket_EncodeWith: unexpected error %v", err)
+	}
+	expected := &bytes.Buffer{}
+	if err := bucket.Encode(expected); err != nil {
+		t.Fatalf("TestBucket_EncodeWith: unexpected error %v", err)
+	}
+	assert.Equal(t, expected.Bytes(), buf.Bytes())
+
+	assert.EqualError(t, bucket.EncodeWith(buf, 42), "leaky: unsupported encoding 42")
+}
+
+func TestBucket_EncodeCompact(t *testing.T) {
+	for i, createFn := range createCaseFunctions {
+		bucket, err := createFn(5, time.Minute, 300)
+		if err != nil {
+			t.Errorf("TestBucket_EncodeCompact(case:%d): unexpected error %v", i, err)
+			continue
+		}
+		bucket.value = 42
+		bucket.lastDrain = time.Now().Add(-1 * bucket.DrainInterval)
+
+		standard := &bytes.Buffer{}
+		if err = bucket.EncodeWith(standard, EncodingStandard); err != nil {
+			t.Errorf("TestBucket_EncodeCompact(case:%d): unexpected encode error %v", i, err)
+			continue
+		}
+		compact := &bytes.Buffer{}
+		if err = bucket.EncodeWith(compact, EncodingCompact); err != nil {
+			t.Errorf("TestBucket_EncodeCompact(case:%d): unexpected encode error %v", i, err)
+			continue
+		}
+		assert.Lessf(t, compact.Len()*2, standard.Len(), "TestBucket_EncodeCompact(case:%d)", i)
+
+		// Auto-detected, and doesn't consume anything after the bucket
+		compact.WriteString("trailing")
+		bucket2, err := DecodeBucket(compact)
+		if err != nil {
+			t.Errorf("TestBucket_EncodeCompact(case:%d): unexpected decode error %v", i, err)
+			continue
+		}
+		assert.Equalf(t, "trailing", compact.String(), "TestBucket_EncodeCompact(case:%d)", i)
+		assert.Equalf(t, bucket.DrainBy, bucket2.DrainBy, "TestBucket_EncodeCompact(case:%d)", i)
+		assert.Equalf(t, bucket.DrainInterval, bucket2.DrainInterval, "TestBucket_EncodeCompact(case:%d)", i)
+		assert.Equalf(t, bucket.Capacity, bucket2.Capacity, "TestBucket_EncodeCompact(case:%d)", i)
+		assert.Equalf(t, bucket.value, bucket2.value, "TestBucket_EncodeCompact(case:%d)", i)
+		assert.Equalf(t, bucket.lastDrain.UnixNano(), bucket2.lastDrain.UnixNano(), "TestBucket_EncodeCompact(case:%d)", i)
+		assert.Equalf(t, int64(0), bucket2.OverflowLimit, "TestBucket_EncodeCompact(case:%d)", i)
+		assert.Equalf(t, DrainStepped, bucket2.Mode, "TestBucket_EncodeCompact(case:%d)", i)
+	}
+}
+
+func TestBucket_EncodeCompact_Optional(t *testing.T) {
+	// All optional fields present
+	bucket := newMarshalTestBucket(t)
+	buf := &bytes.Buffer{}
+	if err := bucket.EncodeWith(buf, EncodingCompact); err != nil {
+		t.Fatalf("TestBucket_EncodeCompact_Optional: unexpected encode error %v", err)
+	}
+	encoded := bytes.Clone(buf.Bytes())
+	bucket2, err := DecodeBucket(buf)
+	if assert.Nil(t, err) {
+		assertBucketsEqual(t, bucket, bucket2)
+	}
+
+	// All optional fields omitted
+	empty := &Bucket{DrainBy: 5, DrainInterval: time.Minute, Capacity: 300}
+	buf = &bytes.Buffer{}
+	if err = empty.EncodeWith(buf, EncodingCompact); err != nil {
+		t.Fatalf("TestBucket_EncodeCompact_Optional: unexpected encode error %v", err)
+	}
+	assert.Equal(t, []byte{compactMarker, 0, 0x0a, 0x80, 0xe0, 0xba, 0x84, 0xbf, 0x03, 0xd8, 0x04, 0x00}, buf.Bytes())
+	bucket2, err = DecodeBucket(buf)
+	if assert.Nil(t, err) {
+		assertBucketsEqual(t, empty, bucket2)
+		assert.True(t, bucket2.lastDrain.IsZero())
+	}
+
+	// Truncated at every point
+	truncations := []struct {
+		length  int
+		message string
+	}{
+		{2, "leaky: unable to read format version"}, // the flags and first fields are read with the version
+		{5, "leaky: unable to read `DrainInterval`"},
+		{9, "leaky: unable to read `Capacity`"},
+		{11, "leaky: unable to read `value`"},
+		{12, "leaky: unable to read `lastDrain`"},
+		{19, "leaky: unable to read `OverflowLimit`"},
+		{20, "leaky: unable to read `Mode`"},
+	}
+	assert.Len(t, encoded, 21)
+	for j, truncation := range truncations {
+		_, err = DecodeBucket(bytes.NewBuffer(encoded[:truncation.length]))
+		assert.ErrorContainsf(t, err, truncation.message, "TestBucket_EncodeCompact_Optional(msg:%d)", j)
+	}
+
+	// Rejects unknown flags and modes
+	_, err = DecodeBucket(bytes.NewBuffer(append([]byte{compactMarker, 0x80}, encoded[2:]...)))
+	assert.EqualError(t, err, "leaky: unsupported flags 10000000")
+	corrupted := bytes.Clone(encoded)
+	corrupted[len(corrupted)-1] = 42
+	_, err = DecodeBucket(bytes.NewBuffer(corrupted))
+	assert.EqualError(t, err, "leaky: unsupported drain mode 42")
+}
+
+func TestBucket_EncodeCompact_Errors(t *testing.T) {
+	// Last drain out of range
+	bucket := &Bucket{DrainBy: 5, DrainInterval: time.Minute, Capacity: 300, lastDrain: time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC)}
+	assert.EqualError(t, bucket.EncodeWith(&bytes.Buffer{}, EncodingCompact), "leaky: `lastDrain` is out of range for compact encoding")
+
+	// Write failure
+	bucket.lastDrain = time.Now()
+	err := bucket.EncodeWith(newFaultyReaderWriter(1, 1), EncodingCompact)
+	assert.ErrorContains(t, err, "leaky: unable to write compact bucket")
+
+	// Short buckets
+	_, err = DecodeBucket(bytes.NewBuffer([]byte{compactMarker, 0, 10}))
+	assert.ErrorContains(t, err, "leaky: unable to read format version")
+	_, err = DecodeBucket(bytes.NewBuffer([]byte{compactMarker, 0, 10, 0x80}))
+	assert.ErrorContains(t, err, "leaky: unable to read `DrainInterval`")
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
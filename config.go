@@ -0,0 +1,275 @@
+package leaky
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// Config describes the parameters of a Bucket. It is used as a template when buckets are created on
+// demand, such as by a Registry.
+type Config struct {
+	// DrainBy is the amount to drain the bucket by each drain interval.
+	DrainBy int64
+
+	// DrainInterval is the duration between each drain interval.
+	DrainInterval time.Duration
+
+	// Capacity is the maximum capacity the bucket can hold.
+	Capacity int64
+
+	// OverflowLimit is how much an Add operation can overflow the bucket. See Bucket.OverflowLimit.
+	OverflowLimit int64
+
+	// Mode is how the bucket drains over time. See DrainMode.
+	Mode DrainMode
+}
+
+// Validate returns an error if the config would produce a bucket which never drains, can never fill,
+// or is otherwise invalid.
+func (c Config) Validate() error {
+	if c.DrainBy <= 0 || c.DrainInterval <= 0 {
+		return errors.New("leaky: bucket never drains")
+	}
+	if c.Capacity <= 0 {
+		return errors.New("leaky: bucket can never fill")
+	}
+	if c.OverflowLimit < 0 {
+		return errors.New("leaky: overflow limit cannot be negative")
+	}
+	if c.Mode != DrainStepped && c.Mode != DrainContinuous {
+		return errors.New("leaky: unsupported drain mode")
+	}
+	return nil
+}
+
+// NewBucketFromConfig creates a new, empty Bucket using the parameters in the given config, applying
+// the given options to the bucket before it is returned. It returns an error if the config is invalid.
+//
+// Example usage:
+//
+//	bucket, err := leaky.NewBucketFromConfig(leaky.Config{
+//		DrainBy:       5,
+//		DrainInterval: time.Minute,
+//		Capacity:      300,
+//		Mode:          leaky.DrainContinuous,
+//	})
+//
+// Parameters:
+//
+//	config  - the parameters for the bucket
+//	opts    - the options to apply to the bucket
+//
+// Return values:
+//
+//	*Bucket - the created Bucket instance
+//	error   - error message if the config or options are invalid
+func NewBucketFromConfig(config Config, opts ...Option) (*Bucket, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = config.Validate(); err != nil {
+		return nil, err
+	}
+	return &Bucket{
+		DrainBy:       config.DrainBy,
+		DrainInterval: config.DrainInterval,
+		Capacity:      config.Capacity,
+		OverflowLimit: config.OverflowLimit,
+		Mode:          config.Mode,
+		value:         0,
+		lastDrain:     o.clock.Now(),
+		clock:         o.clock,
+		lock:          sync.Mutex{},
+	}, nil
+}
+
+// drain returns the value and last drain time of a bucket with this config after subtracting the drained
+// amount based on the elapsed time since the last drain.
+// If the bucket is already empty, it does nothing.
+//
+// If the bucket has never been drained before, it sets the last drain time as the current time.
+// If the bucket value is zero or negative after the drain, it sets the value to zero and updates the last drain time.
+//
+// The elapsed time since the last drain is calculated by subtracting the last drain time from the current time.
+// In DrainStepped mode:
+// The elapsed time is truncated to the nearest multiple of the drain interval.
+// The number of leaks is then calculated by dividing the elapsed time by the drain interval.
+// The drained amount is calculated by multiplying the drain by the number of leaks.
+// In DrainContinuous mode:
+// The drained amount is the elapsed time multiplied by the drain, divided by the drain interval, rounded down.
+// The drain time is the shortest time which would drain that amount.
+//
+// The bucket value is updated by subtracting the drained amount.
+// If the bucket value becomes negative, it is set to zero.
+//
+// Finally, the last drain time is updated to the current time minus the remaining elapsed time (since - drainTime).
+func (c Config) drain(value int64, lastDrain time.Time, now time.Time) (int64, time.Time) {
+	if lastDrain.IsZero() {
+		lastDrain = now // assume we've never drained
+	}
+
+	if value <= 0 {
+		return 0, now // nothing to drain, so don't bother
+	}
+
+	since := now.Sub(lastDrain)
+	var drained int64
+	var drainTime time.Duration
+	if c.Mode == DrainContinuous {
+		if since <= 0 {
+			return value, lastDrain // time hasn't moved forwards
+		}
+		var ok bool
+		if drained, ok = mulDiv(int64(since), c.DrainBy, int64(c.DrainInterval)); !ok || drained >= value {
+			drained = value
+			drainTime = since // everything drained, so there's no time to carry over
+		} else {
+			drainTime = c.unitsDuration(drained)
+		}
+	} else {
+		drainTime = since.Truncate(c.DrainInterval)
+		leaks := int64(drainTime.Abs() / c.DrainInterval.Abs())
+		drained = c.DrainBy * leaks
+	}
+
+	value -= drained
+	if value < 0 {
+		value = 0
+	}
+	return value, now.Add((since - drainTime) * -1)
+}
+
+// add returns the value of a drained bucket with this config after adding the given amount. The value
+// is not allowed to become negative. If the bucket is over capacity, or the amount would overflow the
+// bucket by more than OverflowLimit, a *BucketFullError is returned, or ErrBucketFull if the amount
+// can never fit.
+func (c Config) add(value int64, lastDrain time.Time, now time.Time, amount int64) (int64, error) {
+	newValue := value + amount
+	if newValue < 0 {
+		newValue = 0
+	}
+
+	// Only check capacity if we're heading towards the upper limit
+	if amount > 0 {
+		// Are we already over capacity, or about to overflow beyond what we're allowed to? Error if so.
+		if value > c.Capacity || newValue > (c.Capacity+c.OverflowLimit) {
+			if delay, ok := c.delay(value, lastDrain, now, amount); ok {
+				return value, &BucketFullError{RetryAfter: delay}
+			}
+			return value, ErrBucketFull
+		}
+	}
+
+	return newValue, nil
+}
+
+// delay returns how long until the given amount can be added to a drained bucket with this config. If
+// the amount can never be added, false is returned.
+func (c Config) delay(value int64, lastDrain time.Time, now time.Time, amount int64) (time.Duration, bool) {
+	// Add requires that the bucket be within capacity, and not overflow by more than allowed.
+	target := min(c.Capacity, c.Capacity+c.OverflowLimit-amount)
+	if target < 0 {
+		return 0, false
+	}
+	return c.until(value, lastDrain, now, target), true
+}
+
+// until returns how long until a drained bucket with this config drains to the given target value.
+func (c Config) until(value int64, lastDrain time.Time, now time.Time, target int64) time.Duration {
+	if value <= target {
+		return 0
+	}
+	if c.DrainBy <= 0 || c.DrainInterval <= 0 {
+		return time.Duration(math.MaxInt64) // never drains
+	}
+
+	var drainTime time.Duration
+	if c.Mode == DrainContinuous {
+		drainTime = c.unitsDuration(value - target)
+	} else {
+		leaks := (value - target + c.DrainBy - 1) / c.DrainBy
+		if leaks > int64(math.MaxInt64/c.DrainInterval) {
+			return time.Duration(math.MaxInt64)
+		}
+		drainTime = time.Duration(leaks) * c.DrainInterval
+	}
+	wait := drainTime - now.Sub(lastDrain)
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// backoff returns the value a drained bucket with this config must have so that adding a single unit
+// is not possible for at least retryAfter. The result is never less than the given value.
+func (c Config) backoff(value int64, lastDrain time.Time, now time.Time, retryAfter time.Duration) int64 {
+	if retryAfter <= 0 || c.DrainBy <= 0 || c.DrainInterval <= 0 {
+		return value
+	}
+	target := min(c.Capacity, c.Capacity+c.OverflowLimit-1)
+
+	// Time already elapsed since the last drain counts towards the next drain, so must be made up
+	elapsed := now.Sub(lastDrain)
+	drainTime := retryAfter + elapsed
+	if elapsed > 0 && drainTime < retryAfter {
+		drainTime = time.Duration(math.MaxInt64)
+	}
+	var units int64
+	if c.Mode == DrainContinuous {
+		var ok bool
+		if units, ok = mulDiv(int64(drainTime), c.DrainBy, int64(c.DrainInterval)); !ok {
+			return math.MaxInt64
+		}
+		if c.unitsDuration(units) < drainTime {
+			units++ // round up so the bucket isn't available early
+		}
+	} else {
+		leaks := int64(drainTime / c.DrainInterval)
+		if drainTime%c.DrainInterval != 0 {
+			leaks++ // round up so the bucket isn't available early
+		}
+		if leaks > math.MaxInt64/c.DrainBy {
+			return math.MaxInt64
+		}
+		units = leaks * c.DrainBy
+	}
+	if units > math.MaxInt64-target {
+		return math.MaxInt64
+	}
+	return max(value, target+units)
+}
+
+// unitsDuration returns the shortest time a bucket with this config takes to drain the given number of
+// units in DrainContinuous mode. If the duration would overflow, the maximum duration is returned.
+func (c Config) unitsDuration(units int64) time.Duration {
+	hi, lo := bits.Mul64(uint64(units), uint64(c.DrainInterval))
+	if hi >= uint64(c.DrainBy) {
+		return time.Duration(math.MaxInt64)
+	}
+	d, rem := bits.Div64(hi, lo, uint64(c.DrainBy))
+	if rem > 0 {
+		d++ // round up so we never drain early
+	}
+	if d > math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(d)
+}
+
+// mulDiv returns a * b / c, rounded down, for non-negative a and positive b and c. If the result
+// does not fit in an int64, false is returned.
+func mulDiv(a int64, b int64, c int64) (int64, bool) {
+	hi, lo := bits.Mul64(uint64(a), uint64(b))
+	if hi >= uint64(c) {
+		return 0, false
+	}
+	q, _ := bits.Div64(hi, lo, uint64(c))
+	if q > math.MaxInt64 {
+		return 0, false
+	}
+	return int64(q), true
+}
@@ -0,0 +1,86 @@
+package leaky
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	valid := Config{DrainBy: 5, DrainInterval: time.Minute, Capacity: 300}
+	assert.Nil(t, valid.Validate())
+
+	config := valid
+	config.DrainBy = 0
+	assert.EqualError(t, config.Validate(), "leaky: bucket never drains")
+
+	config = valid
+	config.DrainInterval = -1 * time.Minute
+	assert.EqualError(t, config.Validate(), "leaky: bucket never drains")
+
+	config = valid
+	config.Capacity = 0
+	assert.EqualError(t, config.Validate(), "leaky: bucket can never fill")
+
+	config = valid
+	config.OverflowLimit = -1
+	assert.EqualError(t, config.Validate(), "leaky: overflow limit cannot be negative")
+
+	config = valid
+	config.Mode = 42
+	assert.EqualError(t, config.Validate(), "leaky: unsupported drain mode")
+}
+
+func TestNewBucketFromConfig(t *testing.T) {
+	var err error
+
+	_, err = NewBucketFromConfig(Config{DrainBy: 5, DrainInterval: time.Minute})
+	assert.EqualError(t, err, "leaky: bucket can never fill")
+
+	_, err = NewBucketFromConfig(Config{DrainBy: 5, DrainInterval: time.Minute, Capacity: 300}, WithClock(nil))
+	assert.EqualError(t, err, "leaky: clock cannot be nil")
+
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	bucket, err := NewBucketFromConfig(Config{
+		DrainBy:       5,
+		DrainInterval: time.Minute,
+		Capacity:      300,
+		OverflowLimit: 10,
+		Mode:          DrainContinuous,
+	}, WithClock(clock))
+	assert.Nil(t, err)
+	assert.NotNil(t, bucket)
+	assert.Equal(t, int64(5), bucket.DrainBy)
+	assert.Equal(t, time.Minute, bucket.DrainInterval)
+	assert.Equal(t, int64(300), bucket.Capacity)
+	assert.Equal(t, int64(10), bucket.OverflowLimit)
+	assert.Equal(t, DrainContinuous, bucket.Mode)
+	assert.Equal(t, int64(0), bucket.value)
+	assert.Equal(t, clock.Now(), bucket.lastDrain)
+}
+
+func TestConfig_backoff(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	config := Config{DrainBy: 5, DrainInterval: time.Minute, Capacity: 300}
+
+	// Nothing to do
+	assert.Equal(t, int64(7), config.backoff(7, now, now, 0))
+	assert.Equal(t, int64(7), Config{}.backoff(7, now, now, time.Minute))
+
+	// Exact multiples of the interval aren't rounded up
+	assert.Equal(t, int64(304), config.backoff(0, now, now, time.Minute))
+	assert.Equal(t, int64(309), config.backoff(0, now, now, time.Minute+1))
+
+	// Saturates when the value would overflow
+	config.DrainBy = math.MaxInt64
+	assert.Equal(t, int64(math.MaxInt64), config.backoff(0, now, now, 2*time.Minute))
+	assert.Equal(t, int64(math.MaxInt64), config.backoff(0, now, now, time.Minute))
+	config.Mode = DrainContinuous
+	assert.Equal(t, int64(math.MaxInt64), config.backoff(0, now, now, time.Hour))
+
+	// Elapsed time can't push the drain time past the maximum duration
+	config.DrainBy = 5
+	assert.Equal(t, config.backoff(0, now, now, time.Duration(math.MaxInt64)), config.backoff(0, now.Add(-time.Hour), now, time.Duration(math.MaxInt64)-time.Minute))
+}
@@ -15,8 +15,11 @@ func main() {
 	}
 
 	// Try to add to the bucket
-	if err = bucket.Add(50); errors.Is(err, leaky.ErrBucketFull) {
-		panic("bucket is full") // or cancel the request, return a 429, etc
+	var fullErr *leaky.BucketFullError
+	if err = bucket.Add(50); errors.As(err, &fullErr) {
+		panic(fmt.Sprintf("bucket is full, retry after %s", fullErr.RetryAfter)) // or cancel the request, return a 429, etc
+	} else if errors.Is(err, leaky.ErrBucketFull) {
+		panic("bucket can never fit the amount")
 	} else if err != nil {
 		panic(err) // TODO: Handle error
 	} else {
@@ -43,9 +46,14 @@ func main() {
 	}
 
 	// Expand the bucket in any direction
-	bucket.Capacity = 700
-	bucket.DrainBy = 40
-	bucket.DrainInterval = time.Hour
+	// Pending drains are applied at the old rate before the new parameters take effect.
+	config := bucket.Config()
+	config.Capacity = 700
+	config.DrainBy = 40
+	config.DrainInterval = time.Hour
+	if err = bucket.Reconfigure(config); err != nil {
+		panic(err) // TODO: Handle error
+	}
 	fmt.Println("Remaining capacity after expansion:", bucket.Remaining())
 	fmt.Println("Size after expansion:", bucket.Value())
 }
@@ -16,6 +16,7 @@ func main() {
 
 	// Set some values so we can compare later
 	bucket.OverflowLimit = 7
+	bucket.Mode = leaky.DrainContinuous
 	if err = bucket.Set(42); err != nil {
 		panic(err) // TODO: Handle error
 	}
@@ -45,4 +46,5 @@ func printBucket(bucket *leaky.Bucket) {
 	fmt.Println("  DrainBy:", bucket.DrainBy)
 	fmt.Println("  DrainInterval:", bucket.DrainInterval)
 	fmt.Println("  OverflowLimit: ", bucket.OverflowLimit)
+	fmt.Println("  Mode:", bucket.Mode)
 }
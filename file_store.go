@@ -0,0 +1,164 @@
+package leaky
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStore is a Store which keeps one encoded bucket per key in a directory. Writes go to a temporary
+// file which is then renamed over the bucket's file, so readers never see a partially written bucket.
+//
+// CompareAndSwap is atomic between goroutines using the same FileStore. Separate processes sharing a
+// directory will not corrupt each other's buckets, but may overwrite each other's changes.
+type FileStore struct {
+	dir   string
+	opts  *options
+	locks [64]sync.Mutex
+}
+
+// NewFileStore creates a new FileStore which keeps buckets in the given directory, creating it if needed.
+// The options are applied to each bucket loaded from the store.
+//
+// Example usage:
+//
+//	store, err := leaky.NewFileStore("/var/lib/myapp/buckets")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//
+// Parameters:
+//
+//	dir     - the directory to keep buckets in
+//	opts    - the options to apply to loaded buckets
+//
+// Return values:
+//
+//	*FileStore  - the created FileStore instance
+//	error       - error message if the directory cannot be created or the options are invalid
+func NewFileStore(dir string, opts ...Option) (*FileStore, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dir, 0o700); err != nil {
+		return nil, errors.Join(errors.New("leaky: unable to create store directory"), err)
+	}
+	return &FileStore{
+		dir:  dir,
+		opts: o,
+	}, nil
+}
+
+// path returns the file path for the given key. Keys are hashed so that any string can be used safely.
+func (s *FileStore) path(key string) (string, *sync.Mutex) {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(hash[:])+".bucket"), &s.locks[hash[0]%byte(len(s.locks))]
+}
+
+// Load returns the bucket stored for the given key, or ErrNotFound if there is none.
+func (s *FileStore) Load(ctx context.Context, key string) (*Bucket, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	path, _ := s.path(key)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, errors.Join(errors.New("leaky: unable to read bucket file"), err)
+	}
+	bucket, err := DecodeBucket(bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	bucket.clock = s.opts.clock
+	return bucket, nil
+}
+
+// Save stores the bucket for the given key, replacing any existing bucket.
+func (s *FileStore) Save(ctx context.Context, key string, bucket *Bucket) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	path, lock := s.path(key)
+	lock.Lock()
+	defer lock.Unlock()
+	return s.write(path, bucket)
+}
+
+// CompareAndSwap stores the new bucket for the given key only if the currently stored bucket is identical
+// to old, or there is no stored bucket and old is nil. The stored bucket is decoded and compared by its
+// parameters and state, so it matches regardless of which encoding it was written with.
+func (s *FileStore) CompareAndSwap(ctx context.Context, key string, old *Bucket, new *Bucket) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	path, lock := s.path(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	current, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		current = nil
+	} else if err != nil {
+		return false, errors.Join(errors.New("leaky: unable to read bucket file"), err)
+	}
+
+	if old == nil {
+		if current != nil {
+			return false, nil
+		}
+	} else {
+		if current == nil {
+			return false, nil
+		}
+		stored, err := DecodeBucket(bytes.NewBuffer(current))
+		if err != nil {
+			return false, err
+		}
+		if !stored.Snapshot().Equal(old.Snapshot()) {
+			return false, nil
+		}
+	}
+
+	if err = s.write(path, new); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// write atomically replaces the file at path with the encoded bucket. The caller must hold the key's lock.
+func (s *FileStore) write(path string, bucket *Bucket) error {
+	buf := &bytes.Buffer{}
+	if err := bucket.Encode(buf); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return errors.Join(errors.New("leaky: unable to create temporary file"), err)
+	}
+	defer os.Remove(f.Name()) // no-op once renamed
+	if _, err = f.Write(buf.Bytes()); err != nil {
+		_ = f.Close()
+		return errors.Join(errors.New("leaky: unable to write temporary file"), err)
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return errors.Join(errors.New("leaky: unable to sync temporary file"), err)
+	}
+	if err = f.Close(); err != nil {
+		return errors.Join(errors.New("leaky: unable to close temporary file"), err)
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		return errors.Join(errors.New("leaky: unable to replace bucket file"), err)
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package leaky
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestFileStore(t *testing.T) (*FileStore, *ManualClock) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	store, err := NewFileStore(t.TempDir(), WithClock(clock))
+	if err != nil {
+		t.Fatalf("newTestFileStore: unexpected error %v", err)
+	}
+	return store, clock
+}
+
+func TestNewFileStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "nested", "buckets")
+
+	_, err := NewFileStore(dir, WithClock(nil))
+	assert.EqualError(t, err, "leaky: clock cannot be nil")
+
+	store, err := NewFileStore(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, store)
+	info, err := os.Stat(dir)
+	assert.Nil(t, err)
+	assert.True(t, info.IsDir())
+
+	file := filepath.Join(t.TempDir(), "file")
+	assert.Nil(t, os.WriteFile(file, nil, 0o600))
+	_, err = NewFileStore(file)
+	assert.ErrorContains(t, err, "leaky: unable to create store directory")
+}
+
+func TestFileStore_LoadSave(t *testing.T) {
+	ctx := context.Background()
+	for i, f := range createCaseFunctions {
+		store, clock := newTestFileStore(t)
+
+		_, err := store.Load(ctx, "a")
+		assert.ErrorIs(t, err, ErrNotFound, "TestFileStore_LoadSave(case:%d)", i)
+
+		bucket, err := f(5, time.Minute, 300)
+		if err != nil {
+			t.Fatalf("TestFileStore_LoadSave(case:%d): unexpected error %v", i, err)
+		}
+		bucket.OverflowLimit = 10
+		bucket.Mode = DrainContinuous
+		assert.Nil(t, bucket.Set(42), "TestFileStore_LoadSave(case:%d)", i)
+		assert.Nil(t, store.Save(ctx, "a", bucket), "TestFileStore_LoadSave(case:%d)", i)
+
+		loaded, err := store.Load(ctx, "a")
+		assert.Nil(t, err, "TestFileStore_LoadSave(case:%d)", i)
+		assert.Equal(t, bucket.Config(), loaded.Config(), "TestFileStore_LoadSave(case:%d)", i)
+		assert.Equal(t, int64(42), loaded.Peek(), "TestFileStore_LoadSave(case:%d)", i)
+		assert.True(t, bucket.lastDrain.Equal(loaded.lastDrain), "TestFileStore_LoadSave(case:%d)", i)
+		assert.Equal(t, Clock(clock), loaded.clock, "TestFileStore_LoadSave(case:%d)", i)
+
+		// Other keys are independent
+		_, err = store.Load(ctx, "b")
+		assert.ErrorIs(t, err, ErrNotFound, "TestFileStore_LoadSave(case:%d)", i)
+
+		// Saving again replaces the bucket
+		assert.Nil(t, bucket.Set(7), "TestFileStore_LoadSave(case:%d)", i)
+		assert.Nil(t, store.Save(ctx, "a", bucket), "TestFileStore_LoadSave(case:%d)", i)
+		loaded, err = store.Load(ctx, "a")
+		assert.Nil(t, err, "TestFileStore_LoadSave(case:%d)", i)
+		assert.Equal(t, int64(7), loaded.Peek(), "TestFileStore_LoadSave(case:%d)", i)
+
+		// No temporary files are left behind
+		entries, err := os.ReadDir(store.dir)
+		assert.Nil(t, err, "TestFileStore_LoadSave(case:%d)", i)
+		assert.Len(t, entries, 1, "TestFileStore_LoadSave(case:%d)", i)
+	}
+}
+
+func TestFileStore_Keys(t *testing.T) {
+	ctx := context.Background()
+	store, _ := newTestFileStore(t)
+
+	// Keys which are not valid file names are still usable
+	keys := []string{"", ".", "..", "a/b", "../escape", "\x00", string(make([]byte, 1024))}
+	for i, key := range keys {
+		bucket, err := NewBucket(5, time.Minute, 300)
+		if err != nil {
+			t.Fatalf("TestFileStore_Keys(case:%d): unexpected error %v", i, err)
+		}
+		assert.Nil(t, bucket.Set(int64(i)), "TestFileStore_Keys(case:%d)", i)
+		assert.Nil(t, store.Save(ctx, key, bucket), "TestFileStore_Keys(case:%d)", i)
+	}
+	for i, key := range keys {
+		loaded, err := store.Load(ctx, key)
+		assert.Nil(t, err, "TestFileStore_Keys(case:%d)", i)
+		assert.Equal(t, int64(i), loaded.Peek(), "TestFileStore_Keys(case:%d)", i)
+	}
+	entries, err := os.ReadDir(store.dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, len(keys))
+}
+
+func TestFileStore_LoadCorrupt(t *testing.T) {
+	ctx := context.Background()
+	store, _ := newTestFileStore(t)
+
+	bucket, err := NewBucket(5, time.Minute, 300)
+	if err != nil {
+		t.Fatalf("TestFileStore_LoadCorrupt: unexpected error %v", err)
+	}
+	assert.Nil(t, store.Save(ctx, "a", bucket))
+	path, _ := store.path("a")
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	data[len(data)-1] ^= 0xFF
+	assert.Nil(t, os.WriteFile(path, data, 0o600))
+
+	_, err = store.Load(ctx, "a")
+	assert.ErrorContains(t, err, "leaky: checksum mismatch")
+}
+
+func TestFileStore_CompareAndSwap(t *testing.T) {
+	ctx := context.Background()
+	for i, f := range createCaseFunctions {
+		store, _ := newTestFileStore(t)
+
+		first, err := f(5, time.Minute, 300)
+		if err != nil {
+			t.Fatalf("TestFileStore_CompareAndSwap(case:%d): unexpected error %v", i, err)
+		}
+		second, err := f(5, time.Minute, 300)
+		if err != nil {
+			t.Fatalf("TestFileStore_CompareAndSwap(case:%d): unexpected error %v", i, err)
+		}
+		assert.Nil(t, second.Set(10), "TestFileStore_CompareAndSwap(case:%d)", i)
+
+		// Mismatched old bucket when nothing is stored
+		swapped, err := store.CompareAndSwap(ctx, "a", first, second)
+		assert.Nil(t, err, "TestFileStore_CompareAndSwap(case:%d)", i)
+		assert.False(t, swapped, "TestFileStore_CompareAndSwap(case:%d)", i)
+
+		// Nil old bucket when nothing is stored
+		swapped, err = store.CompareAndSwap(ctx, "a", nil, first)
+		assert.Nil(t, err, "TestFileStore_CompareAndSwap(case:%d)", i)
+		assert.True(t, swapped, "TestFileStore_CompareAndSwap(case:%d)", i)
+
+		// Nil old bucket when something is stored
+		swapped, err = store.CompareAndSwap(ctx, "a", nil, second)
+		assert.Nil(t, err, "TestFileStore_CompareAndSwap(case:%d)", i)
+		assert.False(t, swapped, "TestFileStore_CompareAndSwap(case:%d)", i)
+
+		// Matching old bucket, as loaded
+		loaded, err := store.Load(ctx, "a")
+		assert.Nil(t, err, "TestFileStore_CompareAndSwap(case:%d)", i)
+		swapped, err = store.CompareAndSwap(ctx, "a", loaded, second)
+		assert.Nil(t, err, "TestFileStore_CompareAndSwap(case:%d)", i)
+		assert.True(t, swapped, "TestFileStore_CompareAndSwap(case:%d)", i)
+
+		// Stale old bucket
+		swapped, err = store.CompareAndSwap(ctx, "a", loaded, first)
+		assert.Nil(t, err, "TestFileStore_CompareAndSwap(case:%d)", i)
+		assert.False(t, swapped, "TestFileStore_CompareAndSwap(case:%d)", i)
+
+		loaded, err = store.Load(ctx, "a")
+		assert.Nil(t, err, "TestFileStore_CompareAndSwap(case:%d)", i)
+		assert.Equal(t, int64(10), loaded.Peek(), "TestFileStore_CompareAndSwap(case:%d)", i)
+	}
+}
+
+func TestFileStore_CompareAndSwapEncodings(t *testing.T) {
+	ctx := context.Background()
+	store, clock := newTestFileStore(t)
+	bucket, err := NewBucketWithOptions(5, time.Minute, 300, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestFileStore_CompareAndSwapEncodings: unexpected error %v", err)
+	}
+	assert.Nil(t, bucket.Add(10))
+
+	// Stored in a different encoding than the store writes
+	buf := &bytes.Buffer{}
+	assert.Nil(t, bucket.EncodeWith(buf, EncodingCompact))
+	path, _ := store.path("a")
+	assert.Nil(t, os.WriteFile(path, buf.Bytes(), 0o600))
+
+	// Still matches the bucket as loaded
+	assert.Nil(t, UpdateBucket(ctx, store, "a", nil, func(bucket *Bucket) error {
+		return bucket.Add(1)
+	}))
+	loaded, err := store.Load(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), loaded.Peek())
+}
+
+func TestFileStore_Context(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	store, _ := newTestFileStore(t)
+	bucket, err := NewBucket(5, time.Minute, 300)
+	if err != nil {
+		t.Fatalf("TestFileStore_Context: unexpected error %v", err)
+	}
+
+	_, err = store.Load(ctx, "a")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.ErrorIs(t, store.Save(ctx, "a", bucket), context.Canceled)
+	_, err = store.CompareAndSwap(ctx, "a", nil, bucket)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestUpdateBucket(t *testing.T) {
+	ctx := context.Background()
+	store, clock := newTestFileStore(t)
+	create := func() (*Bucket, error) {
+		return NewBucketFromConfig(testRegistryConfig, WithClock(clock))
+	}
+	add := func(amount int64) func(bucket *Bucket) error {
+		return func(bucket *Bucket) error {
+			return bucket.Add(amount)
+		}
+	}
+
+	// Creates the bucket if needed
+	assert.Nil(t, UpdateBucket(ctx, store, "a", create, add(100)))
+	loaded, err := store.Load(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, testRegistryConfig, loaded.Config())
+	assert.Equal(t, int64(100), loaded.Peek())
+
+	// Modifies the existing bucket, draining it first
+	clock.Advance(time.Minute)
+	assert.Nil(t, UpdateBucket(ctx, store, "a", create, add(100)))
+	loaded, err = store.Load(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(195), loaded.Peek())
+
+	// Errors from fn are returned, and nothing is saved
+	err = UpdateBucket(ctx, store, "a", create, add(1000))
+	assert.ErrorIs(t, err, ErrBucketFull)
+	loaded, err = store.Load(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(195), loaded.Peek())
+
+	// Errors from create are returned
+	createErr := errors.New("create error")
+	err = UpdateBucket(ctx, store, "b", func() (*Bucket, error) {
+		return nil, createErr
+	}, add(1))
+	assert.ErrorIs(t, err, createErr)
+	_, err = store.Load(ctx, "b")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestUpdateBucket_Concurrent(t *testing.T) {
+	ctx := context.Background()
+	store, clock := newTestFileStore(t)
+	create := func() (*Bucket, error) {
+		return NewBucketFromConfig(testRegistryConfig, WithClock(clock))
+	}
+
+	const goroutines = 8
+	const adds = 10
+	wg := sync.WaitGroup{}
+	for range [goroutines]struct{}{} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range [adds]struct{}{} {
+				assert.Nil(t, UpdateBucket(ctx, store, "a", create, func(bucket *Bucket) error {
+					return bucket.Add(1)
+				}))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every update is kept despite conflicts
+	loaded, err := store.Load(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(goroutines*adds), loaded.Peek())
+}
+
+// conflictStore is a Store whose CompareAndSwap never succeeds, as though another writer always wins.
+type conflictStore struct {
+	Store
+	swaps int
+}
+
+func (s *conflictStore) CompareAndSwap(ctx context.Context, key string, old *Bucket, new *Bucket) (bool, error) {
+	s.swaps++
+	return false, nil
+}
+
+func TestUpdateBucket_Backoff(t *testing.T) {
+	fileStore, clock := newTestFileStore(t)
+	store := &conflictStore{Store: fileStore}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// Gives up with the context's error, having backed off between attempts
+	err := UpdateBucket(ctx, store, "a", func() (*Bucket, error) {
+		return NewBucketFromConfig(testRegistryConfig, WithClock(clock))
+	}, func(bucket *Bucket) error {
+		return bucket.Add(1)
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, store.swaps, 20)
+}
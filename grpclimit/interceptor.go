@@ -0,0 +1,240 @@
+// Package grpclimit provides gRPC server interceptors which limit the rate of calls and streamed messages
+// using leaky buckets.
+package grpclimit
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	leaky "github.com/t2bot/go-leaky-bucket"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// CostFunc returns how much a call, or a message within a stream, adds to its bucket. A cost of zero or
+// less means it is not limited.
+type CostFunc func(ctx context.Context, fullMethod string) int64
+
+// Cost returns a CostFunc which charges the same amount for every call or message.
+func Cost(amount int64) CostFunc {
+	return func(ctx context.Context, fullMethod string) int64 {
+		return amount
+	}
+}
+
+// Interceptor limits calls to a gRPC server, adding the cost of each call to the bucket for its key.
+// Calls which would overflow the bucket fail with codes.ResourceExhausted.
+type Interceptor struct {
+	limiter     leaky.Limiter
+	keyFunc     KeyFunc
+	costFunc    CostFunc
+	messageCost CostFunc
+}
+
+// Option configures an Interceptor.
+type Option func(i *Interceptor)
+
+// WithKeyFunc sets how the bucket for a call is chosen. By default, Join(Method(), Peer()) is used, so
+// each client has a bucket for each method.
+func WithKeyFunc(keyFunc KeyFunc) Option {
+	return func(i *Interceptor) {
+		i.keyFunc = keyFunc
+	}
+}
+
+// WithCostFunc sets how much each call costs, charged when the call starts. By default, every call costs
+// 1.
+func WithCostFunc(costFunc CostFunc) Option {
+	return func(i *Interceptor) {
+		i.costFunc = costFunc
+	}
+}
+
+// WithMessageCostFunc sets how much each message received on a stream costs, charged after the message is
+// received. By default, messages are free.
+func WithMessageCostFunc(costFunc CostFunc) Option {
+	return func(i *Interceptor) {
+		i.messageCost = costFunc
+	}
+}
+
+// NewInterceptor creates a new Interceptor which adds to buckets from the given limiter.
+//
+// Example usage:
+//
+//	registry, err := leaky.NewRegistry(leaky.Config{
+//		DrainBy:       5,
+//		DrainInterval: time.Second,
+//		Capacity:      100,
+//	}, time.Hour)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	interceptor, err := grpclimit.NewInterceptor(registry, grpclimit.WithMessageCostFunc(grpclimit.Cost(1)))
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	server := grpc.NewServer(
+//		grpc.UnaryInterceptor(interceptor.Unary()),
+//		grpc.StreamInterceptor(interceptor.Stream()))
+//
+// Parameters:
+//
+//	limiter - the limiter holding the bucket for each key
+//	opts    - the options to apply to the interceptor
+//
+// Return values:
+//
+//	*Interceptor    - the created Interceptor instance
+//	error           - error message if the limiter or options are invalid
+func NewInterceptor(limiter leaky.Limiter, opts ...Option) (*Interceptor, error) {
+	if limiter == nil {
+		return nil, errors.New("grpclimit: limiter cannot be nil")
+	}
+	i := &Interceptor{
+		limiter:     limiter,
+		keyFunc:     Join(Method(), Peer()),
+		costFunc:    Cost(1),
+		messageCost: Cost(0),
+	}
+	for _, opt := range opts {
+		opt(i)
+	}
+	if i.keyFunc == nil {
+		return nil, errors.New("grpclimit: key function cannot be nil")
+	}
+	if i.costFunc == nil {
+		return nil, errors.New("grpclimit: cost function cannot be nil")
+	}
+	if i.messageCost == nil {
+		return nil, errors.New("grpclimit: message cost function cannot be nil")
+	}
+	return i, nil
+}
+
+// charge adds the given cost to the bucket for the key, returning a gRPC status error if it cannot.
+func (i *Interceptor) charge(key string, cost int64) error {
+	if cost <= 0 {
+		return nil
+	}
+	if err := i.limiter.Add(key, cost); err != nil {
+		return limitError(err)
+	}
+	return nil
+}
+
+// key returns the bucket key for a call, converting errors to gRPC status errors.
+func (i *Interceptor) key(ctx context.Context, fullMethod string) (string, error) {
+	key, err := i.keyFunc(ctx, fullMethod)
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return "", err
+		}
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	return key, nil
+}
+
+// Unary returns a grpc.UnaryServerInterceptor which charges each call before it is handled.
+func (i *Interceptor) Unary() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		cost := i.costFunc(ctx, info.FullMethod)
+		if cost <= 0 {
+			return handler(ctx, req)
+		}
+		key, err := i.key(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		if err = i.charge(key, cost); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// Stream returns a grpc.StreamServerInterceptor which charges each stream before it is handled, and each
+// message received on it.
+func (i *Interceptor) Stream() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := ss.Context()
+		cost := i.costFunc(ctx, info.FullMethod)
+		messageCost := i.messageCost(ctx, info.FullMethod)
+		if cost <= 0 && messageCost <= 0 {
+			return handler(srv, ss)
+		}
+		key, err := i.key(ctx, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		if err = i.charge(key, cost); err != nil {
+			return err
+		}
+		if messageCost <= 0 {
+			return handler(srv, ss)
+		}
+		return handler(srv, &limitedStream{
+			ServerStream: ss,
+			interceptor:  i,
+			key:          key,
+			cost:         messageCost,
+		})
+	}
+}
+
+// limitedStream is a grpc.ServerStream which charges each received message.
+type limitedStream struct {
+	grpc.ServerStream
+
+	interceptor *Interceptor
+	key         string
+	cost        int64
+}
+
+// RecvMsg receives a message, then charges for it. If the bucket is full, the message is discarded and a
+// codes.ResourceExhausted error is returned, which ends the stream when returned by the handler.
+func (s *limitedStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return s.interceptor.charge(s.key, s.cost)
+}
+
+// limitError returns the gRPC status error for an error from leaky.Limiter.Add. When the bucket is full,
+// the error has codes.ResourceExhausted, and a RetryInfo detail if the call could be retried.
+func limitError(err error) error {
+	var fullErr *leaky.BucketFullError
+	if errors.As(err, &fullErr) {
+		st := status.New(codes.ResourceExhausted, "grpclimit: rate limit exceeded")
+		detailed, detailErr := st.WithDetails(&errdetails.RetryInfo{
+			RetryDelay: durationpb.New(max(fullErr.RetryAfter, time.Nanosecond)),
+		})
+		if detailErr != nil {
+			return st.Err() // not possible with a valid duration
+		}
+		return detailed.Err()
+	}
+	if errors.Is(err, leaky.ErrBucketFull) {
+		return status.Error(codes.ResourceExhausted, "grpclimit: cost exceeds rate limit")
+	}
+	return status.Error(codes.Internal, "grpclimit: unable to check rate limit")
+}
+
+// RetryDelay returns the delay from the RetryInfo detail of a gRPC status error, such as one returned by
+// an Interceptor. If the error has no RetryInfo, false is returned.
+func RetryDelay(err error) (time.Duration, bool) {
+	st, ok := status.FromError(err)
+	if !ok {
+		return 0, false
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok && info.RetryDelay.IsValid() {
+			return info.RetryDelay.AsDuration(), true
+		}
+	}
+	return 0, false
+}
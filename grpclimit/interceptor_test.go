@@ -0,0 +1,300 @@
+package grpclimit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	leaky "github.com/t2bot/go-leaky-bucket"
+	"github.com/t2bot/go-leaky-bucket/internal/leakytest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// testService is a hand-written service descriptor so the tests don't need generated code. Echo is a unary
+// method returning its argument, and Count is a client-streaming method returning the number of messages
+// received.
+var testService = grpc.ServiceDesc{
+	ServiceName: "test.Test",
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Echo",
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			in := new(wrapperspb.Int64Value)
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req any) (any, error) {
+				return req, nil
+			}
+			if interceptor == nil {
+				return handler(ctx, in)
+			}
+			return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/test.Test/Echo"}, handler)
+		},
+	}},
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Count",
+		ClientStreams: true,
+		Handler: func(srv any, stream grpc.ServerStream) error {
+			var count int64
+			for {
+				err := stream.RecvMsg(new(wrapperspb.Int64Value))
+				if errors.Is(err, io.EOF) {
+					return stream.SendMsg(wrapperspb.Int64(count))
+				}
+				if err != nil {
+					return err
+				}
+				count++
+			}
+		},
+	}},
+}
+
+var countStream = &grpc.StreamDesc{StreamName: "Count", ClientStreams: true}
+
+func newTestClient(t *testing.T, interceptor *Interceptor) *grpc.ClientConn {
+	listener := bufconn.Listen(1 << 16)
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(interceptor.Unary()),
+		grpc.StreamInterceptor(interceptor.Stream()))
+	server.RegisterService(&testService, struct{}{})
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("newTestClient: unexpected error %v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return conn
+}
+
+func echo(conn *grpc.ClientConn, ctx context.Context) error {
+	return conn.Invoke(ctx, "/test.Test/Echo", wrapperspb.Int64(1), new(wrapperspb.Int64Value))
+}
+
+func count(conn *grpc.ClientConn, messages int) (int64, error) {
+	stream, err := conn.NewStream(context.Background(), countStream, "/test.Test/Count")
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < messages; i++ {
+		if err = stream.SendMsg(wrapperspb.Int64(int64(i))); err != nil {
+			break // the server ended the stream; the error is reported by RecvMsg
+		}
+	}
+	if err = stream.CloseSend(); err != nil {
+		return 0, err
+	}
+	out := new(wrapperspb.Int64Value)
+	if err = stream.RecvMsg(out); err != nil {
+		return 0, err
+	}
+	return out.Value, nil
+}
+
+func TestNewInterceptor(t *testing.T) {
+	registry, _ := leakytest.NewRegistry(t)
+	var err error
+
+	_, err = NewInterceptor(nil)
+	assert.EqualError(t, err, "grpclimit: limiter cannot be nil")
+	_, err = NewInterceptor(registry, WithKeyFunc(nil))
+	assert.EqualError(t, err, "grpclimit: key function cannot be nil")
+	_, err = NewInterceptor(registry, WithCostFunc(nil))
+	assert.EqualError(t, err, "grpclimit: cost function cannot be nil")
+	_, err = NewInterceptor(registry, WithMessageCostFunc(nil))
+	assert.EqualError(t, err, "grpclimit: message cost function cannot be nil")
+
+	interceptor, err := NewInterceptor(registry)
+	assert.Nil(t, err)
+	assert.NotNil(t, interceptor)
+}
+
+func TestInterceptor_Unary(t *testing.T) {
+	registry, clock := leakytest.NewRegistry(t)
+	interceptor, err := NewInterceptor(registry)
+	assert.Nil(t, err)
+	conn := newTestClient(t, interceptor)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		assert.Nilf(t, echo(conn, ctx), "TestInterceptor_Unary(case:%d)", i)
+	}
+	err = echo(conn, ctx)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, "grpclimit: rate limit exceeded", status.Convert(err).Message())
+	delay, ok := RetryDelay(err)
+	assert.True(t, ok)
+	assert.Equal(t, 1500*time.Millisecond, delay)
+
+	// Each method has its own bucket by default
+	_, err = count(conn, 0)
+	assert.Nil(t, err)
+
+	clock.Advance(time.Second)
+	delay, ok = RetryDelay(echo(conn, ctx))
+	assert.True(t, ok)
+	assert.Equal(t, 500*time.Millisecond, delay)
+
+	clock.Advance(500 * time.Millisecond)
+	assert.Nil(t, echo(conn, ctx))
+	assert.Equal(t, int64(3), registry.Get("/test.Test/Echo|bufconn").Value())
+}
+
+func TestInterceptor_UnaryCost(t *testing.T) {
+	registry, _ := leakytest.NewRegistry(t)
+	interceptor, err := NewInterceptor(registry,
+		WithKeyFunc(Metadata("x-api-key")),
+		WithCostFunc(func(ctx context.Context, fullMethod string) int64 {
+			if values := metadata.ValueFromIncomingContext(ctx, "x-free"); len(values) > 0 {
+				return 0
+			}
+			return 2
+		}))
+	assert.Nil(t, err)
+	conn := newTestClient(t, interceptor)
+
+	alice := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "alice")
+	bob := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "bob")
+	assert.Nil(t, echo(conn, alice))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(echo(conn, alice)))
+	assert.Nil(t, echo(conn, bob))
+	assert.Equal(t, int64(2), registry.Get("alice").Value())
+	assert.Equal(t, int64(2), registry.Get("bob").Value())
+
+	// Free calls aren't charged, and don't need a key
+	assert.Nil(t, echo(conn, metadata.AppendToOutgoingContext(alice, "x-free", "1")))
+	assert.Nil(t, echo(conn, metadata.AppendToOutgoingContext(context.Background(), "x-free", "1")))
+
+	err = echo(conn, context.Background())
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	assert.Equal(t, "grpclimit: missing x-api-key metadata", status.Convert(err).Message())
+}
+
+func TestInterceptor_UnaryErrors(t *testing.T) {
+	registry, _ := leakytest.NewRegistry(t)
+	interceptor, err := NewInterceptor(registry,
+		WithKeyFunc(func(ctx context.Context, fullMethod string) (string, error) {
+			return "", errors.New("bad key")
+		}))
+	assert.Nil(t, err)
+	err = echo(newTestClient(t, interceptor), context.Background())
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, "bad key", status.Convert(err).Message())
+
+	// Calls which can never fit don't include retry info
+	interceptor, err = NewInterceptor(registry, WithCostFunc(Cost(10)))
+	assert.Nil(t, err)
+	err = echo(newTestClient(t, interceptor), context.Background())
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, "grpclimit: cost exceeds rate limit", status.Convert(err).Message())
+	_, ok := RetryDelay(err)
+	assert.False(t, ok)
+
+	interceptor, err = NewInterceptor(leakytest.ErrorLimiter{})
+	assert.Nil(t, err)
+	err = echo(newTestClient(t, interceptor), context.Background())
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.Equal(t, "grpclimit: unable to check rate limit", status.Convert(err).Message())
+}
+
+func TestInterceptor_Stream(t *testing.T) {
+	registry, clock := leakytest.NewRegistry(t)
+	interceptor, err := NewInterceptor(registry,
+		WithKeyFunc(Method()),
+		WithCostFunc(Cost(0)),
+		WithMessageCostFunc(Cost(1)))
+	assert.Nil(t, err)
+	conn := newTestClient(t, interceptor)
+
+	n, err := count(conn, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+	assert.Equal(t, int64(2), registry.Get("/test.Test/Count").Value())
+
+	// The stream ends once the bucket overflows
+	_, err = count(conn, 5)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	delay, ok := RetryDelay(err)
+	assert.True(t, ok)
+	assert.Equal(t, 1500*time.Millisecond, delay)
+	assert.Equal(t, int64(3), registry.Get("/test.Test/Count").Value())
+
+	// Streams without messages are free
+	n, err = count(conn, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+
+	clock.Advance(3 * time.Second)
+	n, err = count(conn, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+
+	// Unary calls are not affected by the message cost
+	interceptor, err = NewInterceptor(registry, WithCostFunc(Cost(0)), WithMessageCostFunc(Cost(1)))
+	assert.Nil(t, err)
+	conn = newTestClient(t, interceptor)
+	for i := 0; i < 5; i++ {
+		assert.Nilf(t, echo(conn, context.Background()), "TestInterceptor_Stream(case:%d)", i)
+	}
+}
+
+func TestInterceptor_StreamCost(t *testing.T) {
+	registry, _ := leakytest.NewRegistry(t)
+	interceptor, err := NewInterceptor(registry, WithKeyFunc(Method()), WithCostFunc(Cost(2)))
+	assert.Nil(t, err)
+	conn := newTestClient(t, interceptor)
+
+	// Messages are free by default, so only the stream itself is charged
+	n, err := count(conn, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), n)
+	assert.Equal(t, int64(2), registry.Get("/test.Test/Count").Value())
+
+	_, err = count(conn, 1)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	delay, ok := RetryDelay(err)
+	assert.True(t, ok)
+	assert.Equal(t, 1500*time.Millisecond, delay)
+
+	interceptor, err = NewInterceptor(registry, WithKeyFunc(Metadata("x-api-key")), WithMessageCostFunc(Cost(1)))
+	assert.Nil(t, err)
+	_, err = count(newTestClient(t, interceptor), 1)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestRetryDelay(t *testing.T) {
+	_, ok := RetryDelay(nil)
+	assert.False(t, ok)
+	_, ok = RetryDelay(errors.New("not a status"))
+	assert.False(t, ok)
+	_, ok = RetryDelay(status.Error(codes.ResourceExhausted, "no details"))
+	assert.False(t, ok)
+
+	delay, ok := RetryDelay(limitError(&leaky.BucketFullError{RetryAfter: 2 * time.Second}))
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Second, delay)
+	delay, ok = RetryDelay(limitError(&leaky.BucketFullError{}))
+	assert.True(t, ok)
+	assert.Equal(t, time.Nanosecond, delay)
+}
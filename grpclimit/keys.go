@@ -0,0 +1,71 @@
+package grpclimit
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// KeyFunc returns the key identifying the bucket for a call, given the call's context and full method
+// name (such as "/package.Service/Method"). Calls with the same key share a bucket.
+//
+// If a KeyFunc returns a gRPC status error, it is returned to the client as-is. Other errors are returned
+// with codes.InvalidArgument.
+type KeyFunc func(ctx context.Context, fullMethod string) (string, error)
+
+// Method returns a KeyFunc which uses the full method name, so that each method has its own bucket.
+func Method() KeyFunc {
+	return func(ctx context.Context, fullMethod string) (string, error) {
+		return fullMethod, nil
+	}
+}
+
+// Peer returns a KeyFunc which uses the address of the client, without the port if it has one.
+func Peer() KeyFunc {
+	return func(ctx context.Context, fullMethod string) (string, error) {
+		p, ok := peer.FromContext(ctx)
+		if !ok || p.Addr == nil {
+			return "", status.Error(codes.Internal, "grpclimit: no peer for call")
+		}
+		addr := p.Addr.String()
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			return host, nil
+		}
+		return addr, nil
+	}
+}
+
+// Metadata returns a KeyFunc which uses the first value of the given incoming metadata key, such as an
+// API key or authenticated user set by earlier interceptors. Calls without the metadata are rejected with
+// codes.Unauthenticated.
+func Metadata(name string) KeyFunc {
+	return func(ctx context.Context, fullMethod string) (string, error) {
+		values := metadata.ValueFromIncomingContext(ctx, name)
+		if len(values) == 0 || values[0] == "" {
+			return "", status.Error(codes.Unauthenticated, fmt.Sprintf("grpclimit: missing %s metadata", name))
+		}
+		return values[0], nil
+	}
+}
+
+// Join returns a KeyFunc which combines the keys from each of the given functions, separated by "|". For
+// example, Join(Method(), Peer()) gives each client a separate bucket for each method.
+func Join(keyFuncs ...KeyFunc) KeyFunc {
+	return func(ctx context.Context, fullMethod string) (string, error) {
+		keys := make([]string, len(keyFuncs))
+		for i, keyFunc := range keyFuncs {
+			key, err := keyFunc(ctx, fullMethod)
+			if err != nil {
+				return "", err
+			}
+			keys[i] = key
+		}
+		return strings.Join(keys, "|"), nil
+	}
+}
@@ -0,0 +1,81 @@
+package grpclimit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+type testAddr string
+
+func (a testAddr) Network() string { return "test" }
+func (a testAddr) String() string  { return string(a) }
+
+func TestMethod(t *testing.T) {
+	key, err := Method()(context.Background(), "/test.Test/Echo")
+	assert.Nil(t, err)
+	assert.Equal(t, "/test.Test/Echo", key)
+}
+
+func TestPeer(t *testing.T) {
+	cases := []struct {
+		addr     net.Addr
+		expected string
+	}{
+		{net.TCPAddrFromAddrPort(netip.MustParseAddrPort("192.0.2.1:1234")), "192.0.2.1"},
+		{net.TCPAddrFromAddrPort(netip.MustParseAddrPort("[2001:db8::1]:1234")), "2001:db8::1"},
+		{testAddr("bufconn"), "bufconn"},
+		{&net.UnixAddr{Name: "/run/test.sock", Net: "unix"}, "/run/test.sock"},
+	}
+	for i, c := range cases {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: c.addr})
+		key, err := Peer()(ctx, "/test.Test/Echo")
+		assert.Nilf(t, err, "TestPeer(case:%d)", i)
+		assert.Equalf(t, c.expected, key, "TestPeer(case:%d)", i)
+	}
+
+	_, err := Peer()(context.Background(), "/test.Test/Echo")
+	assert.Equal(t, codes.Internal, status.Code(err))
+	_, err = Peer()(peer.NewContext(context.Background(), &peer.Peer{}), "/test.Test/Echo")
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
+
+func TestMetadata(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-api-key", "alice", "x-api-key", "bob"))
+	key, err := Metadata("X-API-Key")(ctx, "/test.Test/Echo")
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", key)
+
+	_, err = Metadata("x-api-key")(context.Background(), "/test.Test/Echo")
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	assert.Equal(t, "grpclimit: missing x-api-key metadata", status.Convert(err).Message())
+
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-api-key", ""))
+	_, err = Metadata("x-api-key")(ctx, "/test.Test/Echo")
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestJoin(t *testing.T) {
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: testAddr("bufconn")})
+	key, err := Join(Method(), Peer())(ctx, "/test.Test/Echo")
+	assert.Nil(t, err)
+	assert.Equal(t, "/test.Test/Echo|bufconn", key)
+
+	key, err = Join()(ctx, "/test.Test/Echo")
+	assert.Nil(t, err)
+	assert.Equal(t, "", key)
+
+	failing := func(ctx context.Context, fullMethod string) (string, error) {
+		return "", errors.New("no key")
+	}
+	_, err = Join(Method(), failing)(ctx, "/test.Test/Echo")
+	assert.EqualError(t, err, "no key")
+}
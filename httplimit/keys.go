@@ -0,0 +1,106 @@
+package httplimit
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// KeyFunc returns the key identifying the client making a request, such as its IP address or user ID.
+// Requests with the same key share a bucket.
+type KeyFunc func(r *http.Request) (string, error)
+
+// RemoteIP returns a KeyFunc which uses the IP address of the client. If the request came directly from
+// one of the trusted proxies, the X-Forwarded-For header is used to find the client instead: addresses
+// are read from right to left, skipping trusted proxies, and the first untrusted address is used. This
+// prevents clients from choosing their own key by sending a forged header.
+//
+// Example usage:
+//
+//	keyFunc := httplimit.RemoteIP(netip.MustParsePrefix("10.0.0.0/8"))
+//
+// Parameters:
+//
+//	trustedProxies  - the address ranges of proxies whose X-Forwarded-For header is trusted
+//
+// Return values:
+//
+//	KeyFunc - the created key function
+func RemoteIP(trustedProxies ...netip.Prefix) KeyFunc {
+	trusted := func(addr netip.Addr) bool {
+		for _, prefix := range trustedProxies {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(r *http.Request) (string, error) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr // no port
+		}
+		addr, err := netip.ParseAddr(host)
+		if err != nil {
+			return "", fmt.Errorf("httplimit: invalid remote address %q", r.RemoteAddr)
+		}
+		addr = addr.Unmap()
+		if !trusted(addr) {
+			return addr.String(), nil
+		}
+
+		forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(forwarded) - 1; i >= 0; i-- {
+			value := strings.TrimSpace(forwarded[i])
+			if value == "" {
+				continue
+			}
+			next, err := netip.ParseAddr(value)
+			if err != nil {
+				return "", fmt.Errorf("httplimit: invalid X-Forwarded-For address %q", value)
+			}
+			addr = next.Unmap()
+			if !trusted(addr) {
+				break
+			}
+		}
+		return addr.String(), nil
+	}
+}
+
+// Header returns a KeyFunc which uses the value of the given request header, such as an API key. Requests
+// without the header are rejected.
+func Header(name string) KeyFunc {
+	return func(r *http.Request) (string, error) {
+		value := r.Header.Get(name)
+		if value == "" {
+			return "", fmt.Errorf("httplimit: missing %s header", name)
+		}
+		return value, nil
+	}
+}
+
+// User returns a KeyFunc which uses the authenticated user stored in the request's context by earlier
+// middleware, under the given context key. The stored value must be a non-empty string. Requests without
+// a user are rejected.
+//
+// Example usage:
+//
+//	type userKey struct{}
+//	// in the authentication middleware:
+//	r = r.WithContext(context.WithValue(r.Context(), userKey{}, userId))
+//
+//	keyFunc := httplimit.User(userKey{})
+func User(contextKey any) KeyFunc {
+	return func(r *http.Request) (string, error) {
+		user, ok := r.Context().Value(contextKey).(string)
+		if !ok || user == "" {
+			return "", errors.New("httplimit: no authenticated user")
+		}
+		return user, nil
+	}
+}
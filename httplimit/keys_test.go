@@ -0,0 +1,86 @@
+package httplimit
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoteIP(t *testing.T) {
+	trusted := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("fd00::/8"),
+	}
+	cases := []struct {
+		remoteAddr string
+		forwarded  []string
+		trusted    []netip.Prefix
+		expected   string
+		err        string
+	}{
+		// Direct connections
+		{remoteAddr: "192.0.2.1:1234", expected: "192.0.2.1"},
+		{remoteAddr: "[2001:db8::1]:1234", expected: "2001:db8::1"},
+		{remoteAddr: "[::ffff:192.0.2.1]:1234", expected: "192.0.2.1"},
+		{remoteAddr: "192.0.2.1", expected: "192.0.2.1"},
+		{remoteAddr: "invalid", err: `httplimit: invalid remote address "invalid"`},
+
+		// Forged headers from untrusted clients are ignored
+		{remoteAddr: "192.0.2.1:1234", forwarded: []string{"198.51.100.1"}, expected: "192.0.2.1"},
+		{remoteAddr: "192.0.2.1:1234", forwarded: []string{"198.51.100.1"}, trusted: trusted, expected: "192.0.2.1"},
+
+		// Trusted proxies
+		{remoteAddr: "10.0.0.1:1234", forwarded: []string{"198.51.100.1"}, trusted: trusted, expected: "198.51.100.1"},
+		{remoteAddr: "[fd00::1]:1234", forwarded: []string{"2001:db8::2"}, trusted: trusted, expected: "2001:db8::2"},
+		{remoteAddr: "10.0.0.1:1234", forwarded: []string{"203.0.113.9, 198.51.100.1, 10.0.0.2"}, trusted: trusted, expected: "198.51.100.1"},
+		{remoteAddr: "10.0.0.1:1234", forwarded: []string{"203.0.113.9", "198.51.100.1, 10.0.0.2"}, trusted: trusted, expected: "198.51.100.1"},
+		{remoteAddr: "10.0.0.1:1234", forwarded: []string{"10.0.0.3, 10.0.0.2"}, trusted: trusted, expected: "10.0.0.3"},
+		{remoteAddr: "10.0.0.1:1234", trusted: trusted, expected: "10.0.0.1"},
+		{remoteAddr: "10.0.0.1:1234", forwarded: []string{"garbage, 198.51.100.1"}, trusted: trusted, expected: "198.51.100.1"},
+		{remoteAddr: "10.0.0.1:1234", forwarded: []string{"198.51.100.1, garbage"}, trusted: trusted, err: `httplimit: invalid X-Forwarded-For address "garbage"`},
+	}
+	for i, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remoteAddr
+		for _, value := range c.forwarded {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		key, err := RemoteIP(c.trusted...)(r)
+		if c.err != "" {
+			assert.EqualError(t, err, c.err, "TestRemoteIP(case:%d)", i)
+		} else {
+			assert.Nil(t, err, "TestRemoteIP(case:%d)", i)
+			assert.Equal(t, c.expected, key, "TestRemoteIP(case:%d)", i)
+		}
+	}
+}
+
+func TestHeader(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	_, err := Header("X-Api-Key")(r)
+	assert.EqualError(t, err, "httplimit: missing X-Api-Key header")
+
+	r.Header.Set("X-Api-Key", "secret")
+	key, err := Header("X-Api-Key")(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", key)
+}
+
+func TestUser(t *testing.T) {
+	type userKey struct{}
+	r := httptest.NewRequest("GET", "/", nil)
+	_, err := User(userKey{})(r)
+	assert.EqualError(t, err, "httplimit: no authenticated user")
+
+	_, err = User(userKey{})(r.WithContext(context.WithValue(r.Context(), userKey{}, "")))
+	assert.EqualError(t, err, "httplimit: no authenticated user")
+	_, err = User(userKey{})(r.WithContext(context.WithValue(r.Context(), userKey{}, 42)))
+	assert.EqualError(t, err, "httplimit: no authenticated user")
+
+	key, err := User(userKey{})(r.WithContext(context.WithValue(r.Context(), userKey{}, "@alice:example.org")))
+	assert.Nil(t, err)
+	assert.Equal(t, "@alice:example.org", key)
+}
@@ -0,0 +1,239 @@
+// Package httplimit provides net/http middleware which limits the rate of requests from each client using
+// leaky buckets, and an http.RoundTripper which throttles outgoing requests.
+package httplimit
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	leaky "github.com/t2bot/go-leaky-bucket"
+)
+
+// BucketLimiter is a leaky.Limiter which can also wait for room in the bucket for a key, and give access to
+// the bucket itself while keeping it from being evicted. It is needed for RateLimit headers and by
+// Transport, and is implemented by leaky.Registry and leaky.ShardedRegistry.
+type BucketLimiter interface {
+	leaky.Limiter
+	Wait(ctx context.Context, key string, amount int64) error
+	Use(key string, fn func(bucket *leaky.Bucket))
+}
+
+// CostFunc returns how much a request adds to its client's bucket. A cost of zero or less means the
+// request is not limited.
+type CostFunc func(r *http.Request) int64
+
+// Cost returns a CostFunc which charges the same amount for every request.
+func Cost(amount int64) CostFunc {
+	return func(r *http.Request) int64 {
+		return amount
+	}
+}
+
+// Middleware limits requests to an http.Handler, adding the cost of each request to the bucket for its
+// client. Requests which would overflow the bucket are rejected with 429 Too Many Requests.
+type Middleware struct {
+	limiter      leaky.Limiter
+	keyFunc      KeyFunc
+	costFunc     CostFunc
+	deniedFunc   func(w http.ResponseWriter, r *http.Request, retryAfter time.Duration)
+	errorHandler func(w http.ResponseWriter, r *http.Request, err error)
+	headers      bool
+}
+
+// Option configures a Middleware.
+type Option func(m *Middleware)
+
+// WithKeyFunc sets how the client of a request is identified. By default, RemoteIP is used without any
+// trusted proxies.
+func WithKeyFunc(keyFunc KeyFunc) Option {
+	return func(m *Middleware) {
+		m.keyFunc = keyFunc
+	}
+}
+
+// WithCostFunc sets how much each request costs. By default, every request costs 1.
+func WithCostFunc(costFunc CostFunc) Option {
+	return func(m *Middleware) {
+		m.costFunc = costFunc
+	}
+}
+
+// WithDeniedHandler sets the handler called when a request is rate limited. retryAfter is how long until
+// the request would be accepted, or zero if it never will be because its cost exceeds what the bucket can
+// hold. By default, DeniedHandler is used.
+func WithDeniedHandler(handler func(w http.ResponseWriter, r *http.Request, retryAfter time.Duration)) Option {
+	return func(m *Middleware) {
+		m.deniedFunc = handler
+	}
+}
+
+// WithErrorHandler sets the handler called when the key function or limiter returns an error. Errors from
+// the key function are wrapped in a *KeyError. By default, a 400 Bad Request response is written for key
+// errors, and 500 Internal Server Error for limiter errors.
+func WithErrorHandler(handler func(w http.ResponseWriter, r *http.Request, err error)) Option {
+	return func(m *Middleware) {
+		m.errorHandler = handler
+	}
+}
+
+// WithRateLimitHeaders enables the RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, and
+// RateLimit-Policy headers on limited responses, including rejected ones. The limiter must be a
+// BucketLimiter.
+func WithRateLimitHeaders() Option {
+	return func(m *Middleware) {
+		m.headers = true
+	}
+}
+
+// KeyError wraps an error returned by a KeyFunc, so that error handlers can tell it apart from limiter
+// errors.
+type KeyError struct {
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// NewMiddleware creates a new Middleware which adds to buckets from the given limiter.
+//
+// Example usage:
+//
+//	registry, err := leaky.NewRegistry(leaky.Config{
+//		DrainBy:       5,
+//		DrainInterval: time.Second,
+//		Capacity:      100,
+//	}, time.Hour)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	middleware, err := httplimit.NewMiddleware(registry,
+//		httplimit.WithKeyFunc(httplimit.RemoteIP(netip.MustParsePrefix("10.0.0.0/8"))))
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	http.ListenAndServe(":8080", middleware.Handler(mux))
+//
+// Parameters:
+//
+//	limiter - the limiter holding each client's bucket
+//	opts    - the options to apply to the middleware
+//
+// Return values:
+//
+//	*Middleware - the created Middleware instance
+//	error       - error message if the limiter or options are invalid
+func NewMiddleware(limiter leaky.Limiter, opts ...Option) (*Middleware, error) {
+	if limiter == nil {
+		return nil, errors.New("httplimit: limiter cannot be nil")
+	}
+	m := &Middleware{
+		limiter:      limiter,
+		keyFunc:      RemoteIP(),
+		costFunc:     Cost(1),
+		deniedFunc:   DeniedHandler,
+		errorHandler: defaultErrorHandler,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.keyFunc == nil {
+		return nil, errors.New("httplimit: key function cannot be nil")
+	}
+	if m.costFunc == nil {
+		return nil, errors.New("httplimit: cost function cannot be nil")
+	}
+	if m.deniedFunc == nil {
+		return nil, errors.New("httplimit: denied handler cannot be nil")
+	}
+	if m.errorHandler == nil {
+		return nil, errors.New("httplimit: error handler cannot be nil")
+	}
+	if _, ok := limiter.(BucketLimiter); m.headers && !ok {
+		return nil, errors.New("httplimit: limiter must implement BucketLimiter for RateLimit headers")
+	}
+	return m, nil
+}
+
+// Handler returns an http.Handler which limits requests before passing them to next.
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cost := m.costFunc(r)
+		if cost <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key, err := m.keyFunc(r)
+		if err != nil {
+			m.errorHandler(w, r, &KeyError{Err: err})
+			return
+		}
+
+		err = m.limiter.Add(key, cost)
+		retryAfter, denied := RetryAfter(err)
+		if err != nil && !denied {
+			m.errorHandler(w, r, err)
+			return
+		}
+		if m.headers {
+			m.limiter.(BucketLimiter).Use(key, func(bucket *leaky.Bucket) {
+				BucketRateLimit(bucket).SetHeaders(w.Header())
+			})
+		}
+		if denied {
+			m.deniedFunc(w, r, retryAfter)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RetryAfter returns how long until a request rejected with the given error would be accepted. If the
+// error is not leaky.ErrBucketFull, false is returned. If the request will never be accepted, zero is
+// returned.
+func RetryAfter(err error) (time.Duration, bool) {
+	var fullErr *leaky.BucketFullError
+	if errors.As(err, &fullErr) {
+		return max(fullErr.RetryAfter, time.Nanosecond), true
+	}
+	if errors.Is(err, leaky.ErrBucketFull) {
+		return 0, true
+	}
+	return 0, false
+}
+
+// RetryAfterSeconds returns the value of a Retry-After header for the given delay: the delay in whole
+// seconds, rounded up so that clients never retry too early, and at least 1.
+func RetryAfterSeconds(retryAfter time.Duration) string {
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	return strconv.FormatInt(max(seconds, 1), 10)
+}
+
+// DeniedHandler writes a 429 Too Many Requests response. If retryAfter is positive, a Retry-After header
+// is included.
+func DeniedHandler(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", RetryAfterSeconds(retryAfter))
+	}
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
+
+// defaultErrorHandler writes a 400 Bad Request response for key errors, and otherwise a 500 Internal
+// Server Error response.
+func defaultErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	var keyErr *KeyError
+	if errors.As(err, &keyErr) {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
@@ -0,0 +1,179 @@
+package httplimit
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	leaky "github.com/t2bot/go-leaky-bucket"
+	"github.com/t2bot/go-leaky-bucket/internal/leakytest"
+)
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+})
+
+func serve(handler http.Handler, remoteAddr string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestNewMiddleware(t *testing.T) {
+	registry, _ := leakytest.NewRegistry(t)
+	var err error
+
+	_, err = NewMiddleware(nil)
+	assert.EqualError(t, err, "httplimit: limiter cannot be nil")
+	_, err = NewMiddleware(registry, WithKeyFunc(nil))
+	assert.EqualError(t, err, "httplimit: key function cannot be nil")
+	_, err = NewMiddleware(registry, WithCostFunc(nil))
+	assert.EqualError(t, err, "httplimit: cost function cannot be nil")
+	_, err = NewMiddleware(registry, WithDeniedHandler(nil))
+	assert.EqualError(t, err, "httplimit: denied handler cannot be nil")
+	_, err = NewMiddleware(registry, WithErrorHandler(nil))
+	assert.EqualError(t, err, "httplimit: error handler cannot be nil")
+
+	middleware, err := NewMiddleware(registry)
+	assert.Nil(t, err)
+	assert.NotNil(t, middleware)
+}
+
+func TestMiddleware_Handler(t *testing.T) {
+	registry, clock := leakytest.NewRegistry(t)
+	middleware, err := NewMiddleware(registry)
+	if err != nil {
+		t.Fatalf("TestMiddleware_Handler: unexpected error %v", err)
+	}
+	handler := middleware.Handler(okHandler)
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusNoContent, serve(handler, "192.0.2.1:1234").Code, "TestMiddleware_Handler(request:%d)", i)
+	}
+	w := serve(handler, "192.0.2.1:1234")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After")) // 1.5s, rounded up
+
+	// Other clients are unaffected
+	assert.Equal(t, http.StatusNoContent, serve(handler, "192.0.2.2:1234").Code)
+
+	// Accepted again after draining
+	clock.Advance(1500 * time.Millisecond)
+	assert.Equal(t, http.StatusNoContent, serve(handler, "192.0.2.1:1234").Code)
+	assert.Equal(t, http.StatusTooManyRequests, serve(handler, "192.0.2.1:1234").Code)
+
+	// Key errors
+	assert.Equal(t, http.StatusBadRequest, serve(handler, "invalid").Code)
+}
+
+func TestMiddleware_Cost(t *testing.T) {
+	registry, _ := leakytest.NewRegistry(t)
+	middleware, err := NewMiddleware(registry, WithCostFunc(func(r *http.Request) int64 {
+		switch r.RemoteAddr {
+		case "192.0.2.1:1234":
+			return 2
+		case "192.0.2.2:1234":
+			return 4
+		default:
+			return 0
+		}
+	}))
+	if err != nil {
+		t.Fatalf("TestMiddleware_Cost: unexpected error %v", err)
+	}
+	handler := middleware.Handler(okHandler)
+
+	assert.Equal(t, http.StatusNoContent, serve(handler, "192.0.2.1:1234").Code)
+	w := serve(handler, "192.0.2.1:1234")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+
+	// Never fits, so no Retry-After
+	w = serve(handler, "192.0.2.2:1234")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "", w.Header().Get("Retry-After"))
+
+	// Free requests skip the limiter, including key extraction
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, http.StatusNoContent, serve(handler, "invalid").Code, "TestMiddleware_Cost(request:%d)", i)
+	}
+	assert.Equal(t, 2, registry.Len())
+}
+
+func TestMiddleware_Handlers(t *testing.T) {
+	registry, _ := leakytest.NewRegistry(t)
+	var denied []time.Duration
+	var errs []error
+	options := []Option{
+		WithKeyFunc(Header("X-Api-Key")),
+		WithCostFunc(Cost(3)),
+		WithDeniedHandler(func(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+			denied = append(denied, retryAfter)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}),
+		WithErrorHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+			errs = append(errs, err)
+			w.WriteHeader(http.StatusTeapot)
+		}),
+	}
+	middleware, err := NewMiddleware(registry, options...)
+	if err != nil {
+		t.Fatalf("TestMiddleware_Handlers: unexpected error %v", err)
+	}
+	handler := middleware.Handler(okHandler)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Api-Key", "key")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, []time.Duration{4500 * time.Millisecond}, denied)
+
+	w = serve(handler, "192.0.2.1:1234")
+	assert.Equal(t, http.StatusTeapot, w.Code)
+	assert.Len(t, errs, 1)
+	var keyErr *KeyError
+	assert.ErrorAs(t, errs[0], &keyErr)
+	assert.EqualError(t, errs[0], "httplimit: missing X-Api-Key header")
+
+	// Limiter errors aren't key errors
+	middleware, err = NewMiddleware(leakytest.ErrorLimiter{})
+	assert.Nil(t, err)
+	w = serve(middleware.Handler(okHandler), "192.0.2.1:1234")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestRetryAfter(t *testing.T) {
+	retryAfter, ok := RetryAfter(&leaky.BucketFullError{RetryAfter: time.Second})
+	assert.True(t, ok)
+	assert.Equal(t, time.Second, retryAfter)
+
+	retryAfter, ok = RetryAfter(&leaky.BucketFullError{RetryAfter: 0})
+	assert.True(t, ok)
+	assert.Equal(t, time.Nanosecond, retryAfter)
+
+	retryAfter, ok = RetryAfter(leaky.ErrBucketFull)
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), retryAfter)
+
+	_, ok = RetryAfter(errors.New("other"))
+	assert.False(t, ok)
+	_, ok = RetryAfter(nil)
+	assert.False(t, ok)
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	assert.Equal(t, "1", RetryAfterSeconds(0))
+	assert.Equal(t, "1", RetryAfterSeconds(time.Nanosecond))
+	assert.Equal(t, "1", RetryAfterSeconds(time.Second))
+	assert.Equal(t, "2", RetryAfterSeconds(time.Second+time.Nanosecond))
+	assert.Equal(t, "60", RetryAfterSeconds(time.Minute))
+}
@@ -0,0 +1,97 @@
+package httplimit
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	leaky "github.com/t2bot/go-leaky-bucket"
+)
+
+// RateLimit holds the values of the RateLimit response header fields for a bucket, as described by the
+// IETF draft "RateLimit header fields for HTTP" (draft-ietf-httpapi-ratelimit-headers). Clients can use
+// them to throttle themselves before being rejected.
+//
+// A leaky bucket does not reset all at once, so Reset is the time until the bucket has fully drained and
+// the whole Limit is available again.
+type RateLimit struct {
+	// Limit is the bucket's Capacity.
+	Limit int64
+
+	// Remaining is how much more can be added to the bucket now. It is never negative, even when the
+	// bucket has overflowed.
+	Remaining int64
+
+	// Reset is how long until the bucket has fully drained.
+	Reset time.Duration
+
+	// Window is how long a full bucket takes to drain, which is the time window over which the policy
+	// allows Limit.
+	Window time.Duration
+}
+
+// NewRateLimit returns the RateLimit values for the given snapshot of a bucket, at the given time.
+//
+// Example usage:
+//
+//	rateLimit := httplimit.NewRateLimit(bucket.Snapshot(), time.Now())
+//	rateLimit.SetHeaders(w.Header())
+//
+// Parameters:
+//
+//	snapshot    - the bucket's parameters and state
+//	now         - the current time
+//
+// Return values:
+//
+//	RateLimit   - the header values
+func NewRateLimit(snapshot leaky.Snapshot, now time.Time) RateLimit {
+	return RateLimit{
+		Limit:     snapshot.Config.Capacity,
+		Remaining: max(0, snapshot.Remaining(now)),
+		Reset:     snapshot.TimeToEmpty(now),
+		Window:    window(snapshot.Config),
+	}
+}
+
+// BucketRateLimit returns the RateLimit values for the given bucket, using the bucket's clock.
+func BucketRateLimit(bucket *leaky.Bucket) RateLimit {
+	config := bucket.Config()
+	return RateLimit{
+		Limit:     config.Capacity,
+		Remaining: max(0, bucket.Remaining()),
+		Reset:     bucket.TimeToEmpty(),
+		Window:    window(config),
+	}
+}
+
+// window returns how long a full bucket with the given config takes to drain.
+func window(config leaky.Config) time.Duration {
+	start := time.Unix(0, 0) // any time will do
+	return leaky.Snapshot{
+		Config:    config,
+		Value:     config.Capacity,
+		LastDrain: start,
+	}.TimeToEmpty(start)
+}
+
+// seconds returns the duration in whole seconds, rounded up.
+func seconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
+
+// Policy returns the value of the RateLimit-Policy header, such as "300;w=3600" for a bucket which holds
+// 300 and takes an hour to drain when full.
+func (l RateLimit) Policy() string {
+	return strconv.FormatInt(l.Limit, 10) + ";w=" + strconv.FormatInt(max(seconds(l.Window), 1), 10)
+}
+
+// SetHeaders sets the RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, and RateLimit-Policy headers.
+// RateLimit-Reset is in whole seconds, rounded up.
+func (l RateLimit) SetHeaders(h http.Header) {
+	h.Set("RateLimit-Limit", strconv.FormatInt(l.Limit, 10))
+	h.Set("RateLimit-Remaining", strconv.FormatInt(l.Remaining, 10))
+	h.Set("RateLimit-Reset", strconv.FormatInt(seconds(l.Reset), 10))
+	h.Set("RateLimit-Policy", l.Policy())
+}
@@ -0,0 +1,104 @@
+package httplimit
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	leaky "github.com/t2bot/go-leaky-bucket"
+	"github.com/t2bot/go-leaky-bucket/internal/leakytest"
+)
+
+func TestNewRateLimit(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	config := leaky.Config{
+		DrainBy:       5,
+		DrainInterval: time.Minute,
+		Capacity:      300,
+		OverflowLimit: 10,
+	}
+
+	// Empty
+	rateLimit := NewRateLimit(leaky.Snapshot{Config: config}, now)
+	assert.Equal(t, RateLimit{Limit: 300, Remaining: 300, Reset: 0, Window: time.Hour}, rateLimit)
+
+	// Partially full, drained since
+	rateLimit = NewRateLimit(leaky.Snapshot{Config: config, Value: 12, LastDrain: now.Add(-90 * time.Second)}, now)
+	assert.Equal(t, RateLimit{Limit: 300, Remaining: 293, Reset: 90 * time.Second, Window: time.Hour}, rateLimit)
+
+	// Overflowed
+	rateLimit = NewRateLimit(leaky.Snapshot{Config: config, Value: 310, LastDrain: now}, now)
+	assert.Equal(t, RateLimit{Limit: 300, Remaining: 0, Reset: 62 * time.Minute, Window: time.Hour}, rateLimit)
+
+	// Continuous
+	config.Mode = leaky.DrainContinuous
+	config.Capacity = 7
+	rateLimit = NewRateLimit(leaky.Snapshot{Config: config, Value: 2, LastDrain: now}, now)
+	assert.Equal(t, RateLimit{Limit: 7, Remaining: 5, Reset: 24 * time.Second, Window: 84 * time.Second}, rateLimit)
+}
+
+func TestBucketRateLimit(t *testing.T) {
+	clock := leaky.NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	bucket, err := leaky.NewBucketFromConfig(leakytest.Config, leaky.WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestBucketRateLimit: unexpected error %v", err)
+	}
+	assert.Nil(t, bucket.Add(2))
+	clock.Advance(time.Second)
+
+	assert.Equal(t, RateLimit{Limit: 3, Remaining: 1, Reset: 2 * time.Second, Window: 4500 * time.Millisecond}, BucketRateLimit(bucket))
+}
+
+func TestRateLimit_SetHeaders(t *testing.T) {
+	rateLimit := RateLimit{Limit: 3, Remaining: 1, Reset: 2500 * time.Millisecond, Window: 4500 * time.Millisecond}
+	assert.Equal(t, "3;w=5", rateLimit.Policy())
+	assert.Equal(t, "3;w=1", RateLimit{Limit: 3}.Policy())
+
+	h := http.Header{}
+	rateLimit.SetHeaders(h)
+	assert.Equal(t, http.Header{
+		"Ratelimit-Limit":     {"3"},
+		"Ratelimit-Remaining": {"1"},
+		"Ratelimit-Reset":     {"3"},
+		"Ratelimit-Policy":    {"3;w=5"},
+	}, h)
+}
+
+func TestMiddleware_RateLimitHeaders(t *testing.T) {
+	_, err := NewMiddleware(leakytest.ErrorLimiter{}, WithRateLimitHeaders())
+	assert.EqualError(t, err, "httplimit: limiter must implement BucketLimiter for RateLimit headers")
+
+	registry, clock := leakytest.NewRegistry(t)
+	middleware, err := NewMiddleware(registry, WithRateLimitHeaders())
+	if err != nil {
+		t.Fatalf("TestMiddleware_RateLimitHeaders: unexpected error %v", err)
+	}
+	handler := middleware.Handler(okHandler)
+
+	w := serve(handler, "192.0.2.1:1234")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "3", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "3;w=5", w.Header().Get("RateLimit-Policy"))
+
+	serve(handler, "192.0.2.1:1234")
+	serve(handler, "192.0.2.1:1234")
+	w = serve(handler, "192.0.2.1:1234")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "5", w.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+
+	clock.Advance(time.Second)
+	w = serve(handler, "192.0.2.1:1234")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "4", w.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	// Not set when the request isn't limited
+	w = serve(handler, "invalid")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "", w.Header().Get("RateLimit-Limit"))
+}
@@ -0,0 +1,212 @@
+package httplimit
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	leaky "github.com/t2bot/go-leaky-bucket"
+)
+
+// Transport is an http.RoundTripper which throttles outgoing requests, adding the cost of each request to
+// a bucket before sending it. Unlike Middleware, requests wait for the bucket to have room rather than
+// failing.
+type Transport struct {
+	base     http.RoundTripper
+	limiter  BucketLimiter
+	keyFunc  KeyFunc
+	costFunc CostFunc
+	feedback bool
+}
+
+// TransportOption configures a Transport.
+type TransportOption func(t *Transport)
+
+// WithTransportKeyFunc sets how the bucket for a request is chosen. By default, Host is used.
+func WithTransportKeyFunc(keyFunc KeyFunc) TransportOption {
+	return func(t *Transport) {
+		t.keyFunc = keyFunc
+	}
+}
+
+// WithTransportCostFunc sets how much each request costs. By default, every request costs 1.
+func WithTransportCostFunc(costFunc CostFunc) TransportOption {
+	return func(t *Transport) {
+		t.costFunc = costFunc
+	}
+}
+
+// WithResponseFeedback adjusts the bucket for a request using the rate limit headers of its response, so
+// that the bucket converges on the server's view of the limit:
+//
+//   - A Retry-After header on a 429 or 503 response stops the bucket accepting anything until then.
+//   - A RateLimit-Remaining header of zero does the same until RateLimit-Reset.
+//   - A RateLimit-Remaining header lower than the bucket's remaining capacity raises the bucket's value to
+//     match, using Bucket.Raise.
+//
+// The bucket is never lowered, so the client does not send faster than its own limit allows.
+func WithResponseFeedback() TransportOption {
+	return func(t *Transport) {
+		t.feedback = true
+	}
+}
+
+// Host returns a KeyFunc which uses the host, and port if any, of the request's URL. It is intended for
+// outgoing requests.
+func Host() KeyFunc {
+	return func(r *http.Request) (string, error) {
+		if r.URL == nil || r.URL.Host == "" {
+			return "", errors.New("httplimit: request has no host")
+		}
+		return r.URL.Host, nil
+	}
+}
+
+// NewTransport creates a new Transport which sends requests with base once the bucket from the given
+// limiter has room. If base is nil, http.DefaultTransport is used.
+//
+// Example usage:
+//
+//	registry, err := leaky.NewRegistry(leaky.Config{
+//		DrainBy:       10,
+//		DrainInterval: time.Second,
+//		Capacity:      10,
+//	}, time.Hour)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	transport, err := httplimit.NewTransport(nil, registry, httplimit.WithResponseFeedback())
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	client := &http.Client{Transport: transport}
+//
+// Parameters:
+//
+//	base    - the transport to send requests with
+//	limiter - the limiter holding the bucket for each key
+//	opts    - the options to apply to the transport
+//
+// Return values:
+//
+//	*Transport  - the created Transport instance
+//	error       - error message if the limiter or options are invalid
+func NewTransport(base http.RoundTripper, limiter BucketLimiter, opts ...TransportOption) (*Transport, error) {
+	if limiter == nil {
+		return nil, errors.New("httplimit: limiter cannot be nil")
+	}
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t := &Transport{
+		base:     base,
+		limiter:  limiter,
+		keyFunc:  Host(),
+		costFunc: Cost(1),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	if t.keyFunc == nil {
+		return nil, errors.New("httplimit: key function cannot be nil")
+	}
+	if t.costFunc == nil {
+		return nil, errors.New("httplimit: cost function cannot be nil")
+	}
+	return t, nil
+}
+
+// RoundTrip implements http.RoundTripper. It waits until the request's bucket has room, or the request's
+// context is done, before sending the request. If the request's cost can never fit in the bucket,
+// leaky.ErrAmountTooLarge is returned.
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	cost := t.costFunc(r)
+	if cost <= 0 {
+		return t.base.RoundTrip(r)
+	}
+
+	key, err := t.keyFunc(r)
+	if err != nil {
+		closeBody(r)
+		return nil, err
+	}
+	if err = t.limiter.Wait(r.Context(), key, cost); err != nil {
+		closeBody(r)
+		return nil, err
+	}
+
+	resp, err := t.base.RoundTrip(r)
+	if err == nil && t.feedback {
+		t.limiter.Use(key, func(bucket *leaky.Bucket) {
+			applyFeedback(bucket, resp)
+		})
+	}
+	return resp, err
+}
+
+// closeBody closes the request's body, which a RoundTripper must do even when returning an error.
+func closeBody(r *http.Request) {
+	if r.Body != nil {
+		_ = r.Body.Close()
+	}
+}
+
+// applyFeedback adjusts the bucket using the response's rate limit headers.
+func applyFeedback(bucket *leaky.Bucket, resp *http.Response) {
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if retryAfter, ok := parseRetryAfter(resp.Header); ok {
+			bucket.Backoff(retryAfter)
+		}
+	}
+
+	remaining, err := strconv.ParseInt(resp.Header.Get("RateLimit-Remaining"), 10, 64)
+	if err != nil || remaining < 0 {
+		return
+	}
+	if remaining == 0 {
+		if reset, err := strconv.ParseInt(resp.Header.Get("RateLimit-Reset"), 10, 64); err == nil && reset > 0 {
+			bucket.Backoff(secondsDuration(reset))
+		}
+		return
+	}
+	if capacity := bucket.Config().Capacity; remaining < capacity {
+		bucket.Raise(capacity - remaining)
+	}
+}
+
+// secondsDuration returns the given number of seconds as a duration, saturating instead of overflowing.
+func secondsDuration(seconds int64) time.Duration {
+	if seconds > math.MaxInt64/int64(time.Second) {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// parseRetryAfter returns the delay in a Retry-After header, which is either a number of seconds or an
+// HTTP date. Dates are compared against the response's Date header, if present, to avoid clock skew.
+func parseRetryAfter(header http.Header) (time.Duration, bool) {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds <= 0 {
+			return 0, false
+		}
+		return secondsDuration(seconds), true
+	}
+	at, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	now := time.Now()
+	if date, err := http.ParseTime(header.Get("Date")); err == nil {
+		now = date
+	}
+	if delay := at.Sub(now); delay > 0 {
+		return delay, true
+	}
+	return 0, false
+}
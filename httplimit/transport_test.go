@@ -0,0 +1,247 @@
+package httplimit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	leaky "github.com/t2bot/go-leaky-bucket"
+	"github.com/t2bot/go-leaky-bucket/internal/leakytest"
+)
+
+// roundTripFunc is an http.RoundTripper which calls itself.
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// trackingBody records whether it was closed.
+type trackingBody struct {
+	io.Reader
+	closed bool
+}
+
+func (b *trackingBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func newResponseTransport(header http.Header, status int) (http.RoundTripper, *atomic.Int32) {
+	sent := &atomic.Int32{}
+	return roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		sent.Add(1)
+		return &http.Response{
+			StatusCode: status,
+			Header:     header.Clone(),
+			Body:       http.NoBody,
+			Request:    r,
+		}, nil
+	}), sent
+}
+
+func TestNewTransport(t *testing.T) {
+	registry, _ := leakytest.NewRegistry(t)
+	var err error
+
+	_, err = NewTransport(nil, nil)
+	assert.EqualError(t, err, "httplimit: limiter cannot be nil")
+	_, err = NewTransport(nil, registry, WithTransportKeyFunc(nil))
+	assert.EqualError(t, err, "httplimit: key function cannot be nil")
+	_, err = NewTransport(nil, registry, WithTransportCostFunc(nil))
+	assert.EqualError(t, err, "httplimit: cost function cannot be nil")
+
+	transport, err := NewTransport(nil, registry)
+	assert.Nil(t, err)
+	assert.Equal(t, http.DefaultTransport, transport.base)
+}
+
+func TestHost(t *testing.T) {
+	key, err := Host()(httptest.NewRequest("GET", "https://example.org:8448/path", nil))
+	assert.Nil(t, err)
+	assert.Equal(t, "example.org:8448", key)
+
+	_, err = Host()(&http.Request{})
+	assert.EqualError(t, err, "httplimit: request has no host")
+}
+
+func TestTransport_RoundTrip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	registry, clock := leakytest.NewRegistry(t)
+	transport, err := NewTransport(nil, registry)
+	if err != nil {
+		t.Fatalf("TestTransport_RoundTrip: unexpected error %v", err)
+	}
+	client := &http.Client{Transport: transport}
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(server.URL)
+		assert.Nil(t, err, "TestTransport_RoundTrip(request:%d)", i)
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode, "TestTransport_RoundTrip(request:%d)", i)
+		_ = resp.Body.Close()
+	}
+	assert.Equal(t, int64(3), registry.Value(strings.TrimPrefix(server.URL, "http://")))
+
+	// Waits for the bucket to drain
+	done := make(chan error)
+	go func() {
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		done <- err
+	}()
+	leakytest.WaitForTimers(t, clock, 1)
+	select {
+	case <-done:
+		t.Fatal("TestTransport_RoundTrip: returned before drain")
+	default:
+	}
+	clock.Advance(1500 * time.Millisecond)
+	select {
+	case err = <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("TestTransport_RoundTrip: did not return after drain")
+	}
+
+	// Cancelling the request stops the wait
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	assert.Nil(t, err)
+	go func() {
+		_, err := client.Do(req)
+		done <- err
+	}()
+	leakytest.WaitForTimers(t, clock, 1)
+	cancel()
+	select {
+	case err = <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("TestTransport_RoundTrip: did not return after cancel")
+	}
+}
+
+func TestTransport_Cost(t *testing.T) {
+	base, sent := newResponseTransport(http.Header{}, http.StatusOK)
+	registry, _ := leakytest.NewRegistry(t)
+	transport, err := NewTransport(base, registry,
+		WithTransportKeyFunc(Header("X-Account")),
+		WithTransportCostFunc(func(r *http.Request) int64 {
+			if r.Method == "GET" {
+				return 0
+			}
+			return 4
+		}))
+	if err != nil {
+		t.Fatalf("TestTransport_Cost: unexpected error %v", err)
+	}
+
+	// Free requests skip the limiter
+	_, err = transport.RoundTrip(httptest.NewRequest("GET", "http://example.org", nil))
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), sent.Load())
+
+	// Requests which can never fit fail, closing the body
+	body := &trackingBody{Reader: strings.NewReader("data")}
+	req := httptest.NewRequest("POST", "http://example.org", body)
+	req.Header.Set("X-Account", "a")
+	_, err = transport.RoundTrip(req)
+	assert.ErrorIs(t, err, leaky.ErrAmountTooLarge)
+	assert.True(t, body.closed)
+	assert.Equal(t, int32(1), sent.Load())
+
+	// As do key errors
+	body = &trackingBody{Reader: strings.NewReader("data")}
+	_, err = transport.RoundTrip(httptest.NewRequest("POST", "http://example.org", body))
+	assert.EqualError(t, err, "httplimit: missing X-Account header")
+	assert.True(t, body.closed)
+}
+
+func TestTransport_Feedback(t *testing.T) {
+	cases := []struct {
+		status   int
+		header   http.Header
+		feedback bool
+		value    int64
+		delay    time.Duration
+	}{
+		// No feedback unless enabled
+		{status: http.StatusTooManyRequests, header: http.Header{"Retry-After": {"5"}}, value: 1},
+
+		// Retry-After
+		{status: http.StatusTooManyRequests, header: http.Header{"Retry-After": {"5"}}, feedback: true, value: 6, delay: 6 * time.Second},
+		{status: http.StatusServiceUnavailable, header: http.Header{"Retry-After": {"5"}}, feedback: true, value: 6, delay: 6 * time.Second},
+		{status: http.StatusOK, header: http.Header{"Retry-After": {"5"}}, feedback: true, value: 1},
+		{status: http.StatusTooManyRequests, header: http.Header{"Retry-After": {"0"}}, feedback: true, value: 1},
+		{status: http.StatusTooManyRequests, header: http.Header{"Retry-After": {"soon"}}, feedback: true, value: 1},
+		{
+			status: http.StatusTooManyRequests,
+			header: http.Header{
+				"Retry-After": {"Mon, 01 Jan 2024 00:00:03 GMT"},
+				"Date":        {"Mon, 01 Jan 2024 00:00:00 GMT"},
+			},
+			feedback: true,
+			value:    4,
+			delay:    3 * time.Second,
+		},
+		{
+			status: http.StatusTooManyRequests,
+			header: http.Header{
+				"Retry-After": {"Mon, 01 Jan 2024 00:00:00 GMT"},
+				"Date":        {"Mon, 01 Jan 2024 00:00:03 GMT"},
+			},
+			feedback: true,
+			value:    1,
+		},
+
+		// RateLimit headers
+		{status: http.StatusOK, header: http.Header{"Ratelimit-Remaining": {"1"}}, feedback: true, value: 2},
+		{status: http.StatusOK, header: http.Header{"Ratelimit-Remaining": {"2"}}, feedback: true, value: 1},
+		{status: http.StatusOK, header: http.Header{"Ratelimit-Remaining": {"50"}}, feedback: true, value: 1},
+		{status: http.StatusOK, header: http.Header{"Ratelimit-Remaining": {"-1"}}, feedback: true, value: 1},
+		{status: http.StatusOK, header: http.Header{"Ratelimit-Remaining": {"0"}, "Ratelimit-Reset": {"4"}}, feedback: true, value: 5, delay: 4500 * time.Millisecond},
+		{status: http.StatusOK, header: http.Header{"Ratelimit-Remaining": {"0"}}, feedback: true, value: 1},
+	}
+	for i, c := range cases {
+		base, _ := newResponseTransport(c.header, c.status)
+		registry, clock := leakytest.NewRegistry(t)
+		var opts []TransportOption
+		if c.feedback {
+			opts = append(opts, WithResponseFeedback())
+		}
+		transport, err := NewTransport(base, registry, opts...)
+		if err != nil {
+			t.Fatalf("TestTransport_Feedback(case:%d): unexpected error %v", i, err)
+		}
+		if c.header.Get("Date") != "" {
+			clock.Set(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)) // the bucket's clock is irrelevant
+		}
+
+		_, err = transport.RoundTrip(httptest.NewRequest("GET", "http://example.org", nil))
+		assert.Nil(t, err, "TestTransport_Feedback(case:%d)", i)
+		bucket := registry.Get("example.org")
+		assert.Equal(t, c.value, bucket.Peek(), "TestTransport_Feedback(case:%d)", i)
+		err = bucket.Add(1)
+		if c.delay == 0 {
+			assert.Nil(t, err, "TestTransport_Feedback(case:%d)", i)
+		} else {
+			var fullErr *leaky.BucketFullError
+			if assert.True(t, errors.As(err, &fullErr), "TestTransport_Feedback(case:%d)", i) {
+				assert.Equal(t, c.delay, fullErr.RetryAfter, "TestTransport_Feedback(case:%d)", i)
+			}
+		}
+	}
+}
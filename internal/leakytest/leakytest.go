@@ -0,0 +1,53 @@
+// Package leakytest provides fixtures shared by the tests of this module's subpackages.
+package leakytest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	leaky "github.com/t2bot/go-leaky-bucket"
+)
+
+// Config is a small bucket config which fills after a few requests and drains one unit every 1.5 seconds,
+// so that tests can exercise full buckets and partial intervals with a ManualClock.
+var Config = leaky.Config{
+	DrainBy:       1,
+	DrainInterval: 1500 * time.Millisecond,
+	Capacity:      3,
+}
+
+// NewRegistry creates a Registry using Config and a ManualClock, which is returned so the test can
+// advance it.
+func NewRegistry(t *testing.T) (*leaky.Registry, *leaky.ManualClock) {
+	clock := leaky.NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	registry, err := leaky.NewRegistry(Config, time.Hour, leaky.WithClock(clock))
+	if err != nil {
+		t.Fatalf("NewRegistry: unexpected error %v", err)
+	}
+	return registry, clock
+}
+
+// ErrLimiter is the error returned by ErrorLimiter.
+var ErrLimiter = errors.New("limiter error")
+
+// ErrorLimiter is a leaky.Limiter which always fails with ErrLimiter, for testing how errors other than a
+// full bucket are handled.
+type ErrorLimiter struct{}
+
+// Add returns ErrLimiter.
+func (ErrorLimiter) Add(key string, amount int64) error {
+	return ErrLimiter
+}
+
+// WaitForTimers waits until the clock has the given number of pending timers, failing the test if that
+// takes more than a second. This allows a test to advance the clock only once a goroutine is blocked on it.
+func WaitForTimers(t *testing.T, clock *leaky.ManualClock, count int) {
+	deadline := time.Now().Add(time.Second)
+	for clock.Timers() < count {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d timers", count)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
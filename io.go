@@ -0,0 +1,147 @@
+package leaky
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// Reader is an io.Reader which adds each byte read to a Bucket, limiting the rate at which data is read.
+type Reader struct {
+	ctx    context.Context
+	r      io.Reader
+	bucket *Bucket
+}
+
+// Writer is an io.Writer which adds each byte written to a Bucket, limiting the rate at which data is
+// written.
+type Writer struct {
+	ctx    context.Context
+	w      io.Writer
+	bucket *Bucket
+}
+
+// NewReader returns a Reader which reads from r, adding each byte read to the bucket. Reads block until
+// the bucket has room for the bytes read. See NewReaderContext.
+func NewReader(r io.Reader, bucket *Bucket) *Reader {
+	return NewReaderContext(context.Background(), r, bucket)
+}
+
+// NewReaderContext returns a Reader which reads from r, adding each byte read to the bucket. After each
+// read, the Reader waits for the bucket to have room for the bytes which were read before returning them,
+// so reading at the end of the data never blocks. Reads are limited to the bucket's Capacity, so a large
+// buffer is filled over several calls to Read.
+//
+// If the context is cancelled while waiting, Read returns the bytes read along with the context's error.
+// Those bytes are not added to the bucket.
+//
+// Example usage:
+//
+//	// 1 MiB per second, in bursts of up to 64 KiB
+//	bucket, err := leaky.NewBucket(1024*1024/16, time.Second/16, 64*1024)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	_, err = io.Copy(dst, leaky.NewReaderContext(ctx, src, bucket))
+//
+// Parameters:
+//
+//	ctx     - the context which may cancel reads
+//	r       - the reader to read from
+//	bucket  - the bucket to add bytes to
+//
+// Return values:
+//
+//	*Reader - the created Reader instance
+func NewReaderContext(ctx context.Context, r io.Reader, bucket *Bucket) *Reader {
+	return &Reader{
+		ctx:    ctx,
+		r:      r,
+		bucket: bucket,
+	}
+}
+
+// NewWriter returns a Writer which writes to w, adding each byte written to the bucket. Writes block
+// until the bucket has room. See NewWriterContext.
+func NewWriter(w io.Writer, bucket *Bucket) *Writer {
+	return NewWriterContext(context.Background(), w, bucket)
+}
+
+// NewWriterContext returns a Writer which writes to w, adding each byte written to the bucket. Writes are
+// split into chunks no larger than the bucket's Capacity, and the Writer waits for the bucket to have
+// room for each chunk before writing it. If fewer bytes are written than requested, the difference is
+// drained from the bucket again.
+//
+// If the context is cancelled while waiting, Write returns the number of bytes written so far and the
+// context's error.
+//
+// Parameters:
+//
+//	ctx     - the context which may cancel writes
+//	w       - the writer to write to
+//	bucket  - the bucket to add bytes to
+//
+// Return values:
+//
+//	*Writer - the created Writer instance
+func NewWriterContext(ctx context.Context, w io.Writer, bucket *Bucket) *Writer {
+	return &Writer{
+		ctx:    ctx,
+		w:      w,
+		bucket: bucket,
+	}
+}
+
+// chunkSize returns the largest number of bytes, up to n, which can be added to the bucket at once.
+func chunkSize(bucket *Bucket, n int) (int, error) {
+	capacity := bucket.Config().Capacity
+	if capacity <= 0 {
+		return 0, errors.New("leaky: bucket can never fill")
+	}
+	return int(min(int64(n), capacity)), nil
+}
+
+// Read reads up to len(p) bytes, or the bucket's Capacity if smaller, then waits for the bucket to have
+// room for the bytes read.
+func (r *Reader) Read(p []byte) (int, error) {
+	size, err := chunkSize(r.bucket, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := r.r.Read(p[:size])
+	if n > 0 {
+		if waitErr := r.bucket.Wait(r.ctx, int64(n)); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// Write writes p in chunks no larger than the bucket's Capacity, waiting for the bucket to have room for
+// each chunk.
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		size, err := chunkSize(w.bucket, len(p)-written)
+		if err != nil {
+			return written, err
+		}
+		if err = w.bucket.Wait(w.ctx, int64(size)); err != nil {
+			return written, err
+		}
+
+		n, err := w.w.Write(p[written : written+size])
+		if n < size {
+			_ = w.bucket.Drain(int64(size - n)) // draining can't fail
+		}
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n < size {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,194 @@
+package leaky
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// shortWriter writes at most limit bytes per call, optionally failing.
+type shortWriter struct {
+	bytes.Buffer
+	limit int
+	err   error
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	n, _ := w.Buffer.Write(p[:min(len(p), w.limit)])
+	return n, w.err
+}
+
+func newIOTestBucket(t *testing.T) (*Bucket, *ManualClock) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	bucket, err := NewBucketFromConfig(Config{
+		DrainBy:       10,
+		DrainInterval: time.Second,
+		Capacity:      10,
+	}, WithClock(clock))
+	if err != nil {
+		t.Fatalf("newIOTestBucket: unexpected error %v", err)
+	}
+	return bucket, clock
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+func TestReader(t *testing.T) {
+	bucket, clock := newIOTestBucket(t)
+	reader := NewReader(strings.NewReader(strings.Repeat("a", 25)), bucket)
+	buf := make([]byte, 100)
+
+	// Limited to the capacity
+	n, err := reader.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, int64(10), bucket.Peek())
+
+	// Empty reads don't wait
+	n, err = reader.Read(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	// Blocks until drained
+	done := make(chan readResult)
+	go func() {
+		n, err := reader.Read(buf)
+		done <- readResult{n, err}
+	}()
+	waitForTimers(t, clock, 1)
+	clock.Advance(time.Second)
+	select {
+	case result := <-done:
+		assert.Nil(t, result.err)
+		assert.Equal(t, 10, result.n)
+	case <-time.After(time.Second):
+		t.Fatal("TestReader: did not return after drain")
+	}
+
+	// Only the bytes read are added
+	clock.Advance(time.Second)
+	n, err = reader.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, int64(5), bucket.Peek())
+
+	// Reaching the end doesn't wait
+	n, err = reader.Read(buf)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, int64(5), bucket.Peek())
+}
+
+func TestReader_Context(t *testing.T) {
+	bucket, clock := newIOTestBucket(t)
+	assert.Nil(t, bucket.Set(10))
+	ctx, cancel := context.WithCancel(context.Background())
+	reader := NewReaderContext(ctx, strings.NewReader("data"), bucket)
+
+	done := make(chan readResult)
+	buf := make([]byte, 4)
+	go func() {
+		n, err := reader.Read(buf)
+		done <- readResult{n, err}
+	}()
+	waitForTimers(t, clock, 1)
+	cancel()
+	select {
+	case result := <-done:
+		assert.ErrorIs(t, result.err, context.Canceled)
+		assert.Equal(t, 4, result.n)
+		assert.Equal(t, "data", string(buf))
+	case <-time.After(time.Second):
+		t.Fatal("TestReader_Context: did not return after cancel")
+	}
+	assert.Equal(t, int64(10), bucket.Peek())
+
+	// Invalid buckets
+	_, err := NewReader(strings.NewReader("data"), &Bucket{}).Read(make([]byte, 4))
+	assert.EqualError(t, err, "leaky: bucket can never fill")
+}
+
+func TestWriter(t *testing.T) {
+	bucket, clock := newIOTestBucket(t)
+	buf := &bytes.Buffer{}
+	writer := NewWriter(buf, bucket)
+
+	// Split into chunks, waiting for each
+	done := make(chan readResult)
+	go func() {
+		n, err := writer.Write([]byte(strings.Repeat("a", 25)))
+		done <- readResult{n, err}
+	}()
+	for i := 0; i < 2; i++ {
+		waitForTimers(t, clock, 1)
+		clock.Advance(time.Second)
+	}
+	select {
+	case result := <-done:
+		assert.Nil(t, result.err)
+		assert.Equal(t, 25, result.n)
+	case <-time.After(time.Second):
+		t.Fatal("TestWriter: did not return after drain")
+	}
+	assert.Equal(t, strings.Repeat("a", 25), buf.String())
+	assert.Equal(t, int64(5), bucket.Peek())
+
+	// Empty writes don't wait
+	n, err := writer.Write(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestWriter_Short(t *testing.T) {
+	bucket, _ := newIOTestBucket(t)
+	w := &shortWriter{limit: 3}
+
+	n, err := NewWriter(w, bucket).Write([]byte("data"))
+	assert.Equal(t, io.ErrShortWrite, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, int64(3), bucket.Peek())
+
+	writeErr := errors.New("write error")
+	w.err = writeErr
+	n, err = NewWriter(w, bucket).Write([]byte("data"))
+	assert.Equal(t, writeErr, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, int64(6), bucket.Peek())
+	assert.Equal(t, "datdat", w.String())
+}
+
+func TestWriter_Context(t *testing.T) {
+	bucket, clock := newIOTestBucket(t)
+	buf := &bytes.Buffer{}
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := NewWriterContext(ctx, buf, bucket)
+
+	done := make(chan readResult)
+	go func() {
+		n, err := writer.Write([]byte(strings.Repeat("a", 15)))
+		done <- readResult{n, err}
+	}()
+	waitForTimers(t, clock, 1)
+	cancel()
+	select {
+	case result := <-done:
+		assert.ErrorIs(t, result.err, context.Canceled)
+		assert.Equal(t, 10, result.n)
+	case <-time.After(time.Second):
+		t.Fatal("TestWriter_Context: did not return after cancel")
+	}
+	assert.Equal(t, strings.Repeat("a", 10), buf.String())
+
+	// Invalid buckets
+	_, err := NewWriter(buf, &Bucket{}).Write([]byte("data"))
+	assert.EqualError(t, err, "leaky: bucket can never fill")
+}
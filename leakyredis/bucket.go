@@ -0,0 +1,334 @@
+// Package leakyredis provides a leaky bucket whose state is held in Redis, allowing many processes to share
+// a single limit.
+package leakyredis
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	leaky "github.com/t2bot/go-leaky-bucket"
+)
+
+// addScript drains the bucket stored in KEYS[1] and then adds to it, using the same algorithm as
+// leaky.Bucket.Add. Times are in microseconds, as Lua numbers are doubles and cannot hold nanosecond
+// timestamps exactly.
+//
+// ARGV: now, drain by, drain interval, capacity, overflow limit, mode (1 = continuous), amount.
+//
+// The bucket is stored as a hash of its value and last drain time, and expires once it would have fully
+// drained. An empty bucket is equivalent to a missing one, so it is deleted instead.
+//
+// Returns the new value, and -1 if the amount was added, -2 if it can never fit, or how long until it
+// would fit in microseconds.
+var addScript = redis.NewScript(`
+local key = KEYS[1]
+local now = tonumber(ARGV[1])
+local drain_by = tonumber(ARGV[2])
+local interval = tonumber(ARGV[3])
+local capacity = tonumber(ARGV[4])
+local overflow = tonumber(ARGV[5])
+local continuous = ARGV[6] == "1"
+local amount = tonumber(ARGV[7])
+
+local state = redis.call("HMGET", key, "value", "last_drain")
+local value = tonumber(state[1]) or 0
+local last = tonumber(state[2]) or now
+
+-- Drain
+if value <= 0 then
+	value = 0
+	last = now
+else
+	local since = now - last
+	if since > 0 then
+		local drained
+		local drain_time
+		if continuous then
+			drained = math.floor(since * drain_by / interval)
+			if drained >= value then
+				drained = value
+				drain_time = since
+			else
+				drain_time = math.ceil(drained * interval / drain_by)
+			end
+		else
+			local leaks = math.floor(since / interval)
+			drained = leaks * drain_by
+			drain_time = leaks * interval
+		end
+		value = math.max(0, value - drained)
+		last = last + drain_time
+	end
+end
+
+-- Add
+local new_value = math.max(0, value + amount)
+local retry = -1
+if amount > 0 and (value > capacity or new_value > capacity + overflow) then
+	local target = math.min(capacity, capacity + overflow - amount)
+	if target < 0 then
+		retry = -2
+	else
+		local drain_time
+		if continuous then
+			drain_time = math.ceil((value - target) * interval / drain_by)
+		else
+			drain_time = math.ceil((value - target) / drain_by) * interval
+		end
+		retry = math.max(0, drain_time - (now - last))
+	end
+	new_value = value
+end
+
+-- Store
+if new_value == 0 then
+	redis.call("DEL", key)
+else
+	local empty_time
+	if continuous then
+		empty_time = math.ceil(new_value * interval / drain_by)
+	else
+		empty_time = math.ceil(new_value / drain_by) * interval
+	end
+	local ttl = math.ceil((empty_time - (now - last)) / 1000) + 1
+	redis.call("HSET", key, "value", new_value, "last_drain", last)
+	redis.call("PEXPIRE", key, math.max(1, ttl))
+end
+return {new_value, retry}
+`)
+
+// setScript sets the value of the bucket stored in KEYS[1], resetting its last drain time.
+//
+// ARGV: now, drain by, drain interval, mode (1 = continuous), value.
+var setScript = redis.NewScript(`
+local key = KEYS[1]
+local now = tonumber(ARGV[1])
+local drain_by = tonumber(ARGV[2])
+local interval = tonumber(ARGV[3])
+local continuous = ARGV[4] == "1"
+local value = tonumber(ARGV[5])
+
+if value == 0 then
+	redis.call("DEL", key)
+	return 0
+end
+local empty_time
+if continuous then
+	empty_time = math.ceil(value * interval / drain_by)
+else
+	empty_time = math.ceil(value / drain_by) * interval
+end
+redis.call("HSET", key, "value", value, "last_drain", now)
+redis.call("PEXPIRE", key, math.ceil(empty_time / 1000) + 1)
+return value
+`)
+
+// maxExact is the largest integer which a Lua number can hold exactly.
+const maxExact = 1 << 53
+
+// Bucket is a leaky bucket whose value and last drain time are stored in Redis, under a single key. Each
+// operation runs as a Lua script, so the drain and update happen atomically even when many processes
+// share the bucket. Its behaviour matches leaky.Bucket, except that times are handled in microseconds, so
+// in DrainContinuous mode the time taken to drain each unit is rounded up to a whole microsecond.
+//
+// The current time is supplied by the caller's clock rather than the Redis server, so the clocks of
+// processes sharing a bucket should be synchronized. If a process's clock is behind the bucket's last
+// drain time, the bucket is not drained until it catches up.
+type Bucket struct {
+	client   redis.Scripter
+	key      string
+	config   leaky.Config
+	clock    leaky.Clock
+	interval int64
+}
+
+// Option configures a Bucket.
+type Option func(b *Bucket)
+
+// WithClock sets the clock used to determine the current time. By default, leaky.RealClock is used.
+func WithClock(clock leaky.Clock) Option {
+	return func(b *Bucket) {
+		b.clock = clock
+	}
+}
+
+// NewBucket creates a Bucket stored under the given key, using the parameters in the given config. Nothing
+// is written to Redis until the bucket is first modified, and a missing key is treated as an empty bucket.
+//
+// The config's DrainInterval must be a whole number of microseconds, and its Capacity plus OverflowLimit
+// must be below 2^53 so that values can be handled exactly by Lua.
+//
+// Example usage:
+//
+//	client := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+//	bucket, err := leakyredis.NewBucket(client, "ratelimit:"+userId, leaky.Config{
+//		DrainBy:       5,
+//		DrainInterval: time.Minute,
+//		Capacity:      300,
+//	})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	if err = bucket.Add(ctx, 1); errors.Is(err, leaky.ErrBucketFull) {
+//		// rate limited
+//	}
+//
+// Parameters:
+//
+//	client  - the Redis client, such as a *redis.Client or *redis.ClusterClient
+//	key     - the key to store the bucket under
+//	config  - the parameters for the bucket
+//	opts    - the options to apply to the bucket
+//
+// Return values:
+//
+//	*Bucket - the created Bucket instance
+//	error   - error message if the config or options are invalid
+func NewBucket(client redis.Scripter, key string, config leaky.Config, opts ...Option) (*Bucket, error) {
+	if client == nil {
+		return nil, errors.New("leakyredis: client cannot be nil")
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.DrainInterval%time.Microsecond != 0 {
+		return nil, errors.New("leakyredis: drain interval must be a whole number of microseconds")
+	}
+	if config.Capacity >= maxExact || config.OverflowLimit >= maxExact-config.Capacity || config.DrainBy >= maxExact {
+		return nil, errors.New("leakyredis: config values too large")
+	}
+	b := &Bucket{
+		client:   client,
+		key:      key,
+		config:   config,
+		clock:    leaky.RealClock,
+		interval: config.DrainInterval.Microseconds(),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.clock == nil {
+		return nil, errors.New("leakyredis: clock cannot be nil")
+	}
+	return b, nil
+}
+
+// Key returns the Redis key the bucket is stored under.
+func (b *Bucket) Key() string {
+	return b.key
+}
+
+// Config returns the parameters of the bucket.
+func (b *Bucket) Config() leaky.Config {
+	return b.config
+}
+
+// now returns the current time in microseconds since the Unix epoch.
+func (b *Bucket) now() int64 {
+	return b.clock.Now().UnixMicro()
+}
+
+// mode returns the script argument for the bucket's drain mode.
+func (b *Bucket) mode() string {
+	if b.config.Mode == leaky.DrainContinuous {
+		return "1"
+	}
+	return "0"
+}
+
+// add runs addScript, returning the new value and the retry result.
+func (b *Bucket) add(ctx context.Context, amount int64) (int64, int64, error) {
+	if amount >= maxExact || amount <= -maxExact {
+		return 0, 0, errors.New("leakyredis: amount too large")
+	}
+	result, err := addScript.Run(ctx, b.client, []string{b.key},
+		b.now(),
+		b.config.DrainBy,
+		b.interval,
+		b.config.Capacity,
+		b.config.OverflowLimit,
+		b.mode(),
+		amount,
+	).Int64Slice()
+	if err != nil {
+		return 0, 0, errors.Join(errors.New("leakyredis: unable to run script"), err)
+	}
+	if len(result) != 2 {
+		return 0, 0, errors.New("leakyredis: unexpected script result")
+	}
+	return result[0], result[1], nil
+}
+
+// Value returns the current value of the bucket after performing a drain operation.
+func (b *Bucket) Value(ctx context.Context) (int64, error) {
+	value, _, err := b.add(ctx, 0)
+	return value, err
+}
+
+// Remaining returns the remaining capacity of the bucket after performing a drain operation.
+//
+// Note that this may return a negative number if OverflowLimit is set.
+func (b *Bucket) Remaining(ctx context.Context) (int64, error) {
+	value, err := b.Value(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return b.config.Capacity - value, nil
+}
+
+// Add increments the value of the bucket by the specified amount, with the same semantics as
+// leaky.Bucket.Add. If the bucket is full, a *leaky.BucketFullError is returned, or leaky.ErrBucketFull if
+// the amount can never fit.
+func (b *Bucket) Add(ctx context.Context, amount int64) error {
+	_, retry, err := b.add(ctx, amount)
+	if err != nil {
+		return err
+	}
+	switch {
+	case retry == -1:
+		return nil
+	case retry < 0:
+		return leaky.ErrBucketFull
+	case retry > math.MaxInt64/int64(time.Microsecond):
+		return &leaky.BucketFullError{RetryAfter: time.Duration(math.MaxInt64)}
+	default:
+		return &leaky.BucketFullError{RetryAfter: time.Duration(retry) * time.Microsecond}
+	}
+}
+
+// Drain reduces the value of the bucket by the specified amount. It is equivalent to calling Add with
+// a negative amount.
+func (b *Bucket) Drain(ctx context.Context, amount int64) error {
+	return b.Add(ctx, -amount)
+}
+
+// Set sets the value of the bucket, with the same semantics as leaky.Bucket.Set. This resets the drain
+// time.
+func (b *Bucket) Set(ctx context.Context, value int64) error {
+	if value < 0 {
+		return errors.New("leaky: bucket value cannot be negative")
+	}
+	if value > b.config.Capacity {
+		return errors.New("leaky: bucket value cannot exceed capacity")
+	}
+
+	err := setScript.Run(ctx, b.client, []string{b.key},
+		b.now(),
+		b.config.DrainBy,
+		b.interval,
+		b.mode(),
+		value,
+	).Err()
+	if err != nil {
+		return errors.Join(errors.New("leakyredis: unable to run script"), err)
+	}
+	return nil
+}
+
+// Delete removes the bucket from Redis, leaving it empty.
+func (b *Bucket) Delete(ctx context.Context) error {
+	return b.Set(ctx, 0)
+}
@@ -0,0 +1,263 @@
+package leakyredis
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	leaky "github.com/t2bot/go-leaky-bucket"
+)
+
+var testConfig = leaky.Config{
+	DrainBy:       5,
+	DrainInterval: time.Minute,
+	Capacity:      300,
+	OverflowLimit: 10,
+}
+
+func newTestClient(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	return server, client
+}
+
+func TestNewBucket(t *testing.T) {
+	_, client := newTestClient(t)
+	var err error
+
+	_, err = NewBucket(nil, "a", testConfig)
+	assert.EqualError(t, err, "leakyredis: client cannot be nil")
+
+	_, err = NewBucket(client, "a", leaky.Config{})
+	assert.EqualError(t, err, "leaky: bucket never drains")
+
+	config := testConfig
+	config.DrainInterval = time.Microsecond + 1
+	_, err = NewBucket(client, "a", config)
+	assert.EqualError(t, err, "leakyredis: drain interval must be a whole number of microseconds")
+
+	config = testConfig
+	config.Capacity = 1 << 53
+	_, err = NewBucket(client, "a", config)
+	assert.EqualError(t, err, "leakyredis: config values too large")
+
+	config = testConfig
+	config.OverflowLimit = 1<<53 - config.Capacity
+	_, err = NewBucket(client, "a", config)
+	assert.EqualError(t, err, "leakyredis: config values too large")
+
+	_, err = NewBucket(client, "a", testConfig, WithClock(nil))
+	assert.EqualError(t, err, "leakyredis: clock cannot be nil")
+
+	bucket, err := NewBucket(client, "a", testConfig)
+	assert.Nil(t, err)
+	assert.Equal(t, "a", bucket.Key())
+	assert.Equal(t, testConfig, bucket.Config())
+	assert.Equal(t, leaky.RealClock, bucket.clock)
+}
+
+func TestBucket_Add(t *testing.T) {
+	ctx := context.Background()
+	server, client := newTestClient(t)
+	clock := leaky.NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	bucket, err := NewBucket(client, "a", testConfig, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestBucket_Add: unexpected error %v", err)
+	}
+
+	// Nothing is stored until the bucket is used
+	value, err := bucket.Value(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), value)
+	assert.False(t, server.Exists("a"))
+
+	assert.Nil(t, bucket.Add(ctx, 300))
+	assert.True(t, server.Exists("a"))
+	assert.Equal(t, "300", server.HGet("a", "value"))
+	// 60 intervals to drain, plus a millisecond
+	assert.Equal(t, time.Hour+time.Millisecond, server.TTL("a"))
+
+	// Overflow
+	assert.Nil(t, bucket.Add(ctx, 10))
+	err = bucket.Add(ctx, 1)
+	var fullErr *leaky.BucketFullError
+	assert.ErrorAs(t, err, &fullErr)
+	assert.Equal(t, 2*time.Minute, fullErr.RetryAfter)
+
+	// Can never fit
+	err = bucket.Add(ctx, 311)
+	assert.ErrorIs(t, err, leaky.ErrBucketFull)
+	assert.False(t, errors.As(err, &fullErr))
+
+	// Drains over time
+	clock.Advance(90 * time.Second)
+	value, err = bucket.Value(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(305), value)
+	remaining, err := bucket.Remaining(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(-5), remaining)
+
+	// The unused 30 seconds is kept
+	err = bucket.Add(ctx, 1)
+	assert.ErrorAs(t, err, &fullErr)
+	assert.Equal(t, 30*time.Second, fullErr.RetryAfter)
+	clock.Advance(30 * time.Second)
+	assert.Nil(t, bucket.Add(ctx, 1))
+
+	// Draining to empty removes the key
+	assert.Nil(t, bucket.Drain(ctx, 1000))
+	assert.False(t, server.Exists("a"))
+}
+
+func TestBucket_Set(t *testing.T) {
+	ctx := context.Background()
+	server, client := newTestClient(t)
+	clock := leaky.NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	bucket, err := NewBucket(client, "a", testConfig, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestBucket_Set: unexpected error %v", err)
+	}
+
+	assert.EqualError(t, bucket.Set(ctx, -1), "leaky: bucket value cannot be negative")
+	assert.EqualError(t, bucket.Set(ctx, 301), "leaky: bucket value cannot exceed capacity")
+
+	clock.Advance(30 * time.Second)
+	assert.Nil(t, bucket.Set(ctx, 12))
+	assert.Equal(t, "12", server.HGet("a", "value"))
+	assert.Equal(t, 3*time.Minute+time.Millisecond, server.TTL("a"))
+
+	// The drain time was reset
+	clock.Advance(30 * time.Second)
+	value, err := bucket.Value(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(12), value)
+
+	assert.Nil(t, bucket.Delete(ctx))
+	assert.False(t, server.Exists("a"))
+}
+
+func TestBucket_Shared(t *testing.T) {
+	ctx := context.Background()
+	_, client := newTestClient(t)
+	clock := leaky.NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	first, err := NewBucket(client, "a", testConfig, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestBucket_Shared: unexpected error %v", err)
+	}
+	second, err := NewBucket(client, "a", testConfig, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestBucket_Shared: unexpected error %v", err)
+	}
+	other, err := NewBucket(client, "b", testConfig, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestBucket_Shared: unexpected error %v", err)
+	}
+
+	assert.Nil(t, first.Add(ctx, 200))
+	assert.Nil(t, second.Add(ctx, 100))
+	value, err := first.Value(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(300), value)
+	value, err = other.Value(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), value)
+}
+
+func TestBucket_ClockBehind(t *testing.T) {
+	ctx := context.Background()
+	_, client := newTestClient(t)
+	clock := leaky.NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	behind := leaky.NewManualClock(clock.Now().Add(-time.Hour))
+	bucket, err := NewBucket(client, "a", testConfig, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestBucket_ClockBehind: unexpected error %v", err)
+	}
+	lagging, err := NewBucket(client, "a", testConfig, WithClock(behind))
+	if err != nil {
+		t.Fatalf("TestBucket_ClockBehind: unexpected error %v", err)
+	}
+
+	assert.Nil(t, bucket.Add(ctx, 100))
+	value, err := lagging.Value(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), value)
+
+	clock.Advance(time.Minute)
+	value, err = bucket.Value(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(95), value)
+}
+
+func TestBucket_Errors(t *testing.T) {
+	ctx := context.Background()
+	server, client := newTestClient(t)
+	bucket, err := NewBucket(client, "a", testConfig)
+	if err != nil {
+		t.Fatalf("TestBucket_Errors: unexpected error %v", err)
+	}
+
+	assert.EqualError(t, bucket.Add(ctx, 1<<53), "leakyredis: amount too large")
+
+	server.Close()
+	err = bucket.Add(ctx, 1)
+	assert.ErrorContains(t, err, "leakyredis: unable to run script")
+	_, err = bucket.Value(ctx)
+	assert.ErrorContains(t, err, "leakyredis: unable to run script")
+	_, err = bucket.Remaining(ctx)
+	assert.ErrorContains(t, err, "leakyredis: unable to run script")
+	assert.ErrorContains(t, bucket.Set(ctx, 1), "leakyredis: unable to run script")
+}
+
+// TestBucket_MatchesBucket runs the same random operations against a Bucket and a leaky.Bucket, checking
+// that they agree.
+func TestBucket_MatchesBucket(t *testing.T) {
+	ctx := context.Background()
+	_, client := newTestClient(t)
+	configs := []leaky.Config{
+		testConfig,
+		{DrainBy: 4, DrainInterval: 10 * time.Second, Capacity: 50, Mode: leaky.DrainContinuous},
+		{DrainBy: 7, DrainInterval: 3 * time.Second, Capacity: 50, OverflowLimit: 5},
+		{DrainBy: 1, DrainInterval: time.Millisecond, Capacity: 1000, Mode: leaky.DrainContinuous},
+	}
+	for i, config := range configs {
+		random := rand.New(rand.NewSource(int64(i)))
+		clock := leaky.NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		remote, err := NewBucket(client, "matches", config, WithClock(clock))
+		if err != nil {
+			t.Fatalf("TestBucket_MatchesBucket(case:%d): unexpected error %v", i, err)
+		}
+		local, err := leaky.NewBucketFromConfig(config, leaky.WithClock(clock))
+		if err != nil {
+			t.Fatalf("TestBucket_MatchesBucket(case:%d): unexpected error %v", i, err)
+		}
+
+		for op := 0; op < 500; op++ {
+			clock.Advance(time.Duration(random.Int63n(int64(config.DrainInterval)*2/int64(time.Microsecond))) * time.Microsecond)
+			amount := random.Int63n(config.Capacity/2) - config.Capacity/8
+			remoteErr := remote.Add(ctx, amount)
+			localErr := local.Add(amount)
+			if !assert.Equal(t, localErr, remoteErr, "TestBucket_MatchesBucket(case:%d, op:%d)", i, op) {
+				break
+			}
+			if errors.Is(localErr, leaky.ErrBucketFull) {
+				assert.Nil(t, remote.Set(ctx, config.Capacity/2), "TestBucket_MatchesBucket(case:%d, op:%d)", i, op)
+				assert.Nil(t, local.Set(config.Capacity/2), "TestBucket_MatchesBucket(case:%d, op:%d)", i, op)
+			}
+			value, err := remote.Value(ctx)
+			assert.Nil(t, err, "TestBucket_MatchesBucket(case:%d, op:%d)", i, op)
+			if !assert.Equal(t, local.Value(), value, "TestBucket_MatchesBucket(case:%d, op:%d)", i, op) {
+				break
+			}
+		}
+		assert.Nil(t, remote.Delete(ctx), "TestBucket_MatchesBucket(case:%d)", i)
+	}
+}
@@ -0,0 +1,338 @@
+// Package leakysql provides a leaky.Store which keeps buckets in a SQL database table, such as in Postgres
+// or SQLite.
+package leakysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	leaky "github.com/t2bot/go-leaky-bucket"
+)
+
+// Placeholder is the style of query parameter placeholder used by a database driver.
+type Placeholder int
+
+const (
+	// PlaceholderQuestion uses "?" for each parameter, as used by SQLite and MySQL drivers.
+	PlaceholderQuestion Placeholder = iota
+
+	// PlaceholderDollar uses "$1", "$2", and so on, as used by Postgres drivers.
+	PlaceholderDollar
+)
+
+// tableNamePattern matches the table names accepted by NewStore, which are interpolated into queries.
+var tableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// Store is a leaky.Store which keeps one row per key in a table, holding the encoded bucket and a version
+// number which is incremented by every write. Add and Remaining operate on stored buckets directly, using
+// the version to detect concurrent changes.
+//
+// The table has the following columns, and can be created with CreateTable:
+//
+//	bucket_key  VARCHAR(255) PRIMARY KEY
+//	bucket      TEXT NOT NULL      -- the bucket's MarshalText form
+//	version     BIGINT NOT NULL
+type Store struct {
+	db          *sql.DB
+	table       string
+	config      leaky.Config
+	clock       leaky.Clock
+	placeholder Placeholder
+
+	beforeWrite func() // used by tests to simulate concurrent changes
+}
+
+// Option configures a Store.
+type Option func(s *Store)
+
+// WithClock sets the clock used by buckets loaded from the store. By default, leaky.RealClock is used.
+func WithClock(clock leaky.Clock) Option {
+	return func(s *Store) {
+		s.clock = clock
+	}
+}
+
+// WithPlaceholder sets the style of query parameter placeholder. By default, PlaceholderQuestion is used.
+func WithPlaceholder(placeholder Placeholder) Option {
+	return func(s *Store) {
+		s.placeholder = placeholder
+	}
+}
+
+// NewStore creates a Store which keeps buckets in the given table. Buckets created by Add use the
+// parameters in the given config.
+//
+// Example usage:
+//
+//	db, err := sql.Open("postgres", connStr)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	store, err := leakysql.NewStore(db, "rate_limits", leaky.Config{
+//		DrainBy:       5,
+//		DrainInterval: time.Minute,
+//		Capacity:      300,
+//	}, leakysql.WithPlaceholder(leakysql.PlaceholderDollar))
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	if err = store.CreateTable(ctx); err != nil {
+//		log.Fatal(err)
+//	}
+//	if err = store.Add(ctx, userId, 1); errors.Is(err, leaky.ErrBucketFull) {
+//		// rate limited
+//	}
+//
+// Parameters:
+//
+//	db      - the database to use
+//	table   - the name of the table, optionally qualified by a schema
+//	config  - the parameters for buckets created by Add
+//	opts    - the options to apply to the store
+//
+// Return values:
+//
+//	*Store  - the created Store instance
+//	error   - error message if the table name, config, or options are invalid
+func NewStore(db *sql.DB, table string, config leaky.Config, opts ...Option) (*Store, error) {
+	if db == nil {
+		return nil, errors.New("leakysql: database cannot be nil")
+	}
+	if !tableNamePattern.MatchString(table) {
+		return nil, fmt.Errorf("leakysql: invalid table name %q", table)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	s := &Store{
+		db:          db,
+		table:       table,
+		config:      config,
+		clock:       leaky.RealClock,
+		placeholder: PlaceholderQuestion,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.clock == nil {
+		return nil, errors.New("leakysql: clock cannot be nil")
+	}
+	if s.placeholder != PlaceholderQuestion && s.placeholder != PlaceholderDollar {
+		return nil, errors.New("leakysql: unsupported placeholder style")
+	}
+	return s, nil
+}
+
+// Config returns the parameters for buckets created by Add.
+func (s *Store) Config() leaky.Config {
+	return s.config
+}
+
+// query replaces each "?" in the query with the store's placeholder style, and the table name for "{table}".
+func (s *Store) query(query string) string {
+	query = strings.ReplaceAll(query, "{table}", s.table)
+	if s.placeholder == PlaceholderQuestion {
+		return query
+	}
+	builder := strings.Builder{}
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			_, _ = fmt.Fprintf(&builder, "$%d", n)
+		} else {
+			builder.WriteRune(r)
+		}
+	}
+	return builder.String()
+}
+
+// CreateTable creates the store's table if it does not already exist.
+func (s *Store) CreateTable(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, s.query(`CREATE TABLE IF NOT EXISTS {table} (
+		bucket_key VARCHAR(255) PRIMARY KEY,
+		bucket TEXT NOT NULL,
+		version BIGINT NOT NULL
+	)`))
+	if err != nil {
+		return errors.Join(errors.New("leakysql: unable to create table"), err)
+	}
+	return nil
+}
+
+// load returns the bucket and version stored for the given key, or leaky.ErrNotFound.
+func (s *Store) load(ctx context.Context, key string) (*leaky.Bucket, int64, error) {
+	text := ""
+	version := int64(0)
+	err := s.db.QueryRowContext(ctx, s.query(`SELECT bucket, version FROM {table} WHERE bucket_key = ?`), key).Scan(&text, &version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, 0, leaky.ErrNotFound
+	} else if err != nil {
+		return nil, 0, errors.Join(errors.New("leakysql: unable to load bucket"), err)
+	}
+
+	// Unmarshaling keeps the bucket's clock, so start from a bucket which uses ours
+	bucket, err := leaky.NewBucketFromConfig(s.config, leaky.WithClock(s.clock))
+	if err != nil {
+		return nil, 0, err
+	}
+	if err = bucket.UnmarshalText([]byte(text)); err != nil {
+		return nil, 0, err
+	}
+	return bucket, version, nil
+}
+
+// insert stores the bucket for a key which has no row, returning false if a row already exists.
+func (s *Store) insert(ctx context.Context, key string, text []byte) (bool, error) {
+	if s.beforeWrite != nil {
+		s.beforeWrite()
+	}
+	_, err := s.db.ExecContext(ctx, s.query(`INSERT INTO {table} (bucket_key, bucket, version) VALUES (?, ?, 1)`), key, string(text))
+	if err == nil {
+		return true, nil
+	}
+
+	// Drivers report duplicate keys differently, so check whether the row exists instead
+	if _, _, loadErr := s.load(ctx, key); loadErr == nil {
+		return false, nil
+	}
+	return false, errors.Join(errors.New("leakysql: unable to insert bucket"), err)
+}
+
+// update runs an update statement with the given arguments, returning whether a row was changed.
+func (s *Store) update(ctx context.Context, query string, args ...any) (bool, error) {
+	if s.beforeWrite != nil {
+		s.beforeWrite()
+	}
+	result, err := s.db.ExecContext(ctx, s.query(query), args...)
+	if err != nil {
+		return false, errors.Join(errors.New("leakysql: unable to update bucket"), err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Join(errors.New("leakysql: unable to update bucket"), err)
+	}
+	return rows > 0, nil
+}
+
+// Load returns the bucket stored for the given key, or leaky.ErrNotFound if there is none.
+func (s *Store) Load(ctx context.Context, key string) (*leaky.Bucket, error) {
+	bucket, _, err := s.load(ctx, key)
+	return bucket, err
+}
+
+// Save stores the bucket for the given key, replacing any existing bucket.
+func (s *Store) Save(ctx context.Context, key string, bucket *leaky.Bucket) error {
+	text, err := bucket.MarshalText()
+	if err != nil {
+		return err
+	}
+	for {
+		if updated, err := s.update(ctx, `UPDATE {table} SET bucket = ?, version = version + 1 WHERE bucket_key = ?`, string(text), key); err != nil || updated {
+			return err
+		}
+		if inserted, err := s.insert(ctx, key, text); err != nil || inserted {
+			return err
+		}
+	}
+}
+
+// CompareAndSwap stores the new bucket for the given key only if the currently stored bucket is identical
+// to old, or there is no stored bucket and old is nil.
+func (s *Store) CompareAndSwap(ctx context.Context, key string, old *leaky.Bucket, new *leaky.Bucket) (bool, error) {
+	text, err := new.MarshalText()
+	if err != nil {
+		return false, err
+	}
+	if old == nil {
+		return s.insert(ctx, key, text)
+	}
+	oldText, err := old.MarshalText()
+	if err != nil {
+		return false, err
+	}
+	return s.update(ctx, `UPDATE {table} SET bucket = ?, version = version + 1 WHERE bucket_key = ? AND bucket = ?`, string(text), key, string(oldText))
+}
+
+// Delete removes the bucket for the given key, if any.
+func (s *Store) Delete(ctx context.Context, key string) error {
+	if _, err := s.db.ExecContext(ctx, s.query(`DELETE FROM {table} WHERE bucket_key = ?`), key); err != nil {
+		return errors.Join(errors.New("leakysql: unable to delete bucket"), err)
+	}
+	return nil
+}
+
+// Add adds the specified amount to the bucket for the given key, creating the bucket from the store's
+// config if needed. See leaky.Bucket.Add for details.
+//
+// The bucket is read, modified, and then written only if its version has not changed in the meantime.
+// If another writer changed it first, the whole operation is retried. Nothing is written if the bucket
+// is full.
+func (s *Store) Add(ctx context.Context, key string, amount int64) error {
+	for {
+		bucket, version, err := s.load(ctx, key)
+		if errors.Is(err, leaky.ErrNotFound) {
+			if bucket, err = leaky.NewBucketFromConfig(s.config, leaky.WithClock(s.clock)); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+
+		if err = bucket.Add(amount); err != nil {
+			return err
+		}
+		text, err := bucket.MarshalText()
+		if err != nil {
+			return err
+		}
+
+		var written bool
+		if version == 0 {
+			written, err = s.insert(ctx, key, text)
+		} else {
+			written, err = s.update(ctx, `UPDATE {table} SET bucket = ?, version = version + 1 WHERE bucket_key = ? AND version = ?`, string(text), key, version)
+		}
+		if err != nil || written {
+			return err
+		}
+	}
+}
+
+// Drain reduces the value of the bucket for the given key by the specified amount. It is equivalent to
+// calling Add with a negative amount.
+func (s *Store) Drain(ctx context.Context, key string, amount int64) error {
+	return s.Add(ctx, key, -amount)
+}
+
+// Value returns the value of the bucket for the given key after performing a drain operation. If there is
+// no bucket for the key, zero is returned. Nothing is written.
+func (s *Store) Value(ctx context.Context, key string) (int64, error) {
+	bucket, _, err := s.load(ctx, key)
+	if errors.Is(err, leaky.ErrNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return bucket.Value(), nil
+}
+
+// Remaining returns the remaining capacity of the bucket for the given key after performing a drain
+// operation. If there is no bucket for the key, the config's Capacity is returned. Nothing is written.
+//
+// Note that this may return a negative number if OverflowLimit is set.
+func (s *Store) Remaining(ctx context.Context, key string) (int64, error) {
+	bucket, _, err := s.load(ctx, key)
+	if errors.Is(err, leaky.ErrNotFound) {
+		return s.config.Capacity, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return bucket.Remaining(), nil
+}
+
+var _ leaky.Store = (*Store)(nil)
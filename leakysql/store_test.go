@@ -0,0 +1,308 @@
+package leakysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	leaky "github.com/t2bot/go-leaky-bucket"
+	_ "modernc.org/sqlite"
+)
+
+var testConfig = leaky.Config{
+	DrainBy:       5,
+	DrainInterval: time.Minute,
+	Capacity:      300,
+	OverflowLimit: 10,
+}
+
+func newTestStore(t *testing.T) (*Store, *leaky.ManualClock) {
+	db, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "test.db")+"?_pragma=busy_timeout(10000)")
+	if err != nil {
+		t.Fatalf("newTestStore: unexpected error %v", err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	clock := leaky.NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	store, err := NewStore(db, "buckets", testConfig, WithClock(clock))
+	if err != nil {
+		t.Fatalf("newTestStore: unexpected error %v", err)
+	}
+	if err = store.CreateTable(context.Background()); err != nil {
+		t.Fatalf("newTestStore: unexpected error %v", err)
+	}
+	return store, clock
+}
+
+func TestNewStore(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("TestNewStore: unexpected error %v", err)
+	}
+	defer db.Close()
+
+	_, err = NewStore(nil, "buckets", testConfig)
+	assert.EqualError(t, err, "leakysql: database cannot be nil")
+
+	for _, table := range []string{"", "1buckets", "buckets; DROP TABLE users", "a.b.c", `"buckets"`} {
+		_, err = NewStore(db, table, testConfig)
+		assert.EqualError(t, err, fmt.Sprintf("leakysql: invalid table name %q", table), "TestNewStore(table:%s)", table)
+	}
+
+	_, err = NewStore(db, "buckets", leaky.Config{})
+	assert.EqualError(t, err, "leaky: bucket never drains")
+
+	_, err = NewStore(db, "buckets", testConfig, WithClock(nil))
+	assert.EqualError(t, err, "leakysql: clock cannot be nil")
+
+	_, err = NewStore(db, "buckets", testConfig, WithPlaceholder(Placeholder(99)))
+	assert.EqualError(t, err, "leakysql: unsupported placeholder style")
+
+	store, err := NewStore(db, "public.buckets", testConfig)
+	assert.Nil(t, err)
+	assert.Equal(t, testConfig, store.Config())
+	assert.Equal(t, leaky.RealClock, store.clock)
+}
+
+func TestStore_query(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("TestStore_query: unexpected error %v", err)
+	}
+	defer db.Close()
+
+	store, err := NewStore(db, "buckets", testConfig)
+	assert.Nil(t, err)
+	assert.Equal(t, "UPDATE buckets SET a = ? WHERE b = ?", store.query("UPDATE {table} SET a = ? WHERE b = ?"))
+
+	store, err = NewStore(db, "buckets", testConfig, WithPlaceholder(PlaceholderDollar))
+	assert.Nil(t, err)
+	assert.Equal(t, "UPDATE buckets SET a = $1 WHERE b = $2", store.query("UPDATE {table} SET a = ? WHERE b = ?"))
+}
+
+func TestStore_LoadSave(t *testing.T) {
+	ctx := context.Background()
+	store, clock := newTestStore(t)
+
+	_, err := store.Load(ctx, "a")
+	assert.ErrorIs(t, err, leaky.ErrNotFound)
+
+	bucket, err := leaky.NewBucketFromConfig(leaky.Config{
+		DrainBy:       7,
+		DrainInterval: time.Second,
+		Capacity:      50,
+		Mode:          leaky.DrainContinuous,
+	}, leaky.WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestStore_LoadSave: unexpected error %v", err)
+	}
+	assert.Nil(t, bucket.Set(42))
+	assert.Nil(t, store.Save(ctx, "a", bucket))
+
+	// Parameters come from the saved bucket rather than the store's config
+	loaded, err := store.Load(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, bucket.Config(), loaded.Config())
+	assert.Equal(t, int64(42), loaded.Peek())
+
+	// Loaded buckets use the store's clock
+	clock.Advance(time.Hour)
+	assert.Equal(t, int64(0), loaded.Value())
+
+	// Saving again replaces the bucket
+	assert.Nil(t, bucket.Set(7))
+	assert.Nil(t, store.Save(ctx, "a", bucket))
+	loaded, err = store.Load(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), loaded.Peek())
+
+	assert.Nil(t, store.Delete(ctx, "a"))
+	_, err = store.Load(ctx, "a")
+	assert.ErrorIs(t, err, leaky.ErrNotFound)
+}
+
+func TestStore_CompareAndSwap(t *testing.T) {
+	ctx := context.Background()
+	store, clock := newTestStore(t)
+
+	first, err := leaky.NewBucketFromConfig(testConfig, leaky.WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestStore_CompareAndSwap: unexpected error %v", err)
+	}
+	second, err := leaky.NewBucketFromConfig(testConfig, leaky.WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestStore_CompareAndSwap: unexpected error %v", err)
+	}
+	assert.Nil(t, second.Set(10))
+
+	swapped, err := store.CompareAndSwap(ctx, "a", first, second)
+	assert.Nil(t, err)
+	assert.False(t, swapped)
+
+	swapped, err = store.CompareAndSwap(ctx, "a", nil, first)
+	assert.Nil(t, err)
+	assert.True(t, swapped)
+
+	swapped, err = store.CompareAndSwap(ctx, "a", nil, second)
+	assert.Nil(t, err)
+	assert.False(t, swapped)
+
+	loaded, err := store.Load(ctx, "a")
+	assert.Nil(t, err)
+	swapped, err = store.CompareAndSwap(ctx, "a", loaded, second)
+	assert.Nil(t, err)
+	assert.True(t, swapped)
+
+	swapped, err = store.CompareAndSwap(ctx, "a", loaded, first)
+	assert.Nil(t, err)
+	assert.False(t, swapped)
+
+	loaded, err = store.Load(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), loaded.Peek())
+
+	// Works with leaky.UpdateBucket
+	err = leaky.UpdateBucket(ctx, store, "a", func() (*leaky.Bucket, error) {
+		return leaky.NewBucketFromConfig(testConfig, leaky.WithClock(clock))
+	}, func(bucket *leaky.Bucket) error {
+		return bucket.Add(5)
+	})
+	assert.Nil(t, err)
+	loaded, err = store.Load(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(15), loaded.Peek())
+}
+
+func TestStore_Add(t *testing.T) {
+	ctx := context.Background()
+	store, clock := newTestStore(t)
+
+	value, err := store.Value(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), value)
+	remaining, err := store.Remaining(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(300), remaining)
+
+	// Creates from the config
+	assert.Nil(t, store.Add(ctx, "a", 300))
+	loaded, err := store.Load(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, testConfig, loaded.Config())
+
+	// Overflow
+	assert.Nil(t, store.Add(ctx, "a", 10))
+	err = store.Add(ctx, "a", 1)
+	var fullErr *leaky.BucketFullError
+	assert.ErrorAs(t, err, &fullErr)
+	assert.Equal(t, 2*time.Minute, fullErr.RetryAfter)
+	assert.ErrorIs(t, store.Add(ctx, "a", 311), leaky.ErrBucketFull)
+	remaining, err = store.Remaining(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(-10), remaining)
+
+	// Drains over time
+	clock.Advance(90 * time.Second)
+	value, err = store.Value(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(305), value)
+	assert.Nil(t, store.Drain(ctx, "a", 105))
+	remaining, err = store.Remaining(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), remaining)
+
+	// Keys are independent
+	value, err = store.Value(ctx, "b")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), value)
+}
+
+func TestStore_AddConflict(t *testing.T) {
+	ctx := context.Background()
+	store, _ := newTestStore(t)
+	assert.Nil(t, store.Add(ctx, "a", 10))
+
+	// Another writer changes the bucket between the first read and write
+	conflicts := 0
+	store.beforeWrite = func() {
+		if conflicts == 0 {
+			conflicts++
+			store.beforeWrite = nil
+			assert.Nil(t, store.Add(ctx, "a", 100))
+			store.beforeWrite = func() {}
+		}
+	}
+	assert.Nil(t, store.Add(ctx, "a", 1))
+	assert.Equal(t, 1, conflicts)
+	value, err := store.Value(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(111), value)
+
+	// Conflicting insert
+	conflicts = 0
+	store.beforeWrite = func() {
+		if conflicts == 0 {
+			conflicts++
+			store.beforeWrite = nil
+			assert.Nil(t, store.Add(ctx, "b", 100))
+			store.beforeWrite = func() {}
+		}
+	}
+	assert.Nil(t, store.Add(ctx, "b", 1))
+	value, err = store.Value(ctx, "b")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(101), value)
+}
+
+func TestStore_AddConcurrent(t *testing.T) {
+	ctx := context.Background()
+	store, _ := newTestStore(t)
+
+	const goroutines = 4
+	const adds = 10
+	wg := sync.WaitGroup{}
+	for range [goroutines]struct{}{} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range [adds]struct{}{} {
+				assert.Nil(t, store.Add(ctx, "a", 1))
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := store.Value(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(goroutines*adds), value)
+}
+
+func TestStore_Errors(t *testing.T) {
+	ctx := context.Background()
+	store, _ := newTestStore(t)
+	assert.Nil(t, store.db.Close())
+
+	_, err := store.Load(ctx, "a")
+	assert.ErrorContains(t, err, "leakysql: unable to load bucket")
+	assert.ErrorContains(t, store.Add(ctx, "a", 1), "leakysql: unable to load bucket")
+	_, err = store.Value(ctx, "a")
+	assert.ErrorContains(t, err, "leakysql: unable to load bucket")
+	_, err = store.Remaining(ctx, "a")
+	assert.ErrorContains(t, err, "leakysql: unable to load bucket")
+	assert.ErrorContains(t, store.Delete(ctx, "a"), "leakysql: unable to delete bucket")
+	assert.ErrorContains(t, store.CreateTable(ctx), "leakysql: unable to create table")
+
+	bucket, err := leaky.NewBucketFromConfig(testConfig)
+	if err != nil {
+		t.Fatalf("TestStore_Errors: unexpected error %v", err)
+	}
+	assert.ErrorContains(t, store.Save(ctx, "a", bucket), "leakysql: unable to update bucket")
+	_, err = store.CompareAndSwap(ctx, "a", nil, bucket)
+	assert.ErrorContains(t, err, "leakysql: unable to insert bucket")
+}
@@ -0,0 +1,168 @@
+package leaky
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// String returns a human-readable name for the drain mode.
+func (m DrainMode) String() string {
+	switch m {
+	case DrainStepped:
+		return "stepped"
+	case DrainContinuous:
+		return "continuous"
+	default:
+		return fmt.Sprintf("DrainMode(%d)", int32(m))
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler, producing the same name as String.
+func (m DrainMode) MarshalText() ([]byte, error) {
+	switch m {
+	case DrainStepped, DrainContinuous:
+		return []byte(m.String()), nil
+	default:
+		return nil, fmt.Errorf("leaky: unsupported drain mode %d", m)
+	}
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, accepting the names produced by MarshalText.
+func (m *DrainMode) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "stepped":
+		*m = DrainStepped
+	case "continuous":
+		*m = DrainContinuous
+	default:
+		return fmt.Errorf("leaky: unsupported drain mode %q", text)
+	}
+	return nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler using the same format as Encode.
+func (b *Bucket) MarshalBinary() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := b.Encode(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, accepting anything DecodeBucket does. The bucket's
+// parameters and state are replaced, though its clock is kept. An error is returned, leaving the bucket
+// unchanged, if the decoded parameters are invalid.
+func (b *Bucket) UnmarshalBinary(data []byte) error {
+	buf := bytes.NewBuffer(data)
+	decoded, err := DecodeBucket(buf)
+	if err != nil {
+		return err
+	}
+	if buf.Len() > 0 {
+		return errors.New("leaky: unexpected data after encoded bucket")
+	}
+	return b.replace(decoded)
+}
+
+// MarshalText implements encoding.TextMarshaler, producing the MarshalBinary form encoded as base64.
+func (b *Bucket) MarshalText() ([]byte, error) {
+	data, err := b.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	text := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+	base64.StdEncoding.Encode(text, data)
+	return text, nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, accepting the output of MarshalText.
+func (b *Bucket) UnmarshalText(text []byte) error {
+	data := make([]byte, base64.StdEncoding.DecodedLen(len(text)))
+	n, err := base64.StdEncoding.Decode(data, text)
+	if err != nil {
+		return errors.Join(errors.New("leaky: unable to decode base64"), err)
+	}
+	return b.UnmarshalBinary(data[:n])
+}
+
+// bucketJSON is the JSON representation of a Bucket.
+type bucketJSON struct {
+	DrainBy       int64     `json:"drain_by"`
+	DrainInterval string    `json:"drain_interval"`
+	Capacity      int64     `json:"capacity"`
+	OverflowLimit int64     `json:"overflow_limit"`
+	Mode          DrainMode `json:"mode"`
+	Value         int64     `json:"value"`
+	LastDrain     time.Time `json:"last_drain"`
+}
+
+// MarshalJSON implements json.Marshaler. Durations are written in time.Duration's string form (such as
+// "1m30s"), and the last drain time is written as an RFC 3339 timestamp.
+//
+// Example output:
+//
+//	{"drain_by":5,"drain_interval":"1m0s","capacity":300,"overflow_limit":0,"mode":"stepped","value":42,"last_drain":"2024-01-01T00:00:00Z"}
+func (b *Bucket) MarshalJSON() ([]byte, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return json.Marshal(bucketJSON{
+		DrainBy:       b.DrainBy,
+		DrainInterval: b.DrainInterval.String(),
+		Capacity:      b.Capacity,
+		OverflowLimit: b.OverflowLimit,
+		Mode:          b.Mode,
+		Value:         b.value,
+		LastDrain:     b.lastDrain,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler, accepting the output of MarshalJSON. The bucket's parameters
+// and state are replaced, though its clock is kept. An error is returned, leaving the bucket unchanged, if
+// the parameters are invalid. See Config.Validate for details.
+func (b *Bucket) UnmarshalJSON(data []byte) error {
+	var raw bucketJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	interval, err := time.ParseDuration(raw.DrainInterval)
+	if err != nil {
+		return errors.Join(errors.New("leaky: unable to parse `drain_interval`"), err)
+	}
+	return b.replace(&Bucket{
+		DrainBy:       raw.DrainBy,
+		DrainInterval: interval,
+		Capacity:      raw.Capacity,
+		OverflowLimit: raw.OverflowLimit,
+		Mode:          raw.Mode,
+		value:         raw.Value,
+		lastDrain:     raw.LastDrain,
+	})
+}
+
+// replace copies the parameters and state of other into the bucket, keeping the bucket's clock. Nothing is
+// copied if other's parameters are invalid or its value is negative.
+func (b *Bucket) replace(other *Bucket) error {
+	if err := other.config().Validate(); err != nil {
+		return err
+	}
+	if other.value < 0 {
+		return errors.New("leaky: bucket value cannot be negative")
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.DrainBy = other.DrainBy
+	b.DrainInterval = other.DrainInterval
+	b.Capacity = other.Capacity
+	b.OverflowLimit = other.OverflowLimit
+	b.Mode = other.Mode
+	b.resetValueLocked(other.value)
+	b.lastDrain = other.lastDrain
+	return nil
+}
@@ -0,0 +1,157 @@
+package leaky
+
+import (
+	"encoding"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	_ encoding.BinaryMarshaler   = (*Bucket)(nil)
+	_ encoding.BinaryUnmarshaler = (*Bucket)(nil)
+	_ encoding.TextMarshaler     = (*Bucket)(nil)
+	_ encoding.TextUnmarshaler   = (*Bucket)(nil)
+	_ json.Marshaler             = (*Bucket)(nil)
+	_ json.Unmarshaler           = (*Bucket)(nil)
+)
+
+func newMarshalTestBucket(t *testing.T) *Bucket {
+	bucket, err := NewBucket(5, 90*time.Second, 300)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	bucket.OverflowLimit = 24
+	bucket.Mode = DrainContinuous
+	bucket.value = 42
+	bucket.lastDrain = time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	return bucket
+}
+
+func assertBucketsEqual(t *testing.T, expected *Bucket, actual *Bucket) {
+	assert.Equal(t, expected.DrainBy, actual.DrainBy)
+	assert.Equal(t, expected.DrainInterval, actual.DrainInterval)
+	assert.Equal(t, expected.Capacity, actual.Capacity)
+	assert.Equal(t, expected.OverflowLimit, actual.OverflowLimit)
+	assert.Equal(t, expected.Mode, actual.Mode)
+	assert.Equal(t, expected.value, actual.value)
+	assert.Equal(t, 0, expected.lastDrain.Compare(actual.lastDrain))
+}
+
+func TestDrainMode_Text(t *testing.T) {
+	assert.Equal(t, "stepped", DrainStepped.String())
+	assert.Equal(t, "continuous", DrainContinuous.String())
+	assert.Equal(t, "DrainMode(42)", DrainMode(42).String())
+
+	for _, mode := range []DrainMode{DrainStepped, DrainContinuous} {
+		text, err := mode.MarshalText()
+		assert.Nil(t, err)
+		var decoded DrainMode
+		assert.Nil(t, decoded.UnmarshalText(text))
+		assert.Equal(t, mode, decoded)
+	}
+
+	_, err := DrainMode(42).MarshalText()
+	assert.EqualError(t, err, "leaky: unsupported drain mode 42")
+	var decoded DrainMode
+	assert.EqualError(t, decoded.UnmarshalText([]byte("sideways")), `leaky: unsupported drain mode "sideways"`)
+}
+
+func TestBucket_MarshalBinary(t *testing.T) {
+	bucket := newMarshalTestBucket(t)
+	data, err := bucket.MarshalBinary()
+	if err != nil {
+		t.Fatalf("TestBucket_MarshalBinary: unexpected error %v", err)
+	}
+
+	// Same format as DecodeBucket expects, and keeps the receiver's clock
+	clock := NewManualClock(time.Now())
+	bucket2, err := NewBucketWithOptions(1, time.Second, 1, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestBucket_MarshalBinary: unexpected error %v", err)
+	}
+	if err = bucket2.UnmarshalBinary(data); err != nil {
+		t.Fatalf("TestBucket_MarshalBinary: unexpected unmarshal error %v", err)
+	}
+	assertBucketsEqual(t, bucket, bucket2)
+	assert.Equal(t, Clock(clock), bucket2.clock)
+
+	// Rejects trailing and truncated data
+	assert.EqualError(t, bucket2.UnmarshalBinary(append(data, 0)), "leaky: unexpected data after encoded bucket")
+	assert.ErrorContains(t, bucket2.UnmarshalBinary(data[:len(data)-1]), "leaky: unable to read checksum")
+
+	// Rejects invalid parameters, leaving the bucket unchanged
+	invalid, err := (&Bucket{DrainBy: 5, Capacity: 300}).MarshalBinary()
+	if err != nil {
+		t.Fatalf("TestBucket_MarshalBinary: unexpected error %v", err)
+	}
+	assert.EqualError(t, bucket2.UnmarshalBinary(invalid), "leaky: bucket never drains")
+	assertBucketsEqual(t, bucket, bucket2)
+}
+
+func TestBucket_MarshalText(t *testing.T) {
+	bucket := newMarshalTestBucket(t)
+	text, err := bucket.MarshalText()
+	if err != nil {
+		t.Fatalf("TestBucket_MarshalText: unexpected error %v", err)
+	}
+
+	bucket2 := &Bucket{}
+	if err = bucket2.UnmarshalText(text); err != nil {
+		t.Fatalf("TestBucket_MarshalText: unexpected unmarshal error %v", err)
+	}
+	assertBucketsEqual(t, bucket, bucket2)
+
+	assert.ErrorContains(t, bucket2.UnmarshalText([]byte("not base64!")), "leaky: unable to decode base64")
+}
+
+func TestBucket_MarshalJSON(t *testing.T) {
+	bucket := newMarshalTestBucket(t)
+	data, err := json.Marshal(bucket)
+	if err != nil {
+		t.Fatalf("TestBucket_MarshalJSON: unexpected error %v", err)
+	}
+	assert.JSONEq(t, `{
+		"drain_by": 5,
+		"drain_interval": "1m30s",
+		"capacity": 300,
+		"overflow_limit": 24,
+		"mode": "continuous",
+		"value": 42,
+		"last_drain": "2024-01-02T03:04:05.000000006Z"
+	}`, string(data))
+
+	bucket2 := &Bucket{}
+	if err = json.Unmarshal(data, bucket2); err != nil {
+		t.Fatalf("TestBucket_MarshalJSON: unexpected unmarshal error %v", err)
+	}
+	assertBucketsEqual(t, bucket, bucket2)
+
+	// Works when embedded in other structs
+	type wrapper struct {
+		Bucket *Bucket `json:"bucket"`
+	}
+	data, err = json.Marshal(wrapper{Bucket: bucket})
+	if err != nil {
+		t.Fatalf("TestBucket_MarshalJSON: unexpected error %v", err)
+	}
+	var decoded wrapper
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("TestBucket_MarshalJSON: unexpected unmarshal error %v", err)
+	}
+	assertBucketsEqual(t, bucket, decoded.Bucket)
+
+	// Rejects bad values
+	assert.ErrorContains(t, bucket2.UnmarshalJSON([]byte(`{"drain_interval":"soon"}`)), "leaky: unable to parse `drain_interval`")
+	assert.ErrorContains(t, bucket2.UnmarshalJSON([]byte(`{"drain_interval":"1m","mode":"sideways"}`)), "leaky: unsupported drain mode")
+	assert.ErrorContains(t, bucket2.UnmarshalJSON([]byte(`{"last_drain":"yesterday"}`)), "cannot parse")
+
+	// Rejects invalid parameters, leaving the bucket unchanged
+	assert.EqualError(t, bucket2.UnmarshalJSON([]byte(`{"drain_by":5,"drain_interval":"0s","capacity":300,"value":5}`)), "leaky: bucket never drains")
+	assert.EqualError(t, bucket2.UnmarshalJSON([]byte(`{"drain_by":5,"drain_interval":"1m","capacity":0,"value":5}`)), "leaky: bucket can never fill")
+	assert.EqualError(t, bucket2.UnmarshalJSON([]byte(`{"drain_by":5,"drain_interval":"1m","capacity":300,"overflow_limit":-1}`)), "leaky: overflow limit cannot be negative")
+	assert.EqualError(t, bucket2.UnmarshalJSON([]byte(`{"drain_by":5,"drain_interval":"1m","capacity":300,"value":-5}`)), "leaky: bucket value cannot be negative")
+	assertBucketsEqual(t, bucket, bucket2)
+}
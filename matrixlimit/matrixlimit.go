@@ -0,0 +1,179 @@
+// Package matrixlimit produces and consumes the Matrix specification's M_LIMIT_EXCEEDED error, for
+// homeservers, bridges, and bots which use leaky buckets for rate limiting.
+package matrixlimit
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	leaky "github.com/t2bot/go-leaky-bucket"
+)
+
+// ErrCodeLimitExceeded is the Matrix error code for requests which were rate limited.
+const ErrCodeLimitExceeded = "M_LIMIT_EXCEEDED"
+
+// Error is the JSON body of a Matrix error response.
+type Error struct {
+	// ErrCode is the Matrix error code, such as ErrCodeLimitExceeded.
+	ErrCode string `json:"errcode"`
+
+	// Message is the human-readable error message.
+	Message string `json:"error"`
+
+	// RetryAfterMs is how many milliseconds the client should wait before retrying. It is zero if the
+	// client should not retry.
+	RetryAfterMs int64 `json:"retry_after_ms,omitempty"`
+}
+
+// NewError returns the M_LIMIT_EXCEEDED error for a request rejected with the given error, such as from
+// Bucket.Add. retry_after_ms is set from the bucket's drain schedule when the error is a
+// *leaky.BucketFullError, rounded up to whole milliseconds. If the error is not leaky.ErrBucketFull, false
+// is returned.
+//
+// Example usage:
+//
+//	if err := bucket.Add(1); err != nil {
+//		if limitErr, ok := matrixlimit.NewError(err); ok {
+//			limitErr.Write(w)
+//			return
+//		}
+//	}
+//
+// Parameters:
+//
+//	err - the error which rejected the request
+//
+// Return values:
+//
+//	*Error  - the Matrix error
+//	bool    - whether the error was a rate limit error
+func NewError(err error) (*Error, bool) {
+	var fullErr *leaky.BucketFullError
+	if errors.As(err, &fullErr) {
+		return RetryAfterError(fullErr.RetryAfter), true
+	}
+	if errors.Is(err, leaky.ErrBucketFull) {
+		return RetryAfterError(0), true
+	}
+	return nil, false
+}
+
+// RetryAfterError returns an M_LIMIT_EXCEEDED error which asks the client to retry after the given delay,
+// rounded up to whole milliseconds. If retryAfter is zero or less, retry_after_ms is omitted.
+func RetryAfterError(retryAfter time.Duration) *Error {
+	e := &Error{
+		ErrCode: ErrCodeLimitExceeded,
+		Message: "Too many requests",
+	}
+	if retryAfter > 0 {
+		e.RetryAfterMs = int64(math.Ceil(float64(retryAfter) / float64(time.Millisecond)))
+	}
+	return e
+}
+
+// Error returns the error code and message, implementing the error interface.
+func (e *Error) Error() string {
+	return e.ErrCode + ": " + e.Message
+}
+
+// RetryAfter returns the delay requested by the error, and false if it did not request one.
+func (e *Error) RetryAfter() (time.Duration, bool) {
+	if e.RetryAfterMs <= 0 {
+		return 0, false
+	}
+	if e.RetryAfterMs > math.MaxInt64/int64(time.Millisecond) {
+		return time.Duration(math.MaxInt64), true
+	}
+	return time.Duration(e.RetryAfterMs) * time.Millisecond, true
+}
+
+// Write writes the error as a 429 Too Many Requests response. A Retry-After header, in whole seconds
+// rounded up, is included alongside retry_after_ms when a delay is set.
+func (e *Error) Write(w http.ResponseWriter) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		panic(err) // not possible with this type
+	}
+	if retryAfter, ok := e.RetryAfter(); ok {
+		seconds := int64(math.Ceil(retryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.FormatInt(max(seconds, 1), 10))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	_, _ = w.Write(body)
+}
+
+// DeniedHandler writes an M_LIMIT_EXCEEDED response. It can be used with httplimit.WithDeniedHandler.
+func DeniedHandler(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	RetryAfterError(retryAfter).Write(w)
+}
+
+// ParseError parses an M_LIMIT_EXCEEDED error from a response body. If the body is not a Matrix error
+// with that code, false is returned.
+func ParseError(body []byte) (*Error, bool) {
+	e := &Error{}
+	if err := json.Unmarshal(body, e); err != nil || e.ErrCode != ErrCodeLimitExceeded {
+		return nil, false
+	}
+	return e, true
+}
+
+// maxBodySize is the most ParseResponse will read of a response body.
+const maxBodySize = 64 * 1024
+
+// ParseResponse parses an M_LIMIT_EXCEEDED error from an HTTP response. If the response is not a 429, or
+// its body is not an M_LIMIT_EXCEEDED error, false is returned. If the body has no retry_after_ms but the
+// response has a Retry-After header in seconds, the header is used instead.
+//
+// The response body is read but not closed.
+func ParseResponse(resp *http.Response) (*Error, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return nil, false
+	}
+	e, ok := ParseError(body)
+	if !ok {
+		return nil, false
+	}
+	if e.RetryAfterMs <= 0 {
+		if seconds, err := strconv.ParseInt(resp.Header.Get("Retry-After"), 10, 64); err == nil && seconds > 0 {
+			e.RetryAfterMs = seconds * 1000
+			if seconds > math.MaxInt64/1000 {
+				e.RetryAfterMs = math.MaxInt64
+			}
+		}
+	}
+	return e, true
+}
+
+// Apply adjusts the given bucket to match the server's rate limit, so that nothing more is added to it
+// until the requested delay has passed. It returns false, leaving the bucket unchanged, if the error did
+// not request a delay. See leaky.Bucket.Backoff.
+//
+// Example usage:
+//
+//	resp, err := client.Do(req)
+//	if err != nil {
+//		return err
+//	}
+//	defer resp.Body.Close()
+//	if limitErr, ok := matrixlimit.ParseResponse(resp); ok {
+//		limitErr.Apply(bucket)
+//		return bucket.Wait(ctx, 1) // then retry
+//	}
+func (e *Error) Apply(bucket *leaky.Bucket) bool {
+	retryAfter, ok := e.RetryAfter()
+	if !ok {
+		return false
+	}
+	bucket.Backoff(retryAfter)
+	return true
+}
@@ -0,0 +1,156 @@
+package matrixlimit
+
+import (
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	leaky "github.com/t2bot/go-leaky-bucket"
+	"github.com/t2bot/go-leaky-bucket/httplimit"
+)
+
+func TestNewError(t *testing.T) {
+	e, ok := NewError(&leaky.BucketFullError{RetryAfter: 1500*time.Millisecond + 1})
+	assert.True(t, ok)
+	assert.Equal(t, &Error{ErrCode: "M_LIMIT_EXCEEDED", Message: "Too many requests", RetryAfterMs: 1501}, e)
+	assert.EqualError(t, e, "M_LIMIT_EXCEEDED: Too many requests")
+
+	e, ok = NewError(leaky.ErrBucketFull)
+	assert.True(t, ok)
+	assert.Equal(t, &Error{ErrCode: "M_LIMIT_EXCEEDED", Message: "Too many requests"}, e)
+
+	_, ok = NewError(errors.New("other"))
+	assert.False(t, ok)
+	_, ok = NewError(nil)
+	assert.False(t, ok)
+}
+
+func TestError_RetryAfter(t *testing.T) {
+	retryAfter, ok := (&Error{RetryAfterMs: 1500}).RetryAfter()
+	assert.True(t, ok)
+	assert.Equal(t, 1500*time.Millisecond, retryAfter)
+
+	retryAfter, ok = (&Error{RetryAfterMs: math.MaxInt64}).RetryAfter()
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(math.MaxInt64), retryAfter)
+
+	_, ok = (&Error{}).RetryAfter()
+	assert.False(t, ok)
+	_, ok = (&Error{RetryAfterMs: -1}).RetryAfter()
+	assert.False(t, ok)
+}
+
+func TestError_Write(t *testing.T) {
+	w := httptest.NewRecorder()
+	RetryAfterError(1500 * time.Millisecond).Write(w)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests","retry_after_ms":1500}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	RetryAfterError(0).Write(w)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "", w.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests"}`, w.Body.String())
+}
+
+func TestDeniedHandler(t *testing.T) {
+	clock := leaky.NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	registry, err := leaky.NewRegistry(leaky.Config{
+		DrainBy:       1,
+		DrainInterval: 250 * time.Millisecond,
+		Capacity:      1,
+	}, time.Hour, leaky.WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestDeniedHandler: unexpected error %v", err)
+	}
+	middleware, err := httplimit.NewMiddleware(registry, httplimit.WithDeniedHandler(DeniedHandler))
+	if err != nil {
+		t.Fatalf("TestDeniedHandler: unexpected error %v", err)
+	}
+	handler := middleware.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	r := httptest.NewRequest("GET", "/_matrix/client/v3/sync", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.JSONEq(t, `{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests","retry_after_ms":250}`, w.Body.String())
+}
+
+func TestParseError(t *testing.T) {
+	e, ok := ParseError([]byte(`{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests","retry_after_ms":2000}`))
+	assert.True(t, ok)
+	assert.Equal(t, &Error{ErrCode: "M_LIMIT_EXCEEDED", Message: "Too many requests", RetryAfterMs: 2000}, e)
+
+	_, ok = ParseError([]byte(`{"errcode":"M_FORBIDDEN","error":"Forbidden"}`))
+	assert.False(t, ok)
+	_, ok = ParseError([]byte(`not json`))
+	assert.False(t, ok)
+}
+
+func TestParseResponse(t *testing.T) {
+	response := func(status int, retryAfter string, body string) *http.Response {
+		resp := &http.Response{
+			StatusCode: status,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader(body)),
+		}
+		if retryAfter != "" {
+			resp.Header.Set("Retry-After", retryAfter)
+		}
+		return resp
+	}
+
+	e, ok := ParseResponse(response(429, "5", `{"errcode":"M_LIMIT_EXCEEDED","error":"Slow down","retry_after_ms":1234}`))
+	assert.True(t, ok)
+	assert.Equal(t, int64(1234), e.RetryAfterMs)
+
+	// Falls back to Retry-After
+	e, ok = ParseResponse(response(429, "5", `{"errcode":"M_LIMIT_EXCEEDED","error":"Slow down"}`))
+	assert.True(t, ok)
+	assert.Equal(t, int64(5000), e.RetryAfterMs)
+	e, ok = ParseResponse(response(429, "Wed, 21 Oct 2015 07:28:00 GMT", `{"errcode":"M_LIMIT_EXCEEDED","error":"Slow down"}`))
+	assert.True(t, ok)
+	assert.Equal(t, int64(0), e.RetryAfterMs)
+
+	_, ok = ParseResponse(response(200, "", `{"errcode":"M_LIMIT_EXCEEDED","error":"Slow down"}`))
+	assert.False(t, ok)
+	_, ok = ParseResponse(response(429, "5", `{"errcode":"M_UNKNOWN","error":"Oops"}`))
+	assert.False(t, ok)
+}
+
+func TestError_Apply(t *testing.T) {
+	clock := leaky.NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	bucket, err := leaky.NewBucketFromConfig(leaky.Config{
+		DrainBy:       1,
+		DrainInterval: time.Second,
+		Capacity:      10,
+	}, leaky.WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestError_Apply: unexpected error %v", err)
+	}
+
+	assert.False(t, (&Error{ErrCode: ErrCodeLimitExceeded}).Apply(bucket))
+	assert.Equal(t, int64(0), bucket.Peek())
+
+	assert.True(t, (&Error{ErrCode: ErrCodeLimitExceeded, RetryAfterMs: 2500}).Apply(bucket))
+	var fullErr *leaky.BucketFullError
+	assert.ErrorAs(t, bucket.Add(1), &fullErr)
+	assert.Equal(t, 3*time.Second, fullErr.RetryAfter)
+
+	clock.Advance(3 * time.Second)
+	assert.Nil(t, bucket.Add(1))
+}
@@ -0,0 +1,199 @@
+// Package netlimit provides net.Listener and net.Conn wrappers which limit throughput and the rate of
+// accepted connections using leaky buckets.
+package netlimit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+
+	leaky "github.com/t2bot/go-leaky-bucket"
+)
+
+// Conn is a net.Conn whose reads and writes are charged against up to two buckets, one byte per unit:
+// a bucket shared with other connections, and one for this connection alone. Reads and writes block until
+// both buckets have room, or the connection is closed.
+//
+// Waiting for a bucket does not respect the connection's deadlines.
+type Conn struct {
+	net.Conn
+
+	bucket *leaky.Bucket
+	reader io.Reader
+	writer io.Writer
+	cancel context.CancelFunc
+}
+
+// NewConn wraps the given connection so that reads and writes are charged against the given buckets.
+// Either bucket may be nil to disable it. This can be used for outgoing connections, which are not
+// accepted from a Listener.
+//
+// Example usage:
+//
+//	conn, err := net.Dial("tcp", "example.org:443")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	conn = netlimit.NewConn(conn, globalBucket, nil)
+//
+// Parameters:
+//
+//	conn    - the connection to wrap
+//	shared  - the bucket shared with other connections, or nil
+//	bucket  - the bucket for this connection only, or nil
+//
+// Return values:
+//
+//	*Conn   - the created Conn instance
+func NewConn(conn net.Conn, shared *leaky.Bucket, bucket *leaky.Bucket) *Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	var reader io.Reader = conn
+	var writer io.Writer = conn
+	for _, b := range []*leaky.Bucket{shared, bucket} {
+		if b != nil {
+			reader = leaky.NewReaderContext(ctx, reader, b)
+			writer = leaky.NewWriterContext(ctx, writer, b)
+		}
+	}
+	return &Conn{
+		Conn:   conn,
+		bucket: bucket,
+		reader: reader,
+		writer: writer,
+		cancel: cancel,
+	}
+}
+
+// Bucket returns the bucket for this connection only, or nil if there is none.
+func (c *Conn) Bucket() *leaky.Bucket {
+	return c.bucket
+}
+
+// Read reads from the connection, then waits for the buckets to have room for the bytes read.
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// Write waits for the buckets to have room, then writes to the connection. Large writes are split into
+// chunks no larger than the buckets' capacities.
+func (c *Conn) Write(p []byte) (int, error) {
+	return c.writer.Write(p)
+}
+
+// Close closes the connection, unblocking any reads or writes waiting for the buckets.
+func (c *Conn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+// Listener is a net.Listener which returns connections wrapped in a Conn, and optionally limits the rate
+// at which connections are accepted.
+type Listener struct {
+	net.Listener
+
+	shared     *leaky.Bucket
+	connConfig *leaky.Config
+	connOpts   []leaky.Option
+	accept     *leaky.Bucket
+}
+
+// Option configures a Listener.
+type Option func(l *Listener)
+
+// WithSharedBucket charges the reads and writes of every accepted connection against the given bucket,
+// capping the listener's total throughput.
+func WithSharedBucket(bucket *leaky.Bucket) Option {
+	return func(l *Listener) {
+		l.shared = bucket
+	}
+}
+
+// WithConnConfig creates a bucket from the given config and options for each accepted connection, capping
+// the throughput of each connection.
+func WithConnConfig(config leaky.Config, opts ...leaky.Option) Option {
+	return func(l *Listener) {
+		l.connConfig = &config
+		l.connOpts = opts
+	}
+}
+
+// WithAcceptBucket adds 1 to the given bucket for each accepted connection. Connections which arrive while
+// the bucket is full are closed immediately, without being returned by Accept.
+func WithAcceptBucket(bucket *leaky.Bucket) Option {
+	return func(l *Listener) {
+		l.accept = bucket
+	}
+}
+
+// NewListener wraps the given listener, applying the given options to accepted connections.
+//
+// Example usage:
+//
+//	inner, err := net.Listen("tcp", ":8080")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	// 10 MiB/s in total, 1 MiB/s per connection, and 10 new connections per second
+//	shared, _ := leaky.NewBucket(10*1024*1024, time.Second, 10*1024*1024)
+//	accept, _ := leaky.NewBucket(10, time.Second, 10)
+//	listener, err := netlimit.NewListener(inner,
+//		netlimit.WithSharedBucket(shared),
+//		netlimit.WithConnConfig(leaky.Config{
+//			DrainBy:       1024 * 1024,
+//			DrainInterval: time.Second,
+//			Capacity:      1024 * 1024,
+//		}),
+//		netlimit.WithAcceptBucket(accept))
+//
+// Parameters:
+//
+//	listener    - the listener to wrap
+//	opts        - the options to apply to the listener
+//
+// Return values:
+//
+//	*Listener   - the created Listener instance
+//	error       - error message if the listener or options are invalid
+func NewListener(listener net.Listener, opts ...Option) (*Listener, error) {
+	if listener == nil {
+		return nil, errors.New("netlimit: listener cannot be nil")
+	}
+	l := &Listener{
+		Listener: listener,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if l.connConfig != nil {
+		// Catch invalid configs and options now rather than on each Accept
+		if _, err := leaky.NewBucketFromConfig(*l.connConfig, l.connOpts...); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Accept waits for and returns the next connection which is allowed by the accept bucket, wrapped in a
+// Conn.
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.accept != nil && l.accept.Add(1) != nil {
+			_ = conn.Close()
+			continue
+		}
+
+		var bucket *leaky.Bucket
+		if l.connConfig != nil {
+			if bucket, err = leaky.NewBucketFromConfig(*l.connConfig, l.connOpts...); err != nil {
+				_ = conn.Close()
+				return nil, err // validated by NewListener
+			}
+		}
+		return NewConn(conn, l.shared, bucket), nil
+	}
+}
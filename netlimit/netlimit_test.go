@@ -0,0 +1,197 @@
+package netlimit
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	leaky "github.com/t2bot/go-leaky-bucket"
+	"github.com/t2bot/go-leaky-bucket/internal/leakytest"
+)
+
+func newTestBucket(t *testing.T, clock leaky.Clock, capacity int64) *leaky.Bucket {
+	bucket, err := leaky.NewBucketFromConfig(leaky.Config{
+		DrainBy:       capacity,
+		DrainInterval: time.Second,
+		Capacity:      capacity,
+	}, leaky.WithClock(clock))
+	if err != nil {
+		t.Fatalf("newTestBucket: unexpected error %v", err)
+	}
+	return bucket
+}
+
+type ioResult struct {
+	n   int
+	err error
+}
+
+func TestConn(t *testing.T) {
+	clock := leaky.NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	shared := newTestBucket(t, clock, 10)
+	bucket := newTestBucket(t, clock, 4)
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := NewConn(server, shared, bucket)
+	defer conn.Close()
+	assert.Same(t, bucket, conn.Bucket())
+
+	// Writes are charged to both buckets, waiting for the smaller one
+	received := make(chan []byte)
+	go func() {
+		buf := make([]byte, 6)
+		_, _ = io.ReadFull(client, buf)
+		received <- buf
+	}()
+	done := make(chan ioResult)
+	go func() {
+		n, err := conn.Write([]byte("abcdef"))
+		done <- ioResult{n, err}
+	}()
+	leakytest.WaitForTimers(t, clock, 1)
+	assert.Equal(t, int64(4), bucket.Peek())
+	assert.Equal(t, int64(4), shared.Peek())
+	clock.Advance(time.Second)
+	select {
+	case result := <-done:
+		assert.Nil(t, result.err)
+		assert.Equal(t, 6, result.n)
+	case <-time.After(time.Second):
+		t.Fatal("TestConn: write did not return after drain")
+	}
+	assert.Equal(t, []byte("abcdef"), <-received)
+	assert.Equal(t, int64(2), bucket.Peek())
+	assert.Equal(t, int64(2), shared.Peek())
+
+	// Reads are too
+	go func() {
+		_, _ = client.Write([]byte("xy"))
+	}()
+	buf := make([]byte, 10)
+	n, err := conn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "xy", string(buf[:n]))
+	assert.Equal(t, int64(4), bucket.Peek())
+	assert.Equal(t, int64(4), shared.Peek())
+
+	// Closing unblocks waiting writes
+	go func() {
+		n, err := conn.Write([]byte("z"))
+		done <- ioResult{n, err}
+	}()
+	leakytest.WaitForTimers(t, clock, 1)
+	assert.Nil(t, conn.Close())
+	select {
+	case result := <-done:
+		assert.ErrorIs(t, result.err, context.Canceled)
+		assert.Equal(t, 0, result.n)
+	case <-time.After(time.Second):
+		t.Fatal("TestConn: write did not return after close")
+	}
+}
+
+func TestConn_NoBuckets(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := NewConn(server, nil, nil)
+	defer conn.Close()
+	assert.Nil(t, conn.Bucket())
+
+	go func() {
+		_, _ = client.Write([]byte("hello"))
+	}()
+	buf := make([]byte, 10)
+	n, err := conn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+}
+
+func TestNewListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestNewListener: unexpected error %v", err)
+	}
+	defer inner.Close()
+
+	_, err = NewListener(nil)
+	assert.EqualError(t, err, "netlimit: listener cannot be nil")
+
+	_, err = NewListener(inner, WithConnConfig(leaky.Config{}))
+	assert.EqualError(t, err, "leaky: bucket never drains")
+
+	_, err = NewListener(inner, WithConnConfig(leaky.Config{DrainBy: 1, DrainInterval: time.Second, Capacity: 1}, leaky.WithClock(nil)))
+	assert.EqualError(t, err, "leaky: clock cannot be nil")
+
+	listener, err := NewListener(inner)
+	assert.Nil(t, err)
+	assert.Equal(t, inner.Addr(), listener.Addr())
+}
+
+func TestListener_Accept(t *testing.T) {
+	clock := leaky.NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	shared := newTestBucket(t, clock, 100)
+	accept := newTestBucket(t, clock, 1)
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestListener_Accept: unexpected error %v", err)
+	}
+	config := leaky.Config{DrainBy: 10, DrainInterval: time.Second, Capacity: 10}
+	listener, err := NewListener(inner,
+		WithSharedBucket(shared),
+		WithConnConfig(config, leaky.WithClock(clock)),
+		WithAcceptBucket(accept))
+	if err != nil {
+		t.Fatalf("TestListener_Accept: unexpected error %v", err)
+	}
+	defer listener.Close()
+
+	// Each accepted connection greets the client
+	accepted := make(chan *Conn, 3)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			_, _ = conn.Write([]byte("hi"))
+			accepted <- conn.(*Conn)
+		}
+	}()
+	dial := func() string {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("TestListener_Accept: unexpected error %v", err)
+		}
+		defer conn.Close()
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 2)
+		n, _ := io.ReadFull(conn, buf)
+		return string(buf[:n])
+	}
+
+	assert.Equal(t, "hi", dial())
+	first := <-accepted
+	assert.Equal(t, config, first.Bucket().Config())
+	assert.Equal(t, int64(2), first.Bucket().Peek())
+	assert.Equal(t, int64(2), shared.Peek())
+
+	// Over the accept rate, so closed without a greeting
+	assert.Equal(t, "", dial())
+
+	clock.Advance(time.Second)
+	assert.Equal(t, "hi", dial())
+	second := <-accepted
+	assert.NotSame(t, first.Bucket(), second.Bucket())
+	assert.Equal(t, int64(2), second.Bucket().Peek())
+	assert.Equal(t, int64(2), shared.Peek()) // drained by 100, then 2 added
+
+	_ = first.Close()
+	_ = second.Close()
+	assert.Nil(t, listener.Close())
+	_, ok := <-accepted
+	assert.False(t, ok)
+}
@@ -0,0 +1,271 @@
+package leaky
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Registry holds a Bucket for each of an arbitrary number of keys, such as user IDs or IP addresses.
+// Buckets are created on demand from a template Config, and evicted once they have fully drained or
+// have not been used for a while. It is safe for concurrent use.
+//
+// Recreating a fully drained bucket from the template is equivalent to having kept it. Idle eviction
+// however forgets any fill the bucket still held, so the key starts again with an empty bucket; choose a
+// TTL at least as long as a full bucket takes to drain if that matters. Callers which hold on to a *Bucket
+// from Get should not expect changes to it to be visible through the registry after it has been evicted.
+type Registry struct {
+	config  Config
+	ttl     time.Duration
+	opts    []Option
+	clock   Clock
+	buckets map[string]*registryEntry
+	lock    sync.Mutex
+}
+
+// Limiter adds to the bucket for a key. It is implemented by Registry and ShardedRegistry.
+type Limiter interface {
+	Add(key string, amount int64) error
+}
+
+type registryEntry struct {
+	bucket   *Bucket
+	lastUsed time.Time
+	inUse    atomic.Int32 // operations in progress through the registry, which prevent eviction
+}
+
+// NewRegistry creates a new Registry which creates buckets from the given config and options. Buckets
+// which have not been used for at least ttl are evicted, in addition to buckets which have fully drained.
+// A ttl of zero or less disables idle eviction.
+//
+// Eviction happens when Evict is called, or periodically after StartJanitor.
+//
+// Example usage:
+//
+//	registry, err := leaky.NewRegistry(leaky.Config{
+//		DrainBy:       5,
+//		DrainInterval: time.Minute,
+//		Capacity:      300,
+//	}, time.Hour)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	stop := registry.StartJanitor(time.Minute)
+//	defer stop()
+//
+//	if err = registry.Add(r.RemoteAddr, 1); errors.Is(err, leaky.ErrBucketFull) {
+//		w.WriteHeader(http.StatusTooManyRequests)
+//	}
+//
+// Parameters:
+//
+//	config  - the template for each bucket
+//	ttl     - how long a bucket can go unused before being evicted
+//	opts    - the options to apply to each bucket
+//
+// Return values:
+//
+//	*Registry   - the created Registry instance
+//	error       - error message if the config or options are invalid
+func NewRegistry(config Config, ttl time.Duration, opts ...Option) (*Registry, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Registry{
+		config:  config,
+		ttl:     ttl,
+		opts:    opts,
+		clock:   o.clock,
+		buckets: make(map[string]*registryEntry),
+		lock:    sync.Mutex{},
+	}, nil
+}
+
+// Config returns the template used to create buckets.
+func (r *Registry) Config() Config {
+	return r.config
+}
+
+// Get returns the bucket for the given key, creating it if needed. The bucket is marked as used.
+func (r *Registry) Get(key string) *Bucket {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.entryLocked(key).bucket
+}
+
+// acquire returns the entry for the given key, creating it if needed, and marks it as in use so that it
+// is not evicted. The caller must call release on the entry once done with it.
+func (r *Registry) acquire(key string) *registryEntry {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entry := r.entryLocked(key)
+	entry.inUse.Add(1)
+	return entry
+}
+
+// release marks an entry returned by acquire as no longer in use.
+func (e *registryEntry) release() {
+	e.inUse.Add(-1)
+}
+
+// entryLocked returns the entry for the given key, creating it if needed. The entry is marked as used.
+//
+// The caller must hold the registry's lock.
+func (r *Registry) entryLocked(key string) *registryEntry {
+	now := r.clock.Now()
+	if entry, ok := r.buckets[key]; ok {
+		entry.lastUsed = now
+		return entry
+	}
+
+	bucket, err := NewBucketFromConfig(r.config, r.opts...)
+	if err != nil {
+		panic(err) // validated by NewRegistry
+	}
+	entry := &registryEntry{
+		bucket:   bucket,
+		lastUsed: now,
+	}
+	r.buckets[key] = entry
+	return entry
+}
+
+// peek returns the bucket for the given key without creating it or marking it as used.
+func (r *Registry) peek(key string) (*Bucket, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if entry, ok := r.buckets[key]; ok {
+		return entry.bucket, true
+	}
+	return nil, false
+}
+
+// Add adds the specified amount to the bucket for the given key, creating the bucket if needed. The
+// bucket is not evicted while the amount is being added. See Bucket.Add for details.
+func (r *Registry) Add(key string, amount int64) error {
+	entry := r.acquire(key)
+	defer entry.release()
+	return entry.bucket.Add(amount)
+}
+
+// Wait adds the specified amount to the bucket for the given key, creating the bucket if needed, and
+// blocking until the bucket can accept it. The bucket is not evicted while waiting. See Bucket.Wait for
+// details.
+func (r *Registry) Wait(ctx context.Context, key string, amount int64) error {
+	entry := r.acquire(key)
+	defer entry.release()
+	err := entry.bucket.Wait(ctx, amount)
+
+	// Waiting may take longer than the TTL, so mark the bucket as used again now that it's done
+	r.lock.Lock()
+	entry.lastUsed = r.clock.Now()
+	r.lock.Unlock()
+	return err
+}
+
+// Use calls fn with the bucket for the given key, creating the bucket if needed. The bucket is not evicted
+// while fn runs, so changes made by fn are kept by the registry. fn must not hold on to the bucket after
+// returning.
+//
+// Example usage:
+//
+//	registry.Use(host, func(bucket *leaky.Bucket) {
+//		bucket.Backoff(retryAfter)
+//	})
+func (r *Registry) Use(key string, fn func(bucket *Bucket)) {
+	entry := r.acquire(key)
+	defer entry.release()
+	fn(entry.bucket)
+}
+
+// Value returns the value of the bucket for the given key after performing a drain operation. If
+// there is no bucket for the key, zero is returned and no bucket is created.
+func (r *Registry) Value(key string) int64 {
+	if bucket, ok := r.peek(key); ok {
+		return bucket.Value()
+	}
+	return 0
+}
+
+// Remaining returns the remaining capacity of the bucket for the given key after performing a drain
+// operation. If there is no bucket for the key, the template's Capacity is returned and no bucket is
+// created.
+func (r *Registry) Remaining(key string) int64 {
+	if bucket, ok := r.peek(key); ok {
+		return bucket.Remaining()
+	}
+	return r.config.Capacity
+}
+
+// Delete removes the bucket for the given key, if any.
+func (r *Registry) Delete(key string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.buckets, key)
+}
+
+// Len returns the number of buckets currently held by the registry.
+func (r *Registry) Len() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.buckets)
+}
+
+// Evict removes buckets which have fully drained, or have been idle for at least the registry's TTL.
+// Buckets which are being added to through the registry are kept. It returns the number of buckets
+// removed.
+func (r *Registry) Evict() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.clock.Now()
+	evicted := 0
+	for key, entry := range r.buckets {
+		if entry.inUse.Load() > 0 {
+			continue
+		}
+		if (r.ttl > 0 && now.Sub(entry.lastUsed) >= r.ttl) || entry.bucket.Value() == 0 {
+			delete(r.buckets, key)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// StartJanitor starts a goroutine which calls Evict every interval, using the registry's clock. The
+// returned function stops the goroutine, and may be called more than once.
+func (r *Registry) StartJanitor(interval time.Duration) (stop func()) {
+	return startJanitor(r.clock, interval, func() {
+		r.Evict()
+	})
+}
+
+// startJanitor calls evict every interval on a new goroutine until the returned function is called.
+func startJanitor(clock Clock, interval time.Duration, evict func()) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		for {
+			timer := clock.NewTimer(interval)
+			select {
+			case <-done:
+				timer.Stop()
+				return
+			case <-timer.C():
+				evict()
+			}
+		}
+	}()
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+}
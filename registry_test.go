@@ -0,0 +1,221 @@
+package leaky
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testRegistryConfig = Config{
+	DrainBy:       5,
+	DrainInterval: time.Minute,
+	Capacity:      300,
+	OverflowLimit: 10,
+}
+
+func TestNewRegistry(t *testing.T) {
+	var err error
+
+	_, err = NewRegistry(Config{}, time.Hour)
+	assert.EqualError(t, err, "leaky: bucket never drains")
+
+	_, err = NewRegistry(testRegistryConfig, time.Hour, WithClock(nil))
+	assert.EqualError(t, err, "leaky: clock cannot be nil")
+
+	registry, err := NewRegistry(testRegistryConfig, time.Hour)
+	assert.Nil(t, err)
+	assert.NotNil(t, registry)
+	assert.Equal(t, testRegistryConfig, registry.Config())
+	assert.Equal(t, 0, registry.Len())
+}
+
+func TestRegistry_Get(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	registry, err := NewRegistry(testRegistryConfig, time.Hour, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestRegistry_Get: unexpected error %v", err)
+	}
+
+	// Creates from the template
+	bucket := registry.Get("a")
+	assert.Equal(t, 1, registry.Len())
+	assert.Equal(t, testRegistryConfig.DrainBy, bucket.DrainBy)
+	assert.Equal(t, testRegistryConfig.DrainInterval, bucket.DrainInterval)
+	assert.Equal(t, testRegistryConfig.Capacity, bucket.Capacity)
+	assert.Equal(t, testRegistryConfig.OverflowLimit, bucket.OverflowLimit)
+	assert.Equal(t, Clock(clock), bucket.clock)
+
+	// Returns the same bucket for the same key
+	assert.Same(t, bucket, registry.Get("a"))
+	assert.NotSame(t, bucket, registry.Get("b"))
+	assert.Equal(t, 2, registry.Len())
+
+	registry.Delete("a")
+	assert.Equal(t, 1, registry.Len())
+	assert.NotSame(t, bucket, registry.Get("a"))
+}
+
+func TestRegistry_Add(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	registry, err := NewRegistry(testRegistryConfig, time.Hour, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestRegistry_Add: unexpected error %v", err)
+	}
+
+	// Doesn't create buckets when reading
+	assert.Equal(t, int64(0), registry.Value("a"))
+	assert.Equal(t, int64(300), registry.Remaining("a"))
+	assert.Equal(t, 0, registry.Len())
+
+	// Keys are independent
+	if err = registry.Add("a", 300); err != nil {
+		t.Errorf("TestRegistry_Add: unexpected Add error %v", err)
+	}
+	if err = registry.Add("b", 100); err != nil {
+		t.Errorf("TestRegistry_Add: unexpected Add error %v", err)
+	}
+	assert.Equal(t, int64(300), registry.Value("a"))
+	assert.Equal(t, int64(0), registry.Remaining("a"))
+	assert.Equal(t, int64(100), registry.Value("b"))
+	assert.Equal(t, int64(200), registry.Remaining("b"))
+	assert.ErrorIs(t, registry.Add("a", 11), ErrBucketFull)
+
+	// Drains like a bucket
+	clock.Advance(time.Minute)
+	assert.Equal(t, int64(295), registry.Value("a"))
+	assert.Equal(t, int64(95), registry.Value("b"))
+}
+
+func TestRegistry_Evict(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	registry, err := NewRegistry(testRegistryConfig, time.Hour, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestRegistry_Evict: unexpected error %v", err)
+	}
+
+	// Evicts empty buckets
+	registry.Get("empty")
+	if err = registry.Add("full", 300); err != nil {
+		t.Errorf("TestRegistry_Evict: unexpected Add error %v", err)
+	}
+	assert.Equal(t, 1, registry.Evict())
+	assert.Equal(t, 1, registry.Len())
+
+	// Evicts fully drained buckets
+	if err = registry.Add("drains", 5); err != nil {
+		t.Errorf("TestRegistry_Evict: unexpected Add error %v", err)
+	}
+	clock.Advance(time.Minute)
+	assert.Equal(t, 1, registry.Evict())
+	assert.Equal(t, 1, registry.Len())
+
+	// Evicts idle buckets, even if not drained
+	clock.Advance(58 * time.Minute)
+	assert.Equal(t, 0, registry.Evict())
+	clock.Advance(time.Minute)
+	assert.Equal(t, 1, registry.Evict())
+	assert.Equal(t, 0, registry.Len())
+
+	// Using a bucket resets its idle time
+	registry.Get("used").DrainBy = 1 // drains slower than the TTL
+	if err = registry.Add("used", 300); err != nil {
+		t.Errorf("TestRegistry_Evict: unexpected Add error %v", err)
+	}
+	clock.Advance(59 * time.Minute)
+	registry.Get("used")
+	clock.Advance(59 * time.Minute)
+	assert.Equal(t, 0, registry.Evict())
+
+	// Idle eviction can be disabled
+	registry, err = NewRegistry(testRegistryConfig, 0, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestRegistry_Evict: unexpected error %v", err)
+	}
+	registry.Get("idle").DrainBy = 0 // never drains
+	if err = registry.Add("idle", 300); err != nil {
+		t.Errorf("TestRegistry_Evict: unexpected Add error %v", err)
+	}
+	clock.Advance(24 * time.Hour)
+	assert.Equal(t, 0, registry.Evict())
+
+	// Buckets in use are kept, even when empty, so adds aren't lost
+	entry := registry.acquire("new")
+	assert.Equal(t, 0, registry.Evict())
+	if err = entry.bucket.Add(10); err != nil {
+		t.Errorf("TestRegistry_Evict: unexpected Add error %v", err)
+	}
+	entry.release()
+	assert.Equal(t, 0, registry.Evict())
+	assert.Equal(t, int64(10), registry.Value("new"))
+	clock.Advance(2 * time.Minute)
+	assert.Equal(t, 1, registry.Evict())
+}
+
+func TestRegistry_Wait(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	registry, err := NewRegistry(testRegistryConfig, time.Minute, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestRegistry_Wait: unexpected error %v", err)
+	}
+	if err = registry.Add("a", 310); err != nil {
+		t.Errorf("TestRegistry_Wait: unexpected Add error %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- registry.Wait(context.Background(), "a", 10)
+	}()
+	waitForTimers(t, clock, 1)
+
+	// The bucket is idle past the TTL, but kept while waiting
+	clock.Advance(time.Minute)
+	assert.Equal(t, 0, registry.Evict())
+	clock.Advance(time.Minute)
+	if err = <-done; err != nil {
+		t.Errorf("TestRegistry_Wait: unexpected Wait error %v", err)
+	}
+	assert.Equal(t, 0, registry.Evict())
+	assert.Equal(t, int64(310), registry.Value("a"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, registry.Wait(ctx, "a", 10), context.Canceled)
+}
+
+func TestRegistry_Use(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	registry, err := NewRegistry(testRegistryConfig, time.Hour, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestRegistry_Use: unexpected error %v", err)
+	}
+	registry.Use("a", func(bucket *Bucket) {
+		assert.Equal(t, 0, registry.Evict())
+		bucket.Raise(50)
+	})
+	assert.Equal(t, int64(50), registry.Value("a"))
+}
+
+func TestRegistry_StartJanitor(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	registry, err := NewRegistry(testRegistryConfig, time.Hour, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestRegistry_StartJanitor: unexpected error %v", err)
+	}
+
+	registry.Get("a")
+	stop := registry.StartJanitor(time.Minute)
+	waitForTimers(t, clock, 1)
+	clock.Advance(time.Minute)
+	waitForTimers(t, clock, 1) // rescheduled after evicting
+	assert.Equal(t, 0, registry.Len())
+
+	stop()
+	stop() // safe to call twice
+	deadline := time.Now().Add(time.Second)
+	for clock.Timers() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, 0, clock.Timers())
+}
@@ -0,0 +1,166 @@
+package leaky
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Reservation represents an amount which has been claimed from a Bucket ahead of time. The reserved
+// amount is added to the bucket immediately and behaves like any other fill: it drains over time and
+// counts towards the bucket's capacity. If the work the reservation was made for does not happen, the
+// reservation may be cancelled to return the amount to the bucket.
+//
+// Reservations may be made while the bucket is full. In that case, the reservation is future-dated and
+// Delay reports how long the caller should wait before acting on it.
+type Reservation struct {
+	bucket    *Bucket
+	amount    int64
+	timeToAct time.Time
+	start     int64 // units queued ahead of the reservation, as a position in the bucket's drain total
+	done      bool
+	lock      sync.Mutex
+}
+
+// Reserve claims the specified amount from the Bucket, returning a Reservation which may later be
+// committed or cancelled. A drain operation is performed before the reservation is made.
+//
+// Unlike Add, Reserve does not fail when the bucket is full. Instead, the amount is added regardless and
+// the reservation's Delay reports when the amount would have fit. This means the bucket may be filled
+// beyond Capacity and OverflowLimit, causing further Adds to be rejected until the reservations have
+// drained. ErrAmountTooLarge is returned if the amount could never fit in the bucket.
+//
+// Example usage:
+//
+//	reservation, err := bucket.Reserve(5)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	time.Sleep(reservation.Delay())
+//	if err = doWork(); err != nil {
+//		reservation.Cancel() // give the capacity back
+//	} else {
+//		reservation.Commit()
+//	}
+//
+// Parameters:
+//
+//	amount  - the amount to reserve; must not be negative
+//
+// Return values:
+//
+//	*Reservation    - the reservation for the amount
+//	error           - ErrAmountTooLarge if the amount can never fit, or an error if the amount is negative
+func (b *Bucket) Reserve(amount int64) (*Reservation, error) {
+	if amount < 0 {
+		return nil, errors.New("leaky: reservation amount cannot be negative")
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := b.now()
+	b.drainLocked(now) // always drain first
+
+	delay, ok := b.delay(amount, now)
+	if !ok {
+		return nil, ErrAmountTooLarge
+	}
+
+	r := &Reservation{
+		bucket:    b,
+		amount:    amount,
+		timeToAct: now.Add(delay),
+		start:     b.drained + b.value,
+		done:      false,
+		lock:      sync.Mutex{},
+	}
+	b.value += amount
+
+	// Reservations which have fully drained can no longer be refunded, so there's no need to track them.
+	// They drain in the order they were made, so they are always at the front of the queue.
+	i := 0
+	for i < len(b.reserved) && b.reserved[i].start+b.reserved[i].amount <= b.drained {
+		i++
+	}
+	b.reserved = append(b.reserved[i:], r)
+	return r, nil
+}
+
+// forget stops tracking the reservation as outstanding, moving the reservations made after it forward in
+// the queue by the refunded amount. The caller must hold the bucket's lock.
+func (r *Reservation) forget(refund int64) {
+	b := r.bucket
+	for i, other := range b.reserved {
+		if other == r {
+			for _, later := range b.reserved[i+1:] {
+				later.start -= refund
+			}
+			b.reserved = append(b.reserved[:i], b.reserved[i+1:]...)
+			return
+		}
+	}
+}
+
+// Amount returns the amount which was reserved.
+func (r *Reservation) Amount() int64 {
+	return r.amount
+}
+
+// Delay returns how long the caller should wait before acting on the reservation. This is zero if the
+// reservation could be satisfied immediately, or the reserved time has already passed.
+func (r *Reservation) Delay() time.Duration {
+	delay := r.timeToAct.Sub(r.bucket.now())
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+// Commit marks the reservation as used. Later calls to Cancel will not refund the reserved amount.
+func (r *Reservation) Commit() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.done {
+		return
+	}
+	r.done = true
+
+	r.bucket.lock.Lock()
+	defer r.bucket.lock.Unlock()
+	r.forget(0)
+}
+
+// Cancel returns the reserved amount to the bucket, if the reservation has not already been committed
+// or cancelled. A drain operation is performed before the amount is returned.
+//
+// Only the part of the reservation which has not yet drained is refunded. The bucket drains in the order
+// it was filled, so the reservation starts draining once everything which was in the bucket before it
+// has drained. For example, if a reservation of 10 was made while the bucket held 5, and 8 units have
+// drained since, only 7 units are refunded. Cancelling a reservation moves the reservations made after it
+// forward in the queue, as though the cancelled amount had never been added.
+func (r *Reservation) Cancel() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.done {
+		return
+	}
+	r.done = true
+
+	b := r.bucket
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.drainLocked(b.now()) // always drain first
+
+	consumed := b.drained - r.start
+	if consumed < 0 {
+		consumed = 0
+	}
+	refund := max(min(r.amount-consumed, b.value), 0)
+	b.value -= refund
+
+	// The drain total is deliberately left alone, as nothing ahead of the reservation was drained. Instead,
+	// everything reserved after this reservation is now that much closer to the front of the queue.
+	r.forget(refund)
+}
@@ -0,0 +1,241 @@
+package leaky
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucket_Reserve(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	bucket, err := NewBucketWithOptions(5, time.Minute, 300, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestBucket_Reserve: unexpected error %v", err)
+	}
+
+	// Can't reserve negative or impossible amounts
+	_, err = bucket.Reserve(-1)
+	assert.EqualError(t, err, "leaky: reservation amount cannot be negative")
+	_, err = bucket.Reserve(301)
+	assert.ErrorIs(t, err, ErrAmountTooLarge)
+	assert.Equal(t, int64(0), bucket.value)
+
+	// Reserves immediately when there's capacity
+	r, err := bucket.Reserve(100)
+	if err != nil {
+		t.Fatalf("TestBucket_Reserve: unexpected Reserve error %v", err)
+	}
+	assert.Equal(t, int64(100), r.Amount())
+	assert.Equal(t, time.Duration(0), r.Delay())
+	assert.Equal(t, int64(100), bucket.value)
+
+	// Reserved units behave like fill
+	assert.Equal(t, int64(200), bucket.Remaining())
+
+	// Future-dated when full
+	bucket.value = 300
+	r, err = bucket.Reserve(10)
+	if err != nil {
+		t.Fatalf("TestBucket_Reserve: unexpected Reserve error %v", err)
+	}
+	assert.Equal(t, 2*time.Minute, r.Delay())
+	assert.Equal(t, int64(310), bucket.value)
+	clock.Advance(time.Minute)
+	assert.Equal(t, time.Minute, r.Delay())
+	clock.Advance(time.Hour)
+	assert.Equal(t, time.Duration(0), r.Delay())
+}
+
+func TestReservation_Cancel(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	bucket, err := NewBucketWithOptions(4, time.Minute, 300, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestReservation_Cancel: unexpected error %v", err)
+	}
+
+	// Refunds the whole amount when nothing has drained
+	bucket.value = 5
+	r, err := bucket.Reserve(10)
+	if err != nil {
+		t.Fatalf("TestReservation_Cancel: unexpected Reserve error %v", err)
+	}
+	assert.Equal(t, int64(15), bucket.value)
+	r.Cancel()
+	assert.Equal(t, int64(5), bucket.value)
+
+	// Only once
+	r.Cancel()
+	assert.Equal(t, int64(5), bucket.value)
+
+	// Refunds only what hasn't drained, after what was in the bucket first
+	r, err = bucket.Reserve(10)
+	if err != nil {
+		t.Fatalf("TestReservation_Cancel: unexpected Reserve error %v", err)
+	}
+	clock.Advance(2 * time.Minute) // drains 8 units: 5 from before, 3 from the reservation
+	r.Cancel()
+	assert.Equal(t, int64(0), bucket.value)
+
+	// Later fill is not refunded
+	r, err = bucket.Reserve(10)
+	if err != nil {
+		t.Fatalf("TestReservation_Cancel: unexpected Reserve error %v", err)
+	}
+	if err = bucket.Add(20); err != nil {
+		t.Errorf("TestReservation_Cancel: unexpected Add error %v", err)
+	}
+	clock.Advance(time.Minute) // drains 4 units of the reservation
+	r.Cancel()
+	assert.Equal(t, int64(20), bucket.value)
+
+	// Nothing to refund once fully drained
+	bucket.value = 0
+	r, err = bucket.Reserve(10)
+	if err != nil {
+		t.Fatalf("TestReservation_Cancel: unexpected Reserve error %v", err)
+	}
+	clock.Advance(time.Hour)
+	r.Cancel()
+	assert.Equal(t, int64(0), bucket.value)
+}
+
+func TestReservation_Commit(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	bucket, err := NewBucketWithOptions(5, time.Minute, 300, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestReservation_Commit: unexpected error %v", err)
+	}
+
+	r, err := bucket.Reserve(10)
+	if err != nil {
+		t.Fatalf("TestReservation_Commit: unexpected Reserve error %v", err)
+	}
+	r.Commit()
+	r.Cancel()
+	assert.Equal(t, int64(10), bucket.value)
+}
+
+func TestReservation_CancelOrder(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	bucket, err := NewBucketWithOptions(5, time.Minute, 300, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestReservation_CancelOrder: unexpected error %v", err)
+	}
+
+	// Cancelling in reverse order refunds everything
+	a, err := bucket.Reserve(10)
+	if err != nil {
+		t.Fatalf("TestReservation_CancelOrder: unexpected Reserve error %v", err)
+	}
+	b, err := bucket.Reserve(10)
+	if err != nil {
+		t.Fatalf("TestReservation_CancelOrder: unexpected Reserve error %v", err)
+	}
+	b.Cancel()
+	assert.Equal(t, int64(10), bucket.Value())
+	a.Cancel()
+	assert.Equal(t, int64(0), bucket.Value())
+
+	// Cancelling in order moves later reservations to the front of the queue
+	a, err = bucket.Reserve(10)
+	if err != nil {
+		t.Fatalf("TestReservation_CancelOrder: unexpected Reserve error %v", err)
+	}
+	b, err = bucket.Reserve(10)
+	if err != nil {
+		t.Fatalf("TestReservation_CancelOrder: unexpected Reserve error %v", err)
+	}
+	if err = bucket.Add(10); err != nil {
+		t.Fatalf("TestReservation_CancelOrder: unexpected Add error %v", err)
+	}
+	a.Cancel()
+	assert.Equal(t, int64(20), bucket.Value())
+	clock.Advance(time.Minute) // drains 5 units of the second reservation
+	b.Cancel()
+	assert.Equal(t, int64(10), bucket.Value())
+
+	// Committed reservations are not refunded, but don't hold up later ones
+	bucket.value = 0
+	a, err = bucket.Reserve(10)
+	if err != nil {
+		t.Fatalf("TestReservation_CancelOrder: unexpected Reserve error %v", err)
+	}
+	b, err = bucket.Reserve(10)
+	if err != nil {
+		t.Fatalf("TestReservation_CancelOrder: unexpected Reserve error %v", err)
+	}
+	a.Commit()
+	b.Cancel()
+	assert.Equal(t, int64(10), bucket.Value())
+	assert.Empty(t, bucket.reserved)
+}
+
+func TestReservation_CancelAfterReplace(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	bucket, err := NewBucketWithOptions(10, time.Minute, 300, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestReservation_CancelAfterReplace: unexpected error %v", err)
+	}
+
+	// Set removes the reservation along with everything ahead of it
+	if err = bucket.Add(100); err != nil {
+		t.Fatalf("TestReservation_CancelAfterReplace: unexpected Add error %v", err)
+	}
+	r, err := bucket.Reserve(50)
+	if err != nil {
+		t.Fatalf("TestReservation_CancelAfterReplace: unexpected Reserve error %v", err)
+	}
+	if err = bucket.Set(0); err != nil {
+		t.Fatalf("TestReservation_CancelAfterReplace: unexpected Set error %v", err)
+	}
+	if err = bucket.Add(200); err != nil {
+		t.Fatalf("TestReservation_CancelAfterReplace: unexpected Add error %v", err)
+	}
+	clock.Advance(5 * time.Minute)
+	assert.Equal(t, int64(150), bucket.Value())
+	r.Cancel()
+	assert.Equal(t, int64(150), bucket.Value())
+
+	// Lowering with Set removes what is ahead of the reservation first, so it is still refunded in full
+	r, err = bucket.Reserve(50)
+	if err != nil {
+		t.Fatalf("TestReservation_CancelAfterReplace: unexpected Reserve error %v", err)
+	}
+	if err = bucket.Set(180); err != nil {
+		t.Fatalf("TestReservation_CancelAfterReplace: unexpected Set error %v", err)
+	}
+	r.Cancel()
+	assert.Equal(t, int64(130), bucket.Value())
+
+	// Replacing the state forgets outstanding reservations
+	state := &bytes.Buffer{}
+	if err = bucket.EncodeState(state); err != nil {
+		t.Fatalf("TestReservation_CancelAfterReplace: unexpected EncodeState error %v", err)
+	}
+	r, err = bucket.Reserve(50)
+	if err != nil {
+		t.Fatalf("TestReservation_CancelAfterReplace: unexpected Reserve error %v", err)
+	}
+	if err = DecodeStateInto(state, bucket); err != nil {
+		t.Fatalf("TestReservation_CancelAfterReplace: unexpected DecodeStateInto error %v", err)
+	}
+	r.Cancel()
+	assert.Equal(t, int64(130), bucket.Value())
+
+	data, err := bucket.MarshalJSON()
+	if err != nil {
+		t.Fatalf("TestReservation_CancelAfterReplace: unexpected MarshalJSON error %v", err)
+	}
+	r, err = bucket.Reserve(50)
+	if err != nil {
+		t.Fatalf("TestReservation_CancelAfterReplace: unexpected Reserve error %v", err)
+	}
+	if err = bucket.UnmarshalJSON(data); err != nil {
+		t.Fatalf("TestReservation_CancelAfterReplace: unexpected UnmarshalJSON error %v", err)
+	}
+	r.Cancel()
+	assert.Equal(t, int64(130), bucket.Value())
+	assert.Empty(t, bucket.reserved)
+}
@@ -0,0 +1,130 @@
+package leaky
+
+import (
+	"context"
+	"errors"
+	"hash/maphash"
+	"time"
+)
+
+// ShardedRegistry spreads keys across a number of independent Registry shards, reducing lock contention
+// when many keys are accessed concurrently. Each key always maps to the same shard, so per-key behaviour
+// is the same as a single Registry. It is safe for concurrent use.
+type ShardedRegistry struct {
+	shards []*Registry
+	seed   maphash.Seed
+}
+
+// NewShardedRegistry creates a new ShardedRegistry with the given number of shards. Each shard is a
+// Registry created with the given config, ttl, and options. See NewRegistry for details.
+//
+// A good starting point for the shard count is a small multiple of GOMAXPROCS.
+//
+// Example usage:
+//
+//	registry, err := leaky.NewShardedRegistry(leaky.Config{
+//		DrainBy:       5,
+//		DrainInterval: time.Minute,
+//		Capacity:      300,
+//	}, time.Hour, 4*runtime.GOMAXPROCS(0))
+//
+// Parameters:
+//
+//	config  - the template for each bucket
+//	ttl     - how long a bucket can go unused before being evicted
+//	shards  - the number of shards to partition keys across
+//	opts    - the options to apply to each bucket
+//
+// Return values:
+//
+//	*ShardedRegistry    - the created ShardedRegistry instance
+//	error               - error message if the config, shard count, or options are invalid
+func NewShardedRegistry(config Config, ttl time.Duration, shards int, opts ...Option) (*ShardedRegistry, error) {
+	if shards <= 0 {
+		return nil, errors.New("leaky: shard count must be positive")
+	}
+	r := &ShardedRegistry{
+		shards: make([]*Registry, shards),
+		seed:   maphash.MakeSeed(),
+	}
+	for i := range r.shards {
+		shard, err := NewRegistry(config, ttl, opts...)
+		if err != nil {
+			return nil, err
+		}
+		r.shards[i] = shard
+	}
+	return r, nil
+}
+
+// shard returns the Registry responsible for the given key.
+func (r *ShardedRegistry) shard(key string) *Registry {
+	return r.shards[maphash.String(r.seed, key)%uint64(len(r.shards))]
+}
+
+// Config returns the template used to create buckets.
+func (r *ShardedRegistry) Config() Config {
+	return r.shards[0].Config()
+}
+
+// Get returns the bucket for the given key, creating it if needed. See Registry.Get.
+func (r *ShardedRegistry) Get(key string) *Bucket {
+	return r.shard(key).Get(key)
+}
+
+// Add adds the specified amount to the bucket for the given key. See Registry.Add.
+func (r *ShardedRegistry) Add(key string, amount int64) error {
+	return r.shard(key).Add(key, amount)
+}
+
+// Wait adds the specified amount to the bucket for the given key, blocking until it fits. See Registry.Wait.
+func (r *ShardedRegistry) Wait(ctx context.Context, key string, amount int64) error {
+	return r.shard(key).Wait(ctx, key, amount)
+}
+
+// Use calls fn with the bucket for the given key. See Registry.Use.
+func (r *ShardedRegistry) Use(key string, fn func(bucket *Bucket)) {
+	r.shard(key).Use(key, fn)
+}
+
+// Value returns the value of the bucket for the given key. See Registry.Value.
+func (r *ShardedRegistry) Value(key string) int64 {
+	return r.shard(key).Value(key)
+}
+
+// Remaining returns the remaining capacity of the bucket for the given key. See Registry.Remaining.
+func (r *ShardedRegistry) Remaining(key string) int64 {
+	return r.shard(key).Remaining(key)
+}
+
+// Delete removes the bucket for the given key, if any.
+func (r *ShardedRegistry) Delete(key string) {
+	r.shard(key).Delete(key)
+}
+
+// Len returns the number of buckets currently held across all shards.
+func (r *ShardedRegistry) Len() int {
+	total := 0
+	for _, shard := range r.shards {
+		total += shard.Len()
+	}
+	return total
+}
+
+// Evict evicts buckets from each shard in turn, returning the total number of buckets removed. See
+// Registry.Evict.
+func (r *ShardedRegistry) Evict() int {
+	total := 0
+	for _, shard := range r.shards {
+		total += shard.Evict()
+	}
+	return total
+}
+
+// StartJanitor starts a goroutine which calls Evict every interval, using the registry's clock. The
+// returned function stops the goroutine, and may be called more than once.
+func (r *ShardedRegistry) StartJanitor(interval time.Duration) (stop func()) {
+	return startJanitor(r.shards[0].clock, interval, func() {
+		r.Evict()
+	})
+}
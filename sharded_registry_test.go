@@ -0,0 +1,106 @@
+package leaky
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewShardedRegistry(t *testing.T) {
+	var err error
+
+	_, err = NewShardedRegistry(testRegistryConfig, time.Hour, 0)
+	assert.EqualError(t, err, "leaky: shard count must be positive")
+
+	_, err = NewShardedRegistry(Config{}, time.Hour, 4)
+	assert.EqualError(t, err, "leaky: bucket never drains")
+
+	registry, err := NewShardedRegistry(testRegistryConfig, time.Hour, 4)
+	assert.Nil(t, err)
+	assert.NotNil(t, registry)
+	assert.Len(t, registry.shards, 4)
+	assert.Equal(t, testRegistryConfig, registry.Config())
+}
+
+func TestShardedRegistry(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	registry, err := NewShardedRegistry(testRegistryConfig, time.Hour, 4, WithClock(clock))
+	if err != nil {
+		t.Fatalf("TestShardedRegistry: unexpected error %v", err)
+	}
+
+	// Keys consistently map to the same bucket
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		assert.Same(t, registry.Get(key), registry.Get(key))
+	}
+	assert.Equal(t, 100, registry.Len())
+
+	// Keys are spread across shards
+	for i, shard := range registry.shards {
+		assert.NotZerof(t, shard.Len(), "TestShardedRegistry(shard:%d)", i)
+	}
+
+	// Same per-key semantics as a Registry
+	if err = registry.Add("key-0", 300); err != nil {
+		t.Errorf("TestShardedRegistry: unexpected Add error %v", err)
+	}
+	assert.ErrorIs(t, registry.Add("key-0", 11), ErrBucketFull)
+	assert.Equal(t, int64(300), registry.Value("key-0"))
+	assert.Equal(t, int64(0), registry.Remaining("key-0"))
+	assert.Equal(t, int64(0), registry.Value("missing"))
+	assert.Equal(t, int64(300), registry.Remaining("missing"))
+
+	// Evicts across all shards
+	assert.Equal(t, 99, registry.Evict())
+	assert.Equal(t, 1, registry.Len())
+	registry.Delete("key-0")
+	assert.Equal(t, 0, registry.Len())
+
+	// Janitor evicts across all shards
+	registry.Get("key-0")
+	stop := registry.StartJanitor(time.Minute)
+	defer stop()
+	waitForTimers(t, clock, 1)
+	clock.Advance(time.Minute)
+	waitForTimers(t, clock, 1)
+	assert.Equal(t, 0, registry.Len())
+}
+
+func benchmarkKeyedAdd(b *testing.B, registry Limiter) {
+	keys := make([]string, 65536)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	next := atomic.Uint64{}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := next.Add(1) * 7919 // spread goroutines across the key space
+		for pb.Next() {
+			_ = registry.Add(keys[i%uint64(len(keys))], 1)
+			i++
+		}
+	})
+}
+
+// Run with `go test -bench KeyedAdd -cpu 1,2,4,8` to compare how throughput scales with GOMAXPROCS.
+func BenchmarkRegistry_KeyedAdd(b *testing.B) {
+	registry, err := NewRegistry(Config{DrainBy: 1, DrainInterval: time.Millisecond, Capacity: 1000000}, time.Hour)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkKeyedAdd(b, registry)
+}
+
+func BenchmarkShardedRegistry_KeyedAdd(b *testing.B) {
+	registry, err := NewShardedRegistry(Config{DrainBy: 1, DrainInterval: time.Millisecond, Capacity: 1000000}, time.Hour, 4*runtime.GOMAXPROCS(0))
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkKeyedAdd(b, registry)
+}
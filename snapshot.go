@@ -0,0 +1,131 @@
+package leaky
+
+import (
+	"errors"
+	"time"
+)
+
+// Snapshot is an immutable copy of a bucket's parameters and state at a point in time. Its methods are pure
+// functions which return a new Snapshot rather than modifying the receiver, so they can be used to
+// implement limiting on top of any store which supports compare-and-swap: load a snapshot, apply an
+// operation to it, and store the result only if the stored snapshot has not changed.
+//
+// Snapshots should be compared with Equal rather than ==, as the latter also compares the location of
+// LastDrain.
+type Snapshot struct {
+	// Config holds the parameters of the bucket.
+	Config Config
+
+	// Value is the value of the bucket as of LastDrain. It has not been drained since then.
+	Value int64
+
+	// LastDrain is the time the bucket was last drained. The zero time means the bucket has never been
+	// drained, which is the case for a new, empty bucket.
+	LastDrain time.Time
+}
+
+// Snapshot returns a copy of the bucket's parameters and state, without performing a drain.
+//
+// Example usage:
+//
+//	snapshot := bucket.Snapshot()
+//	next, err := snapshot.Add(1, time.Now())
+//	if err != nil {
+//		return err // includes ErrBucketFull
+//	}
+//	if !myStore.CompareAndSwap(key, snapshot, next) {
+//		// retry
+//	}
+//
+// Return values:
+//
+//	Snapshot    - the bucket's parameters and state
+func (b *Bucket) Snapshot() Snapshot {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return Snapshot{
+		Config:    b.config(),
+		Value:     b.value,
+		LastDrain: b.lastDrain,
+	}
+}
+
+// NewBucketFromSnapshot creates a new Bucket with the parameters and state in the given snapshot,
+// applying the given options to the bucket before it is returned. It returns an error if the snapshot's
+// config is invalid.
+//
+// Parameters:
+//
+//	snapshot    - the parameters and state for the bucket
+//	opts        - the options to apply to the bucket
+//
+// Return values:
+//
+//	*Bucket - the created Bucket instance
+//	error   - error message if the config or options are invalid
+func NewBucketFromSnapshot(snapshot Snapshot, opts ...Option) (*Bucket, error) {
+	bucket, err := NewBucketFromConfig(snapshot.Config, opts...)
+	if err != nil {
+		return nil, err
+	}
+	bucket.value = snapshot.Value
+	bucket.lastDrain = snapshot.LastDrain
+	return bucket, nil
+}
+
+// Equal reports whether the two snapshots have the same parameters and state.
+func (s Snapshot) Equal(other Snapshot) bool {
+	return s.Config == other.Config && s.Value == other.Value && s.LastDrain.Equal(other.LastDrain)
+}
+
+// Drained returns the snapshot after performing a drain operation at the given time.
+func (s Snapshot) Drained(now time.Time) Snapshot {
+	s.Value, s.LastDrain = s.Config.drain(s.Value, s.LastDrain, now)
+	return s
+}
+
+// Remaining returns the remaining capacity of the bucket after performing a drain operation at the given
+// time.
+//
+// Note that this may return a negative number if OverflowLimit is set.
+func (s Snapshot) Remaining(now time.Time) int64 {
+	return s.Config.Capacity - s.Drained(now).Value
+}
+
+// TimeToEmpty returns how long until the bucket will have fully drained, if nothing more is added, after
+// performing a drain operation at the given time.
+func (s Snapshot) TimeToEmpty(now time.Time) time.Duration {
+	s = s.Drained(now)
+	return s.Config.until(s.Value, s.LastDrain, now, 0)
+}
+
+// Add returns the snapshot after performing a drain operation and then adding the specified amount at the
+// given time, with the same semantics as Bucket.Add.
+//
+// If the amount cannot be added, the drained snapshot is returned along with the error, which is a
+// *BucketFullError or ErrBucketFull as for Bucket.Add. The drained snapshot may be stored, though this is
+// not required. An error is also returned if the snapshot's config is invalid.
+//
+// Parameters:
+//
+//	amount  - the amount to add to the bucket
+//	now     - the time at which to add it
+//
+// Return values:
+//
+//	Snapshot    - the new snapshot
+//	error       - error message if the amount cannot be added
+func (s Snapshot) Add(amount int64, now time.Time) (Snapshot, error) {
+	if err := s.Config.Validate(); err != nil {
+		return s, errors.Join(errors.New("leaky: invalid snapshot"), err)
+	}
+
+	s = s.Drained(now)
+	value, err := s.Config.add(s.Value, s.LastDrain, now, amount)
+	if err != nil {
+		return s, err
+	}
+	s.Value = value
+	return s, nil
+}
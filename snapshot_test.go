@@ -0,0 +1,148 @@
+package leaky
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucket_Snapshot(t *testing.T) {
+	for i, f := range createCaseFunctions {
+		bucket, err := f(5, time.Minute, 300)
+		if err != nil {
+			t.Fatalf("TestBucket_Snapshot(case:%d): unexpected error %v", i, err)
+		}
+		bucket.OverflowLimit = 10
+		bucket.Mode = DrainContinuous
+		assert.Nil(t, bucket.Add(42), "TestBucket_Snapshot(case:%d)", i)
+
+		snapshot := bucket.Snapshot()
+		assert.Equal(t, bucket.Config(), snapshot.Config, "TestBucket_Snapshot(case:%d)", i)
+		assert.Equal(t, int64(42), snapshot.Value, "TestBucket_Snapshot(case:%d)", i)
+		assert.Equal(t, bucket.lastDrain, snapshot.LastDrain, "TestBucket_Snapshot(case:%d)", i)
+
+		// Later changes to the bucket don't affect the snapshot
+		assert.Nil(t, bucket.Add(1), "TestBucket_Snapshot(case:%d)", i)
+		bucket.Capacity = 10
+		assert.Equal(t, int64(42), snapshot.Value, "TestBucket_Snapshot(case:%d)", i)
+		assert.Equal(t, int64(300), snapshot.Config.Capacity, "TestBucket_Snapshot(case:%d)", i)
+	}
+}
+
+func TestNewBucketFromSnapshot(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	snapshot := Snapshot{
+		Config:    testRegistryConfig,
+		Value:     100,
+		LastDrain: clock.Now().Add(-30 * time.Second),
+	}
+
+	_, err := NewBucketFromSnapshot(Snapshot{})
+	assert.EqualError(t, err, "leaky: bucket never drains")
+
+	bucket, err := NewBucketFromSnapshot(snapshot, WithClock(clock))
+	assert.Nil(t, err)
+	assert.True(t, snapshot.Equal(bucket.Snapshot()))
+	assert.Equal(t, Clock(clock), bucket.clock)
+
+	clock.Advance(30 * time.Second)
+	assert.Equal(t, int64(95), bucket.Value())
+}
+
+func TestSnapshot_Equal(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	snapshot := Snapshot{Config: testRegistryConfig, Value: 10, LastDrain: now}
+
+	assert.True(t, snapshot.Equal(snapshot))
+	assert.True(t, snapshot.Equal(Snapshot{Config: testRegistryConfig, Value: 10, LastDrain: now.In(time.FixedZone("X", 3600))}))
+	assert.False(t, snapshot.Equal(Snapshot{Config: testRegistryConfig, Value: 11, LastDrain: now}))
+	assert.False(t, snapshot.Equal(Snapshot{Config: testRegistryConfig, Value: 10, LastDrain: now.Add(1)}))
+	assert.False(t, snapshot.Equal(Snapshot{Config: Config{}, Value: 10, LastDrain: now}))
+}
+
+func TestSnapshot_Add(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	empty := Snapshot{Config: testRegistryConfig}
+
+	// Invalid config
+	_, err := Snapshot{}.Add(1, now)
+	assert.EqualError(t, err, "leaky: invalid snapshot\nleaky: bucket never drains")
+
+	// The receiver is not modified
+	next, err := empty.Add(300, now)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), empty.Value)
+	assert.Equal(t, int64(300), next.Value)
+	assert.Equal(t, now, next.LastDrain)
+
+	// Overflow
+	next, err = next.Add(10, now)
+	assert.Nil(t, err)
+	full, err := next.Add(1, now.Add(time.Minute))
+	var fullErr *BucketFullError
+	assert.ErrorAs(t, err, &fullErr)
+	assert.Equal(t, time.Minute, fullErr.RetryAfter)
+	assert.Equal(t, int64(305), full.Value) // drained
+	assert.Equal(t, now.Add(time.Minute), full.LastDrain)
+	_, err = next.Add(311, now)
+	assert.ErrorIs(t, err, ErrBucketFull)
+
+	// Drains, keeping unused time
+	drained := next.Drained(now.Add(90 * time.Second))
+	assert.Equal(t, int64(305), drained.Value)
+	assert.Equal(t, now.Add(time.Minute), drained.LastDrain)
+	assert.Equal(t, int64(-5), next.Remaining(now.Add(90*time.Second)))
+	assert.Equal(t, int64(-10), next.Remaining(now))
+}
+
+func TestSnapshot_TimeToEmpty(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	snapshot := Snapshot{Config: testRegistryConfig, Value: 12, LastDrain: now}
+
+	assert.Equal(t, time.Duration(0), Snapshot{Config: testRegistryConfig}.TimeToEmpty(now))
+	assert.Equal(t, 3*time.Minute, snapshot.TimeToEmpty(now))
+	assert.Equal(t, 90*time.Second, snapshot.TimeToEmpty(now.Add(90*time.Second)))
+	assert.Equal(t, time.Duration(0), snapshot.TimeToEmpty(now.Add(time.Hour)))
+
+	snapshot.Config.Mode = DrainContinuous
+	assert.Equal(t, 144*time.Second, snapshot.TimeToEmpty(now))
+	assert.Equal(t, 54*time.Second, snapshot.TimeToEmpty(now.Add(90*time.Second)))
+}
+
+// TestSnapshot_MatchesBucket runs the same random operations against a Snapshot and a Bucket, checking
+// that they agree.
+func TestSnapshot_MatchesBucket(t *testing.T) {
+	configs := []Config{
+		testRegistryConfig,
+		{DrainBy: 3, DrainInterval: 7 * time.Second, Capacity: 50, Mode: DrainContinuous},
+		{DrainBy: 7, DrainInterval: 3 * time.Second, Capacity: 50, OverflowLimit: 5},
+	}
+	for i, config := range configs {
+		random := rand.New(rand.NewSource(int64(i)))
+		clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		bucket, err := NewBucketFromConfig(config, WithClock(clock))
+		if err != nil {
+			t.Fatalf("TestSnapshot_MatchesBucket(case:%d): unexpected error %v", i, err)
+		}
+		snapshot := bucket.Snapshot()
+
+		for op := 0; op < 500; op++ {
+			clock.Advance(time.Duration(random.Int63n(int64(config.DrainInterval) * 2)))
+			amount := random.Int63n(config.Capacity/2) - config.Capacity/8
+			bucketErr := bucket.Add(amount)
+			var snapshotErr error
+			snapshot, snapshotErr = snapshot.Add(amount, clock.Now())
+			assert.Equal(t, bucketErr, snapshotErr, "TestSnapshot_MatchesBucket(case:%d, op:%d)", i, op)
+			if errors.Is(bucketErr, ErrBucketFull) {
+				assert.Nil(t, bucket.Set(config.Capacity/2), "TestSnapshot_MatchesBucket(case:%d, op:%d)", i, op)
+				snapshot = bucket.Snapshot()
+			}
+			if !assert.True(t, snapshot.Equal(bucket.Snapshot()), "TestSnapshot_MatchesBucket(case:%d, op:%d)", i, op) {
+				break
+			}
+		}
+	}
+}
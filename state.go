@@ -0,0 +1,144 @@
+package leaky
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// stateFormat is the format version written by EncodeState. It is distinct from the versions written by
+// Encode so that each decoder can reject the other's data.
+const stateFormat = int32(0x53540001) // "ST" followed by version 1
+
+// EncodeState writes only the bucket's value and last drain time to the provided io.Writer. Unlike Encode,
+// the bucket's parameters (DrainBy, DrainInterval, Capacity, OverflowLimit, and Mode) are not written, so
+// the state can be restored into a bucket created from the current configuration with DecodeStateInto.
+//
+// The state is framed by a length and followed by a CRC-32 checksum, in the same way as Encode.
+//
+// Example usage:
+//
+//	buf := &bytes.Buffer{}
+//	if err := bucket.EncodeState(buf); err != nil {
+//		log.Fatal(err)
+//	}
+//
+// Parameters:
+//
+//	w   - an io.Writer interface to which the binary data will be written
+//
+// Return values:
+//
+//	error   - error message if any errors occurred during writing or encoding
+func (b *Bucket) EncodeState(w io.Writer) error {
+	payload, err := b.encodeStatePayload()
+	if err != nil {
+		return err
+	}
+
+	if err = binary.Write(w, binary.BigEndian, stateFormat); err != nil {
+		return errors.Join(errors.New("leaky: unable to write state format version"), err)
+	}
+	if err = binary.Write(w, binary.BigEndian, uint32(len(payload))); err != nil {
+		return errors.Join(errors.New("leaky: unable to write payload length"), err)
+	}
+	if _, err = w.Write(payload); err != nil {
+		return errors.Join(errors.New("leaky: unable to write payload"), err)
+	}
+	if err = binary.Write(w, binary.BigEndian, crc32.ChecksumIEEE(payload)); err != nil {
+		return errors.Join(errors.New("leaky: unable to write checksum"), err)
+	}
+	return nil
+}
+
+// encodeStatePayload produces the EncodeState payload: the value, then the length-prefixed last drain time.
+func (b *Bucket) encodeStatePayload() ([]byte, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	timestampBytes, err := b.lastDrain.MarshalBinary()
+	if err != nil {
+		return nil, errors.Join(errors.New("leaky: unable to marshal `lastDrain`"), err)
+	}
+	payload := make([]byte, 0, 32)
+	payload = binary.BigEndian.AppendUint64(payload, uint64(b.value))
+	payload = append(payload, byte(len(timestampBytes)))
+	payload = append(payload, timestampBytes...)
+	return payload, nil
+}
+
+// DecodeStateInto reads state written by EncodeState and applies it to the given bucket, keeping the
+// bucket's current parameters. The bucket is only modified if the whole state is read successfully.
+//
+// If the restored value exceeds the bucket's Capacity, such as when the capacity was lowered since the
+// state was encoded, the value is reduced to Capacity. The bucket is then full, and drains from the
+// restored last drain time as normal. This avoids a reduced capacity causing buckets to stay full for
+// longer than the new configuration would allow.
+//
+// Example usage:
+//
+//	bucket, err := leaky.NewBucketFromConfig(currentConfig)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	if err = leaky.DecodeStateInto(bytes.NewBuffer(myEncodedState), bucket); err != nil {
+//		log.Fatal(err)
+//	}
+//
+// Parameters:
+//
+//	r       - an io.Reader interface from which the binary data will be read
+//	bucket  - the bucket to restore the state into
+//
+// Return values:
+//
+//	error   - error message if any errors occurred during reading or decoding
+func DecodeStateInto(r io.Reader, bucket *Bucket) error {
+	format := int32(0)
+	if err := binary.Read(r, binary.BigEndian, &format); err != nil {
+		return errors.Join(errors.New("leaky: unable to read state format version"), err)
+	}
+	if format != stateFormat {
+		return fmt.Errorf("leaky: unsupported state format version %d", format)
+	}
+	length := uint32(0)
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return errors.Join(errors.New("leaky: unable to read payload length"), err)
+	}
+	if length > maxPayloadSize {
+		return fmt.Errorf("leaky: invalid payload length %d", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return errors.Join(errors.New("leaky: unable to read payload"), err)
+	}
+	checksum := uint32(0)
+	if err := binary.Read(r, binary.BigEndian, &checksum); err != nil {
+		return errors.Join(errors.New("leaky: unable to read checksum"), err)
+	}
+	if actual := crc32.ChecksumIEEE(payload); actual != checksum {
+		return fmt.Errorf("leaky: checksum mismatch (expected %08x, got %08x)", checksum, actual)
+	}
+
+	if len(payload) < 9 {
+		return errors.New("leaky: payload too short")
+	}
+	value := int64(binary.BigEndian.Uint64(payload))
+	timestampSize := int(payload[8])
+	if len(payload) != 9+timestampSize {
+		return errors.New("leaky: invalid size of `lastDrain`")
+	}
+	lastDrain := time.Time{}
+	if err := lastDrain.UnmarshalBinary(payload[9:]); err != nil {
+		return errors.Join(errors.New("leaky: unable to unmarshal `lastDrain`"), err)
+	}
+
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	bucket.resetValueLocked(max(0, min(value, bucket.Capacity)))
+	bucket.lastDrain = lastDrain
+	return nil
+}
@@ -0,0 +1,95 @@
+package leaky
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucket_EncodeState(t *testing.T) {
+	bucket := newMarshalTestBucket(t)
+
+	errorMessages := []string{
+		"leaky: unable to write state format version",
+		"leaky: unable to write payload length",
+		"leaky: unable to write payload",
+		"leaky: unable to write checksum",
+	}
+	for j, message := range errorMessages {
+		rw := newFaultyReaderWriter(j+1, j+1)
+		if err := bucket.EncodeState(rw); err != nil {
+			assert.ErrorContainsf(t, err, message, "TestBucket_EncodeState(msg:%d)", j)
+		} else {
+			t.Errorf("TestBucket_EncodeState(msg:%d): expected error %s", j, message)
+		}
+	}
+}
+
+func TestDecodeStateInto(t *testing.T) {
+	bucket := newMarshalTestBucket(t)
+	buf := &bytes.Buffer{}
+	if err := bucket.EncodeState(buf); err != nil {
+		t.Fatalf("TestDecodeStateInto: unexpected encode error %v", err)
+	}
+	encoded := bytes.Clone(buf.Bytes())
+
+	// Keeps the target's configuration
+	config := Config{DrainBy: 10, DrainInterval: time.Hour, Capacity: 500}
+	bucket2, err := NewBucketFromConfig(config)
+	if err != nil {
+		t.Fatalf("TestDecodeStateInto: unexpected error %v", err)
+	}
+	if err = DecodeStateInto(buf, bucket2); err != nil {
+		t.Fatalf("TestDecodeStateInto: unexpected decode error %v", err)
+	}
+	assert.Equal(t, config, bucket2.Config())
+	assert.Equal(t, bucket.value, bucket2.value)
+	assert.Equal(t, 0, bucket.lastDrain.Compare(bucket2.lastDrain))
+
+	// Reduces the value to a lowered capacity
+	config.Capacity = 10
+	bucket2, err = NewBucketFromConfig(config)
+	if err != nil {
+		t.Fatalf("TestDecodeStateInto: unexpected error %v", err)
+	}
+	if err = DecodeStateInto(bytes.NewBuffer(encoded), bucket2); err != nil {
+		t.Fatalf("TestDecodeStateInto: unexpected decode error %v", err)
+	}
+	assert.Equal(t, int64(10), bucket2.value)
+	assert.Equal(t, 0, bucket.lastDrain.Compare(bucket2.lastDrain))
+
+	// Not interchangeable with Encode
+	_, err = DecodeBucket(bytes.NewBuffer(encoded))
+	assert.ErrorContains(t, err, "leaky: unsupported format version")
+	full := &bytes.Buffer{}
+	if err = bucket.Encode(full); err != nil {
+		t.Fatalf("TestDecodeStateInto: unexpected encode error %v", err)
+	}
+	assert.EqualError(t, DecodeStateInto(full, bucket2), "leaky: unsupported state format version 2")
+
+	// Read failures leave the bucket untouched
+	errorMessages := []string{
+		"leaky: unable to read state format version",
+		"leaky: unable to read payload length",
+		"leaky: unable to read payload",
+		"leaky: unable to read checksum",
+	}
+	for j, message := range errorMessages {
+		bucket2.value = 1
+		rw := newFaultyReaderWriter(j+1, j+1)
+		rw.Buffer = bytes.NewBuffer(encoded)
+		if err = DecodeStateInto(rw, bucket2); err != nil {
+			assert.ErrorContainsf(t, err, message, "TestDecodeStateInto(msg:%d)", j)
+		} else {
+			t.Errorf("TestDecodeStateInto(msg:%d): expected error %s", j, message)
+		}
+		assert.Equalf(t, int64(1), bucket2.value, "TestDecodeStateInto(msg:%d)", j)
+	}
+
+	// Detects corruption
+	corrupted := bytes.Clone(encoded)
+	corrupted[10] ^= 0x01
+	assert.ErrorContains(t, DecodeStateInto(bytes.NewBuffer(corrupted), bucket2), "leaky: checksum mismatch")
+}
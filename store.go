@@ -0,0 +1,117 @@
+package leaky
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	// updateMinBackoff is how long UpdateBucket waits before its first retry.
+	updateMinBackoff = time.Millisecond
+
+	// updateMaxBackoff is the longest UpdateBucket waits between retries.
+	updateMaxBackoff = 100 * time.Millisecond
+)
+
+// ErrNotFound represents an error indicating that a Store has no bucket for the requested key.
+var ErrNotFound = errors.New("leaky: bucket not found")
+
+// Store persists buckets by key, allowing them to survive process restarts or be shared between processes.
+//
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// Load returns the bucket stored for the given key, or ErrNotFound if there is none.
+	Load(ctx context.Context, key string) (*Bucket, error)
+
+	// Save stores the bucket for the given key, replacing any existing bucket.
+	Save(ctx context.Context, key string, bucket *Bucket) error
+
+	// CompareAndSwap stores the new bucket for the given key only if the currently stored bucket is
+	// identical to old. If old is nil, the new bucket is only stored if there is no bucket for the key.
+	// It returns false, without error, if the stored bucket did not match.
+	CompareAndSwap(ctx context.Context, key string, old *Bucket, new *Bucket) (bool, error)
+}
+
+// UpdateBucket applies fn to the bucket stored for the given key, saving the result with CompareAndSwap.
+// If the stored bucket changes while fn runs, the bucket is loaded again and fn is retried after a short,
+// increasing delay. If there is no bucket for the key, create is called to make one. The update stops with
+// the context's error if the context is cancelled while retrying.
+//
+// fn is called with a copy of the stored bucket, and may return an error to abort the update. For example,
+// fn may call Add on the bucket and return its error so that a full bucket is not saved.
+//
+// Example usage:
+//
+//	err := leaky.UpdateBucket(ctx, store, userId, func() (*leaky.Bucket, error) {
+//		return leaky.NewBucket(5, time.Minute, 300)
+//	}, func(bucket *leaky.Bucket) error {
+//		return bucket.Add(1)
+//	})
+//	if errors.Is(err, leaky.ErrBucketFull) {
+//		// rate limited
+//	}
+//
+// Parameters:
+//
+//	ctx     - the context for store operations
+//	store   - the store holding the bucket
+//	key     - the key of the bucket
+//	create  - called to create the bucket if it does not exist
+//	fn      - called to modify the bucket
+//
+// Return values:
+//
+//	error   - the error returned by create, fn, the store, or the context's error
+func UpdateBucket(ctx context.Context, store Store, key string, create func() (*Bucket, error), fn func(bucket *Bucket) error) error {
+	backoff := updateMinBackoff
+	for {
+		current, err := store.Load(ctx, key)
+		var next *Bucket
+		if errors.Is(err, ErrNotFound) {
+			current = nil
+			if next, err = create(); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		} else {
+			next = current.clone()
+		}
+
+		if err = fn(next); err != nil {
+			return err
+		}
+		if swapped, err := store.CompareAndSwap(ctx, key, current, next); err != nil {
+			return err
+		} else if swapped {
+			return nil
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, updateMaxBackoff)
+	}
+}
+
+// clone returns a copy of the bucket's parameters, state, and clock.
+func (b *Bucket) clone() *Bucket {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return &Bucket{
+		DrainBy:       b.DrainBy,
+		DrainInterval: b.DrainInterval,
+		Capacity:      b.Capacity,
+		OverflowLimit: b.OverflowLimit,
+		Mode:          b.Mode,
+		value:         b.value,
+		lastDrain:     b.lastDrain,
+		clock:         b.clock,
+	}
+}